@@ -105,8 +105,10 @@ The dumpgenesis command dumps the genesis block configuration in JSON format to
 			utils.MetricsInfluxDBBucketFlag,
 			utils.MetricsInfluxDBOrganizationFlag,
 			utils.TxLookupLimitFlag,
-			// record-replay: geth import --substatedir flag
+			// record-replay: geth import --substatedir, --substate-layout and --substate-compression flags
 			research.SubstateDirFlag,
+			research.SubstateLayoutFlag,
+			research.SubstateCompressionFlag,
 		},
 		Category: "BLOCKCHAIN COMMANDS",
 		Description: `
@@ -238,12 +240,6 @@ func dumpGenesis(ctx *cli.Context) error {
 }
 
 func importChain(ctx *cli.Context) error {
-
-	// record-replay: importChain OpenSubstateDB
-	research.SetSubstateFlags(ctx)
-	research.OpenSubstateDB()
-	defer research.CloseSubstateDB()
-
 	if len(ctx.Args()) < 1 {
 		utils.Fatalf("This command requires an argument.")
 	}
@@ -258,6 +254,34 @@ func importChain(ctx *cli.Context) error {
 	chain, db := utils.MakeChain(ctx, stack)
 	defer db.Close()
 
+	// record-replay: importChain opens substate DB and records substates into it
+	substateOpts, err := research.SubstateDBOptionsFromFlags(ctx, false)
+	if err != nil {
+		utils.Fatalf("%v", err)
+	}
+	substateDB, err := research.OpenSubstateDBWithOptions(substateOpts)
+	if err != nil {
+		utils.Fatalf("%v", err)
+	}
+	defer substateDB.Close()
+	substateMetadata, err := substateDB.GetMetadata()
+	if err != nil {
+		utils.Fatalf("%v", err)
+	}
+	genesisHash := chain.Genesis().Hash()
+	if h := substateMetadata.GenesisHash; h != (common.Hash{}) && h != genesisHash {
+		utils.Fatalf("Substate DB was recorded from genesis %s, not %s", h.Hex(), genesisHash.Hex())
+	}
+	err = substateDB.PutMetadata(&research.SubstateDBMetadata{
+		ChainConfig: chain.Config(),
+		GenesisHash: genesisHash,
+		Recorder:    gitCommit,
+	})
+	if err != nil {
+		utils.Fatalf("%v", err)
+	}
+	chain.SetSubstateDB(substateDB)
+
 	// Start periodically gathering memory profiles
 	var peakMemAlloc, peakMemSys uint64
 	go func() {
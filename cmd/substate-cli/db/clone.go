@@ -3,8 +3,8 @@ package db
 import (
 	"fmt"
 	"strconv"
+	"time"
 
-	"github.com/ethereum/go-ethereum/core/rawdb"
 	"github.com/ethereum/go-ethereum/research"
 	cli "gopkg.in/urfave/cli.v1"
 )
@@ -16,6 +16,8 @@ var CloneCommand = cli.Command{
 	ArgsUsage: "<srcPath> <dstPath> <blockNumFirst> <blockNumLast>",
 	Flags: []cli.Flag{
 		research.WorkersFlag,
+		research.SubstateLayoutFlag,
+		research.SubstateCompressionFlag,
 	},
 	Description: `
 The substate-cli db clone command requires four arguments:
@@ -23,7 +25,10 @@ The substate-cli db clone command requires four arguments:
 <srcPath> is the original substate database to read the information.
 <dstPath> is the target substate database to write the information
 <blockNumFirst> and <blockNumLast> are the first and
-last block of the inclusive range of blocks to clone.`,
+last block of the inclusive range of blocks to clone.
+
+Substates are written to <dstPath> in the layout and with the compression
+given by --substate-layout and --substate-compression.`,
 }
 
 func clone(ctx *cli.Context) error {
@@ -47,33 +52,89 @@ func clone(ctx *cli.Context) error {
 		return fmt.Errorf("substate-cli db clone: error: first block has larger number than last block")
 	}
 
-	srcBackend, err := rawdb.NewLevelDBDatabase(srcPath, 1024, 100, "srcDB", true)
+	srcDB, err := research.OpenSubstateDBWithOptions(research.NewSubstateDBOptions(srcPath, true))
 	if err != nil {
-		return fmt.Errorf("substate-cli db clone: error opening %s: %v", srcPath, err)
+		return fmt.Errorf("substate-cli db clone: %v", err)
 	}
-	srcDB := research.NewSubstateDB(srcBackend)
 	defer srcDB.Close()
 
+	layout, err := research.ParseSubstateLayout(ctx.String(research.SubstateLayoutFlag.Name))
+	if err != nil {
+		return fmt.Errorf("substate-cli db clone: %v", err)
+	}
+	compressor, err := research.SubstateCompressorByName(ctx.String(research.SubstateCompressionFlag.Name))
+	if err != nil {
+		return fmt.Errorf("substate-cli db clone: %v", err)
+	}
+
 	// Create dst DB
-	dstBackend, err := rawdb.NewLevelDBDatabase(dstPath, 1024, 100, "srcDB", false)
+	dstOpts := research.NewSubstateDBOptions(dstPath, false)
+	dstOpts.Layout = layout
+	dstOpts.Compressor = compressor
+	dstDB, err := research.OpenSubstateDBWithOptions(dstOpts)
 	if err != nil {
-		return fmt.Errorf("substate-cli db clone: error creating %s: %v", dstPath, err)
+		return fmt.Errorf("substate-cli db clone: %v", err)
 	}
-	dstDB := research.NewSubstateDB(dstBackend)
 	defer dstDB.Close()
 
-	cloneTask := func(block uint64, tx int, substate *research.Substate) (research.WorkerResult, error) {
-        var result research.VanillaWorkerResult
-        result.BlockId = block
-        result.TxId = tx
-		dstDB.PutSubstate(block, tx, substate)
-		return result, nil
+	start := time.Now()
+	numSubstates := int64(0)
+
+	iter := srcDB.NewSubstateIterator(uint64(first), uint64(last), ctx.Int(research.WorkersFlag.Name))
+	defer iter.Release()
+	for iter.Next() {
+		entry := iter.Value()
+		err = dstDB.PutSubstate(entry.Block, entry.Tx, entry.Substate)
+		if err != nil {
+			return fmt.Errorf("substate-cli db clone: %v", err)
+		}
+		numSubstates++
+	}
+	if err = iter.Error(); err != nil {
+		return fmt.Errorf("substate-cli db clone: %v", err)
+	}
+
+	numSummaries := int64(0)
+	err = srcDB.ForEachBlockSummary(uint64(first), uint64(last), func(block uint64, summary *research.BlockSummary) error {
+		numSummaries++
+		return dstDB.PutBlockSummary(block, summary)
+	})
+	if err != nil {
+		return fmt.Errorf("substate-cli db clone: %v", err)
 	}
 
-	taskPool := research.NewSubstateTaskPool("substate-cli db clone",
-        cloneTask, research.VanillaCollectorAction, research.VanillaCollectorInit,
-        uint64(first), uint64(last), ctx)
-	taskPool.DB = srcDB
-	_, err = taskPool.Execute()
-	return err
+	numTxHashes, err := dstDB.CopyTxHashes(srcDB, uint64(first), uint64(last))
+	if err != nil {
+		return fmt.Errorf("substate-cli db clone: %v", err)
+	}
+
+	// copy metadata, add recorded blocks in the range to dst DB
+	metadata, err := srcDB.GetMetadata()
+	if err != nil {
+		return fmt.Errorf("substate-cli db clone: %v", err)
+	}
+	blocks := research.IntersectBlockIntervals(metadata.Blocks, uint64(first), uint64(last))
+	metadata.Blocks = nil
+	err = dstDB.PutMetadata(metadata)
+	if err != nil {
+		return fmt.Errorf("substate-cli db clone: %v", err)
+	}
+	for _, interval := range blocks {
+		err = dstDB.AddRecordedBlocks(interval.First, interval.Last)
+		if err != nil {
+			return fmt.Errorf("substate-cli db clone: %v", err)
+		}
+	}
+	err = dstDB.FlushRecordedBlocks()
+	if err != nil {
+		return fmt.Errorf("substate-cli db clone: %v", err)
+	}
+
+	fmt.Printf("substate-cli db clone: block range = %v %v\n", first, last)
+	fmt.Printf("substate-cli db clone: total #substate = %v\n", numSubstates)
+	fmt.Printf("substate-cli db clone: total #block summary = %v\n", numSummaries)
+	fmt.Printf("substate-cli db clone: total #tx hash = %v\n", numTxHashes)
+	fmt.Printf("substate-cli db clone: done in %v\n", time.Since(start).Round(1*time.Millisecond))
+
+	return nil
 }
@@ -5,6 +5,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/ethereum/go-ethereum/research"
 	"github.com/syndtr/goleveldb/leveldb"
 	leveldb_opt "github.com/syndtr/goleveldb/leveldb/opt"
 	leveldb_util "github.com/syndtr/goleveldb/leveldb/util"
@@ -20,7 +21,8 @@ var CompactCommand = cli.Command{
 	Description: `
 The substate-cli db compact command requires one argument:
 	<dbPath>
-<dbPath> is the target LevelDB instance to compact.`,
+<dbPath> is the target LevelDB instance to compact, or a manifest file of a
+sharded substate DB to compact all of its shards.`,
 }
 
 func compact(ctx *cli.Context) error {
@@ -30,6 +32,9 @@ func compact(ctx *cli.Context) error {
 	}
 
 	dbPath := ctx.Args().Get(0)
+	if research.IsSubstateDBManifest(dbPath) {
+		return compactShards(dbPath)
+	}
 	dbOpt := &leveldb_opt.Options{
 		BlockCacheCapacity:     1 * leveldb_opt.GiB,
 		OpenFilesCacheCapacity: 50,
@@ -60,3 +65,22 @@ func compact(ctx *cli.Context) error {
 
 	return nil
 }
+
+// compactShards compacts all shards of a sharded substate DB.
+func compactShards(manifestPath string) error {
+	db, err := research.OpenSubstateDBWithOptions(research.NewSubstateDBOptions(manifestPath, false))
+	if err != nil {
+		return fmt.Errorf("substate-cli db compact: %v", err)
+	}
+	defer db.Close()
+
+	start := time.Now()
+	fmt.Printf("substate-cli db compact: compaction begin\n")
+	if err := db.Compact(nil, nil); err != nil {
+		return fmt.Errorf("substate-cli db compact: error compacting %s: %v", manifestPath, err)
+	}
+	fmt.Printf("substate-cli db compact: compaction completed\n")
+	fmt.Printf("substate-cli db compact: elapsed time: %v\n", time.Since(start).Round(1*time.Millisecond))
+
+	return nil
+}
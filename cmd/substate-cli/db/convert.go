@@ -0,0 +1,91 @@
+package db
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/research"
+	cli "gopkg.in/urfave/cli.v1"
+)
+
+var LayoutFlag = cli.StringFlag{
+	Name:  "layout",
+	Usage: "Target layout of substate values: inline or dedup",
+	Value: research.DedupAccountLayout.String(),
+}
+
+var ConvertCommand = cli.Command{
+	Action:    convert,
+	Name:      "convert",
+	Usage:     "Convert substates between inline and deduplicated account layouts in place",
+	ArgsUsage: "<dbPath>",
+	Flags: []cli.Flag{
+		LayoutFlag,
+	},
+	Description: `
+The substate-cli db convert command requires one argument:
+    <dbPath>
+<dbPath> is the substate database to convert in place.
+
+--layout=dedup stores each distinct account state (nonce, balance, code hash
+and storage) once under the "1a" prefix and references it by hash from
+substate values. --layout=inline embeds account states in substate values
+again and deletes all account records. Substate values keep their
+compression, see substate-cli db recompress.
+
+The size of each key space is reported before and after conversion.
+Run substate-cli db compact afterwards to reclaim disk space.`,
+}
+
+func printKeySpaceSizes(name string, sizes []*research.KeySpaceSize) {
+	total := int64(0)
+	for _, size := range sizes {
+		fmt.Printf("%s: %-2s %-10s %12v entries %12v\n", name,
+			size.Prefix, research.KeySpaceName(size.Prefix), size.Count, common.StorageSize(size.Bytes))
+		total += size.Bytes
+	}
+	fmt.Printf("%s: total %36v\n", name, common.StorageSize(total))
+}
+
+func convert(ctx *cli.Context) error {
+	if len(ctx.Args()) != 1 {
+		return fmt.Errorf("substate-cli db convert: command requires exactly 1 argument")
+	}
+
+	layout, err := research.ParseSubstateLayout(ctx.String(LayoutFlag.Name))
+	if err != nil {
+		return fmt.Errorf("substate-cli db convert: %v", err)
+	}
+
+	dbPath := ctx.Args().Get(0)
+	db, err := research.OpenSubstateDBWithOptions(research.NewSubstateDBOptions(dbPath, false))
+	if err != nil {
+		return fmt.Errorf("substate-cli db convert: %v", err)
+	}
+	defer db.Close()
+
+	sizes, err := db.KeySpaceSizes()
+	if err != nil {
+		return fmt.Errorf("substate-cli db convert: %v", err)
+	}
+	fmt.Printf("substate-cli db convert: size before conversion\n")
+	printKeySpaceSizes("substate-cli db convert", sizes)
+
+	start := time.Now()
+	converted, err := db.ConvertLayout(layout)
+	if err != nil {
+		return fmt.Errorf("substate-cli db convert: %v", err)
+	}
+	fmt.Printf("substate-cli db convert: %v substates converted to %v layout in %v\n",
+		converted, layout, time.Since(start).Round(1*time.Millisecond))
+
+	sizes, err = db.KeySpaceSizes()
+	if err != nil {
+		return fmt.Errorf("substate-cli db convert: %v", err)
+	}
+	fmt.Printf("substate-cli db convert: size after conversion\n")
+	printKeySpaceSizes("substate-cli db convert", sizes)
+
+	return nil
+}
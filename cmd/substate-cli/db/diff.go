@@ -0,0 +1,107 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/ethereum/go-ethereum/research"
+	cli "gopkg.in/urfave/cli.v1"
+)
+
+var DiffCommand = cli.Command{
+	Action:    diff,
+	Name:      "diff",
+	Usage:     "Compare substates of a given range of blocks in two substate DBs",
+	ArgsUsage: "<dbA> <dbB> [<blockNumFirst> <blockNumLast>]",
+	Flags: []cli.Flag{
+		research.WorkersFlag,
+		research.TxHashFlag,
+		research.AddressFlag,
+		JSONFlag,
+	},
+	Description: `
+The substate-cli db diff command requires four arguments:
+    <dbA> <dbB> <blockNumFirst> <blockNumLast>
+<dbA> and <dbB> are the substate databases to compare, e.g. substates
+recorded by an old and a new version of geth.
+<blockNumFirst> and <blockNumLast> are the first and last block of the
+inclusive range of blocks to compare.
+With --tx-hash or --address, only selected transactions are compared and
+the block range is optional. Transactions are selected by the indices of
+both substate DBs.
+
+The following differences are reported with block and tx of the substate:
+    missing    substate only in <dbA>
+    extra      substate only in <dbB>
+    different  substates that differ in InputAlloc, OutputAlloc, Env,
+               Message or Result, followed by the differing fields
+With --json, each difference is printed as a JSON object per line.
+The command exits with a non-zero status if any difference is found.`,
+}
+
+func diff(ctx *cli.Context) error {
+	selector, err := research.ParseSubstateSelector(ctx)
+	if err != nil {
+		return fmt.Errorf("substate-cli db diff: %v", err)
+	}
+	if len(ctx.Args()) != 4 && !(selector != nil && len(ctx.Args()) == 2) {
+		return fmt.Errorf("substate-cli db diff: command requires exactly 4 arguments, or 2 with --tx-hash or --address")
+	}
+
+	first, last, err := parseBlockRange(ctx.Args()[2:])
+	if err != nil {
+		return fmt.Errorf("substate-cli db diff: %v", err)
+	}
+
+	dbA, err := research.OpenSubstateDBWithOptions(research.NewSubstateDBOptions(ctx.Args().Get(0), true))
+	if err != nil {
+		return fmt.Errorf("substate-cli db diff: %v", err)
+	}
+	defer dbA.Close()
+	dbB, err := research.OpenSubstateDBWithOptions(research.NewSubstateDBOptions(ctx.Args().Get(1), true))
+	if err != nil {
+		return fmt.Errorf("substate-cli db diff: %v", err)
+	}
+	defer dbB.Close()
+
+	jsonOutput := ctx.Bool(JSONFlag.Name)
+	encoder := json.NewEncoder(os.Stdout)
+	var encodeErr error
+	report := func(d *research.SubstateDiff) {
+		if jsonOutput {
+			if err := encoder.Encode(d); err != nil && encodeErr == nil {
+				encodeErr = err
+			}
+			return
+		}
+		fmt.Printf("substate-cli db diff: %v\n", d)
+		for i := range d.Fields {
+			fmt.Printf("    %v\n", &d.Fields[i])
+		}
+	}
+
+	start := time.Now()
+	var stats *research.DiffStats
+	if selector != nil {
+		stats, err = research.DiffSelectedSubstates(dbA, dbB, selector, first, last, report)
+	} else {
+		stats, err = research.DiffSubstateDBs(dbA, dbB, first, last, ctx.Int(research.WorkersFlag.Name), report)
+	}
+	if err != nil {
+		return fmt.Errorf("substate-cli db diff: %v", err)
+	}
+	if encodeErr != nil {
+		return fmt.Errorf("substate-cli db diff: error writing difference: %v", encodeErr)
+	}
+	if !jsonOutput {
+		fmt.Printf("substate-cli db diff: %v common substates, %v missing, %v extra, %v different, compared in %v\n",
+			stats.NumCommon, stats.NumMissing, stats.NumExtra, stats.NumDifferent, time.Since(start).Round(1*time.Millisecond))
+	}
+	if n := stats.NumDiffs(); n > 0 {
+		return fmt.Errorf("substate-cli db diff: %v differences found", n)
+	}
+
+	return nil
+}
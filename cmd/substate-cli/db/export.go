@@ -0,0 +1,115 @@
+package db
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/research"
+	cli "gopkg.in/urfave/cli.v1"
+)
+
+var OutFlag = cli.StringFlag{
+	Name:  "out",
+	Usage: "Output file, gzip-compressed if it ends with .gz (default: stdout)",
+}
+
+var ExportCommand = cli.Command{
+	Action:    export,
+	Name:      "export",
+	Usage:     "Export substates of a given range of blocks to JSON Lines",
+	ArgsUsage: "<dbPath> [<blockNumFirst> <blockNumLast>]",
+	Flags: []cli.Flag{
+		research.WorkersFlag,
+		research.TxHashFlag,
+		research.AddressFlag,
+		OutFlag,
+	},
+	Description: `
+The substate-cli db export command requires three arguments:
+    <dbPath> <blockNumFirst> <blockNumLast>
+<dbPath> is the substate database to read substates.
+<blockNumFirst> and <blockNumLast> are the first and
+last block of the inclusive range of blocks to export.
+With --tx-hash or --address, only selected transactions are exported and
+the block range is optional.
+
+Each line of the output is a JSON object {"block": N, "tx": T, "substate": S}
+where S is the JSON encoding of the substate. Exports of a block range start
+with a header line {"header": H} that lists the recorded blocks of the range.
+Use substate-cli db import to write the substates back into a substate DB.`,
+}
+
+func export(ctx *cli.Context) error {
+	selector, err := research.ParseSubstateSelector(ctx)
+	if err != nil {
+		return fmt.Errorf("substate-cli db export: %v", err)
+	}
+	if len(ctx.Args()) != 3 && !(selector != nil && len(ctx.Args()) == 1) {
+		return fmt.Errorf("substate-cli db export: command requires exactly 3 arguments, or 1 with --tx-hash or --address")
+	}
+
+	dbPath := ctx.Args().Get(0)
+	first, last, err := parseBlockRange(ctx.Args()[1:])
+	if err != nil {
+		return fmt.Errorf("substate-cli db export: %v", err)
+	}
+
+	db, err := research.OpenSubstateDBWithOptions(research.NewSubstateDBOptions(dbPath, true))
+	if err != nil {
+		return fmt.Errorf("substate-cli db export: %v", err)
+	}
+	defer db.Close()
+
+	outPath := ctx.String(OutFlag.Name)
+	var out io.Writer = os.Stdout
+	if outPath != "" {
+		file, err := os.Create(outPath)
+		if err != nil {
+			return fmt.Errorf("substate-cli db export: %v", err)
+		}
+		defer file.Close()
+		out = file
+	}
+	bufOut := bufio.NewWriter(out)
+	out = bufOut
+	var gzipOut *gzip.Writer
+	if strings.HasSuffix(outPath, ".gz") {
+		gzipOut = gzip.NewWriter(bufOut)
+		out = gzipOut
+	}
+
+	start := time.Now()
+	var exported int64
+	if selector != nil {
+		var keys []research.SubstateKey
+		keys, err = db.SelectSubstates(selector, first, last)
+		if err == nil {
+			exported, err = db.ExportSelectedSubstates(out, keys, ctx.Int(research.WorkersFlag.Name))
+		}
+	} else {
+		exported, err = db.ExportSubstates(out, first, last, ctx.Int(research.WorkersFlag.Name))
+	}
+	if err != nil {
+		return fmt.Errorf("substate-cli db export: %v", err)
+	}
+	if gzipOut != nil {
+		if err := gzipOut.Close(); err != nil {
+			return fmt.Errorf("substate-cli db export: %v", err)
+		}
+	}
+	if err := bufOut.Flush(); err != nil {
+		return fmt.Errorf("substate-cli db export: %v", err)
+	}
+
+	if outPath != "" {
+		fmt.Printf("substate-cli db export: %v substates exported to %s in %v\n",
+			exported, outPath, time.Since(start).Round(1*time.Millisecond))
+	}
+
+	return nil
+}
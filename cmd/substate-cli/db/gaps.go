@@ -0,0 +1,166 @@
+package db
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/research"
+	"github.com/ethereum/go-ethereum/rlp"
+	cli "gopkg.in/urfave/cli.v1"
+)
+
+var IntervalsFlag = cli.StringFlag{
+	Name:  "intervals",
+	Usage: "File to write the block intervals to record again, one \"<blockNumFirst> <blockNumLast>\" line per interval",
+}
+
+var GapsCommand = cli.Command{
+	Action:    gaps,
+	Name:      "gaps",
+	Usage:     "Find blocks of a given range that are not completely recorded",
+	ArgsUsage: "[<blockNumFirst> <blockNumLast>]",
+	Flags: []cli.Flag{
+		research.SubstateDirFlag,
+		research.TxHashFlag,
+		research.AddressFlag,
+		DataDirFlag,
+		IntervalsFlag,
+		JSONFlag,
+	},
+	Description: `
+The substate-cli db gaps command requires two arguments:
+    <blockNumFirst> <blockNumLast>
+<blockNumFirst> and <blockNumLast> are the first and last block of the
+inclusive range of blocks to check in the substate DB given by --substatedir.
+With --tx-hash or --address, only the blocks of selected transactions are
+checked and the block range is optional.
+
+The following gaps are reported with their blocks:
+    no-substates  blocks without substates; without --datadir, blocks
+                  recorded by geth import are known to be empty and skipped
+    tx-gap        missing transaction indices within a block
+    tx-count      number of substates differs from the number of
+                  transactions of the canonical block, only with --datadir
+With --json, each gap is printed as a JSON object per line. With --intervals,
+the merged block intervals of all gaps are written to a file, e.g. to export
+and import these blocks again with geth.
+The command exits with a non-zero status if any gap is found.`,
+}
+
+func gaps(ctx *cli.Context) error {
+	selector, err := research.ParseSubstateSelector(ctx)
+	if err != nil {
+		return fmt.Errorf("substate-cli db gaps: %v", err)
+	}
+	if len(ctx.Args()) != 2 && !(selector != nil && len(ctx.Args()) == 0) {
+		return fmt.Errorf("substate-cli db gaps: command requires exactly 2 arguments, or none with --tx-hash or --address")
+	}
+
+	first, last, err := parseBlockRange(ctx.Args())
+	if err != nil {
+		return fmt.Errorf("substate-cli db gaps: %v", err)
+	}
+
+	dbPath := ctx.String(research.SubstateDirFlag.Name)
+	db, err := research.OpenSubstateDBWithOptions(research.NewSubstateDBOptions(dbPath, true))
+	if err != nil {
+		return fmt.Errorf("substate-cli db gaps: %v", err)
+	}
+	defer db.Close()
+
+	var txCount func(block uint64) (int, error)
+	if dataDir := ctx.String(DataDirFlag.Name); dataDir != "" {
+		chainDB, err := openChainDB(dataDir)
+		if err != nil {
+			return fmt.Errorf("substate-cli db gaps: %v", err)
+		}
+		defer chainDB.Close()
+
+		txCount = func(block uint64) (int, error) {
+			hash := rawdb.ReadCanonicalHash(chainDB, block)
+			if hash == (common.Hash{}) {
+				return 0, fmt.Errorf("block not found in chaindata")
+			}
+			body := rawdb.ReadBodyRLP(chainDB, hash, block)
+			if body == nil {
+				return 0, fmt.Errorf("block body %s not found in chaindata", hash.Hex())
+			}
+			// body is [transactions, uncles]
+			content, _, err := rlp.SplitList(body)
+			if err != nil {
+				return 0, err
+			}
+			txs, _, err := rlp.SplitList(content)
+			if err != nil {
+				return 0, err
+			}
+			return rlp.CountValues(txs)
+		}
+	}
+
+	jsonOutput := ctx.Bool(JSONFlag.Name)
+	encoder := json.NewEncoder(os.Stdout)
+	report := func(f *research.GapFinding) {
+		if jsonOutput {
+			encoder.Encode(f)
+		} else {
+			fmt.Printf("substate-cli db gaps: %v\n", f)
+		}
+	}
+
+	start := time.Now()
+	var stats *research.GapStats
+	if selector != nil {
+		var keys []research.SubstateKey
+		keys, err = db.SelectSubstates(selector, first, last)
+		if err == nil {
+			stats, err = db.FindSelectedGaps(keys, txCount, report)
+		}
+	} else {
+		stats, err = db.FindGaps(first, last, txCount, report)
+	}
+	if err != nil {
+		return fmt.Errorf("substate-cli db gaps: %v", err)
+	}
+	if !jsonOutput {
+		fmt.Printf("substate-cli db gaps: %v substates in %v blocks checked in %v\n",
+			stats.NumSubstates, stats.NumBlocks, time.Since(start).Round(1*time.Millisecond))
+		for _, interval := range stats.Missing {
+			fmt.Printf("substate-cli db gaps: missing blocks %v\n", interval)
+		}
+	}
+
+	if path := ctx.String(IntervalsFlag.Name); path != "" {
+		if err := writeBlockIntervals(path, stats.Missing); err != nil {
+			return fmt.Errorf("substate-cli db gaps: %v", err)
+		}
+	}
+	if stats.NumFindings > 0 {
+		return fmt.Errorf("substate-cli db gaps: %v gaps found", stats.NumFindings)
+	}
+
+	return nil
+}
+
+// writeBlockIntervals writes one "<first> <last>" line per interval.
+func writeBlockIntervals(path string, intervals []research.BlockInterval) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	w := bufio.NewWriter(file)
+	for _, interval := range intervals {
+		fmt.Fprintf(w, "%v %v\n", interval.First, interval.Last)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return file.Close()
+}
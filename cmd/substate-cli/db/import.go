@@ -0,0 +1,89 @@
+package db
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/research"
+	cli "gopkg.in/urfave/cli.v1"
+)
+
+var ImportCommand = cli.Command{
+	Action:    importSubstates,
+	Name:      "import",
+	Usage:     "Import substates from JSON Lines written by substate-cli db export",
+	ArgsUsage: "<dbPath> <file>",
+	Flags: []cli.Flag{
+		research.SubstateLayoutFlag,
+		research.SubstateCompressionFlag,
+	},
+	Description: `
+The substate-cli db import command requires two arguments:
+    <dbPath> <file>
+<dbPath> is the substate database to write substates.
+<file> is a JSON Lines file written by substate-cli db export,
+gzip-compressed if it ends with .gz.
+
+Substates are written in the layout and with the compression given by
+--substate-layout and --substate-compression. Block summaries of imported
+blocks are rebuilt from all their substates in the substate DB. Only the
+recorded blocks listed in the header of a block range export are marked as
+recorded; selected substates and failure files may be parts of blocks.`,
+}
+
+func importSubstates(ctx *cli.Context) error {
+	if len(ctx.Args()) != 2 {
+		return fmt.Errorf("substate-cli db import: command requires exactly 2 arguments")
+	}
+
+	dbPath := ctx.Args().Get(0)
+	inPath := ctx.Args().Get(1)
+
+	layout, err := research.ParseSubstateLayout(ctx.String(research.SubstateLayoutFlag.Name))
+	if err != nil {
+		return fmt.Errorf("substate-cli db import: %v", err)
+	}
+	compressor, err := research.SubstateCompressorByName(ctx.String(research.SubstateCompressionFlag.Name))
+	if err != nil {
+		return fmt.Errorf("substate-cli db import: %v", err)
+	}
+
+	file, err := os.Open(inPath)
+	if err != nil {
+		return fmt.Errorf("substate-cli db import: %v", err)
+	}
+	defer file.Close()
+	var in io.Reader = bufio.NewReader(file)
+	if strings.HasSuffix(inPath, ".gz") {
+		gzipIn, err := gzip.NewReader(in)
+		if err != nil {
+			return fmt.Errorf("substate-cli db import: %v", err)
+		}
+		defer gzipIn.Close()
+		in = gzipIn
+	}
+
+	opts := research.NewSubstateDBOptions(dbPath, false)
+	opts.Layout = layout
+	opts.Compressor = compressor
+	db, err := research.OpenSubstateDBWithOptions(opts)
+	if err != nil {
+		return fmt.Errorf("substate-cli db import: %v", err)
+	}
+	defer db.Close()
+
+	start := time.Now()
+	imported, err := db.ImportSubstates(in)
+	if err != nil {
+		return fmt.Errorf("substate-cli db import: %v", err)
+	}
+	fmt.Printf("substate-cli db import: %v substates imported from %s in %v\n",
+		imported, inPath, time.Since(start).Round(1*time.Millisecond))
+
+	return nil
+}
@@ -0,0 +1,112 @@
+package db
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/research"
+	cli "gopkg.in/urfave/cli.v1"
+)
+
+var DataDirFlag = cli.StringFlag{
+	Name:  "datadir",
+	Usage: "Data directory of geth that recorded the substate DB, to read transaction hashes",
+}
+
+var IndexCommand = cli.Command{
+	Action:    index,
+	Name:      "index",
+	Usage:     "Build tx hash and address indices of substates",
+	ArgsUsage: "<dbPath> [<blockNumFirst> <blockNumLast>]",
+	Flags: []cli.Flag{
+		DataDirFlag,
+	},
+	Description: `
+The substate-cli db index command requires one or three arguments:
+    <dbPath> [<blockNumFirst> <blockNumLast>]
+<dbPath> is the substate database to index in place.
+<blockNumFirst> and <blockNumLast> are the first and last block of the
+inclusive range of blocks to index, all blocks by default.
+
+The address index maps every address in InputAlloc, OutputAlloc and
+Message.To to the transactions that touched it. Substates do not contain
+transaction hashes, so the tx hash index is built only with --datadir, from
+the blocks of the chain that was recorded. geth import writes both indices
+while recording, so only substate DBs recorded by older versions need to be
+indexed.
+
+Indexed substates can be selected with --tx-hash and --address instead of a
+block range.`,
+}
+
+func index(ctx *cli.Context) error {
+	if len(ctx.Args()) != 1 && len(ctx.Args()) != 3 {
+		return fmt.Errorf("substate-cli db index: command requires exactly 1 or 3 arguments")
+	}
+
+	dbPath := ctx.Args().Get(0)
+	first, last, err := parseBlockRange(ctx.Args()[1:])
+	if err != nil {
+		return fmt.Errorf("substate-cli db index: %v", err)
+	}
+
+	db, err := research.OpenSubstateDBWithOptions(research.NewSubstateDBOptions(dbPath, false))
+	if err != nil {
+		return fmt.Errorf("substate-cli db index: %v", err)
+	}
+	defer db.Close()
+
+	start := time.Now()
+	numAddresses, err := db.IndexAddresses(first, last)
+	if err != nil {
+		return fmt.Errorf("substate-cli db index: %v", err)
+	}
+	fmt.Printf("substate-cli db index: addresses of %v substates indexed\n", numAddresses)
+
+	if dataDir := ctx.String(DataDirFlag.Name); dataDir != "" {
+		chainDB, err := openChainDB(dataDir)
+		if err != nil {
+			return fmt.Errorf("substate-cli db index: %v", err)
+		}
+		defer chainDB.Close()
+
+		txHashes := func(block uint64) ([]common.Hash, error) {
+			hash := rawdb.ReadCanonicalHash(chainDB, block)
+			if hash == (common.Hash{}) {
+				return nil, fmt.Errorf("block not found in chaindata")
+			}
+			body := rawdb.ReadBody(chainDB, hash, block)
+			if body == nil {
+				return nil, fmt.Errorf("block body %s not found in chaindata", hash.Hex())
+			}
+			hashes := make([]common.Hash, len(body.Transactions))
+			for i, tx := range body.Transactions {
+				hashes[i] = tx.Hash()
+			}
+			return hashes, nil
+		}
+		numTxHashes, err := db.IndexTxHashes(first, last, txHashes)
+		if err != nil {
+			return fmt.Errorf("substate-cli db index: %v", err)
+		}
+		fmt.Printf("substate-cli db index: hashes of %v substates indexed\n", numTxHashes)
+	}
+
+	fmt.Printf("substate-cli db index: done in %v\n", time.Since(start).Round(1*time.Millisecond))
+
+	return nil
+}
+
+// openChainDB opens the chaindata of a geth data directory read-only.
+func openChainDB(dataDir string) (ethdb.Database, error) {
+	chaindata := filepath.Join(dataDir, "geth", "chaindata")
+	chainDB, err := rawdb.NewLevelDBDatabaseWithFreezer(chaindata, 256, 64, filepath.Join(chaindata, "ancient"), "", true)
+	if err != nil {
+		return nil, fmt.Errorf("error opening chaindata %s: %v", chaindata, err)
+	}
+	return chainDB, nil
+}
@@ -0,0 +1,89 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/research"
+	cli "gopkg.in/urfave/cli.v1"
+)
+
+var InfoCommand = cli.Command{
+	Action:    info,
+	Name:      "info",
+	Usage:     "Print metadata of a substate DB",
+	ArgsUsage: "<dbPath>",
+	Flags:     []cli.Flag{},
+	Description: `
+The substate-cli db info command requires one argument:
+    <dbPath>
+<dbPath> is the substate database to describe.
+
+Metadata is written by geth import, substate-cli db upgrade and
+substate-cli db clone. Substate DBs written by older versions have no
+metadata.`,
+}
+
+func info(ctx *cli.Context) error {
+	if len(ctx.Args()) != 1 {
+		return fmt.Errorf("substate-cli db info: command requires exactly 1 argument")
+	}
+
+	dbPath := ctx.Args().Get(0)
+	db, err := research.OpenSubstateDBWithOptions(research.NewSubstateDBOptions(dbPath, true))
+	if err != nil {
+		return fmt.Errorf("substate-cli db info: %v", err)
+	}
+	defer db.Close()
+
+	metadata, err := db.GetMetadata()
+	if err != nil {
+		return fmt.Errorf("substate-cli db info: %v", err)
+	}
+
+	unknown := func(s string) string {
+		if s == "" {
+			return "unknown"
+		}
+		return s
+	}
+
+	version := ""
+	if metadata.Version != 0 {
+		version = fmt.Sprintf("%v", metadata.Version)
+	}
+	fmt.Printf("version: %s (supported: %v)\n", unknown(version), research.SubstateDBVersion)
+
+	genesis := ""
+	if metadata.GenesisHash != (common.Hash{}) {
+		genesis = metadata.GenesisHash.Hex()
+	}
+	fmt.Printf("genesis: %s\n", unknown(genesis))
+	fmt.Printf("recorder: %s\n", unknown(metadata.Recorder))
+
+	if len(metadata.Blocks) == 0 {
+		fmt.Printf("recorded blocks: unknown\n")
+	} else {
+		var numBlocks uint64
+		for _, interval := range metadata.Blocks {
+			numBlocks += interval.Last - interval.First + 1
+		}
+		fmt.Printf("recorded blocks: %v blocks in %v intervals\n", numBlocks, len(metadata.Blocks))
+		for _, interval := range metadata.Blocks {
+			fmt.Printf("    %v\n", interval)
+		}
+	}
+
+	if metadata.ChainConfig == nil {
+		fmt.Printf("chain config: unknown\n")
+	} else {
+		jbytes, err := json.MarshalIndent(metadata.ChainConfig, "", "  ")
+		if err != nil {
+			return fmt.Errorf("substate-cli db info: %v", err)
+		}
+		fmt.Printf("chain config:\n%s\n", jbytes)
+	}
+
+	return nil
+}
@@ -0,0 +1,103 @@
+package db
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ethereum/go-ethereum/research"
+	cli "gopkg.in/urfave/cli.v1"
+)
+
+var ConflictFlag = cli.StringFlag{
+	Name:  "conflict",
+	Usage: "Resolution of conflicting substates: keep (substate in dstPath or an earlier srcPath wins), overwrite (substate in a later srcPath wins), fail",
+	Value: "keep",
+}
+
+var MergeCommand = cli.Command{
+	Action:    merge,
+	Name:      "merge",
+	Usage:     "Merge substate DBs recorded in parallel into one substate DB",
+	ArgsUsage: "<dstPath> <srcPath>...",
+	Flags: []cli.Flag{
+		research.WorkersFlag,
+		research.SubstateLayoutFlag,
+		research.SubstateCompressionFlag,
+		ConflictFlag,
+	},
+	Description: `
+The substate-cli db merge command requires at least two arguments:
+    <dstPath> <srcPath>...
+<dstPath> is the substate database to merge substates into.
+<srcPath> are the substate databases to merge in the given order.
+
+Substates, code blobs, block summaries, tx hashes and metadata of all sources
+are copied into <dstPath>. Substates are written in the layout and with the
+compression given by --substate-layout and --substate-compression. If a source has a
+substate for a transaction that is already in <dstPath> with different
+content, the conflict is reported and resolved as given by --conflict.
+Sources recorded from a different genesis block or with a different chain
+config are rejected. Tx hashes are only copied with the substates taken from
+a source, and recorded blocks of a source are only added after all its
+substates are copied.`,
+}
+
+func merge(ctx *cli.Context) error {
+	if len(ctx.Args()) < 2 {
+		return fmt.Errorf("substate-cli db merge: command requires at least 2 arguments")
+	}
+
+	resolution, err := research.ParseMergeResolution(ctx.String(ConflictFlag.Name))
+	if err != nil {
+		return fmt.Errorf("substate-cli db merge: %v", err)
+	}
+	layout, err := research.ParseSubstateLayout(ctx.String(research.SubstateLayoutFlag.Name))
+	if err != nil {
+		return fmt.Errorf("substate-cli db merge: %v", err)
+	}
+	compressor, err := research.SubstateCompressorByName(ctx.String(research.SubstateCompressionFlag.Name))
+	if err != nil {
+		return fmt.Errorf("substate-cli db merge: %v", err)
+	}
+
+	dstPath := ctx.Args().Get(0)
+	opts := research.NewSubstateDBOptions(dstPath, false)
+	opts.Layout = layout
+	opts.Compressor = compressor
+	dstDB, err := research.OpenSubstateDBWithOptions(opts)
+	if err != nil {
+		return fmt.Errorf("substate-cli db merge: %v", err)
+	}
+	defer dstDB.Close()
+
+	start := time.Now()
+	var numConflicts int64
+	for _, srcPath := range ctx.Args()[1:] {
+		err := func() error {
+			srcDB, err := research.OpenSubstateDBWithOptions(research.NewSubstateDBOptions(srcPath, true))
+			if err != nil {
+				return err
+			}
+			defer srcDB.Close()
+
+			conflict := func(block uint64, tx int) {
+				fmt.Printf("substate-cli db merge: conflict: %v_%v in %s (%v)\n", block, tx, srcPath, resolution)
+			}
+			stats, err := dstDB.MergeFrom(srcDB, resolution, ctx.Int(research.WorkersFlag.Name), conflict)
+			if stats != nil {
+				numConflicts += stats.NumConflicts
+				fmt.Printf("substate-cli db merge: %s: %v substates, %v codes, %v block summaries, %v tx hashes, %v conflicts\n",
+					srcPath, stats.NumSubstates, stats.NumCodes, stats.NumSummaries, stats.NumTxHashes, stats.NumConflicts)
+			}
+			return err
+		}()
+		if err != nil {
+			return fmt.Errorf("substate-cli db merge: %s: %v", srcPath, err)
+		}
+	}
+
+	fmt.Printf("substate-cli db merge: total #conflict = %v\n", numConflicts)
+	fmt.Printf("substate-cli db merge: done in %v\n", time.Since(start).Round(1*time.Millisecond))
+
+	return nil
+}
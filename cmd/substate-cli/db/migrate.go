@@ -0,0 +1,59 @@
+package db
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/ethereum/go-ethereum/research"
+	cli "gopkg.in/urfave/cli.v1"
+)
+
+var MigrateCommand = cli.Command{
+	Action:    migrate,
+	Name:      "migrate",
+	Usage:     "Rewrite legacy and Berlin-era substates into the latest versioned format in place",
+	ArgsUsage: "<dbPath>",
+	Flags:     []cli.Flag{},
+	Description: `
+The substate-cli db migrate command requires one argument:
+    <dbPath>
+<dbPath> is the substate database to migrate in place.
+
+Substates recorded before format bytes were introduced are decoded by
+trial and error. This command rewrites them with a format byte in the
+latest layout so that they are decoded with a single dispatch.
+Rewritten substates keep their compression.`,
+}
+
+func migrate(ctx *cli.Context) error {
+	if len(ctx.Args()) != 1 {
+		return fmt.Errorf("substate-cli db migrate: command requires exactly 1 argument")
+	}
+
+	dbPath := ctx.Args().Get(0)
+	db, err := research.OpenSubstateDBWithOptions(research.NewSubstateDBOptions(dbPath, false))
+	if err != nil {
+		return fmt.Errorf("substate-cli db migrate: %v", err)
+	}
+	defer db.Close()
+
+	start := time.Now()
+	formats, rewritten, err := db.MigrateSubstates()
+	if err != nil {
+		return fmt.Errorf("substate-cli db migrate: %v", err)
+	}
+
+	keys := make([]research.SubstateFormat, 0, len(formats))
+	for format := range formats {
+		keys = append(keys, format)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	for _, format := range keys {
+		fmt.Printf("substate-cli db migrate: %12v %s substates\n", formats[format], format)
+	}
+	fmt.Printf("substate-cli db migrate: %12v substates rewritten\n", rewritten)
+	fmt.Printf("substate-cli db migrate: elapsed time: %v\n", time.Since(start).Round(1*time.Millisecond))
+
+	return nil
+}
@@ -0,0 +1,93 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/research"
+	cli "gopkg.in/urfave/cli.v1"
+)
+
+var TxKindsFlag = cli.StringFlag{
+	Name:  "tx-kinds",
+	Usage: "Comma-separated kinds of transactions to prune: transfer, call, create (default: all transactions)",
+}
+
+var PruneCommand = cli.Command{
+	Action:    prune,
+	Name:      "prune",
+	Usage:     "Delete substates of a range of blocks and unreferenced code",
+	ArgsUsage: "<dbPath> <blockNumFirst> <blockNumLast>",
+	Flags: []cli.Flag{
+		research.WorkersFlag,
+		TxKindsFlag,
+	},
+	Description: `
+The substate-cli db prune command requires three arguments:
+    <dbPath> <blockNumFirst> <blockNumLast>
+<dbPath> is the substate database to prune in place.
+<blockNumFirst> and <blockNumLast> are the first and last block of the
+inclusive range of blocks to prune.
+
+Without --tx-kinds, all substates and block summaries of the range are
+deleted and the range is removed from recorded blocks. With --tx-kinds, e.g.
+--tx-kinds transfer for plain ETH transfers, only substates of the given
+kinds are deleted; the blocks stay recorded and their block summaries list
+the deleted transaction indices as pruned, so db verify and db gaps do not
+report them as missing.
+
+Afterwards, code blobs and account records that are no longer referenced by
+any remaining substate are deleted, and the affected key spaces are
+compacted.`,
+}
+
+func prune(ctx *cli.Context) error {
+	if len(ctx.Args()) != 3 {
+		return fmt.Errorf("substate-cli db prune: command requires exactly 3 arguments")
+	}
+
+	dbPath := ctx.Args().Get(0)
+	first, last, err := parseBlockRange(ctx.Args()[1:])
+	if err != nil {
+		return fmt.Errorf("substate-cli db prune: %v", err)
+	}
+
+	var kinds []research.SubstateTxKind
+	if names := ctx.String(TxKindsFlag.Name); names != "" {
+		for _, name := range strings.Split(names, ",") {
+			kind, err := research.ParseSubstateTxKind(strings.TrimSpace(name))
+			if err != nil {
+				return fmt.Errorf("substate-cli db prune: %v", err)
+			}
+			kinds = append(kinds, kind)
+		}
+	}
+
+	db, err := research.OpenSubstateDBWithOptions(research.NewSubstateDBOptions(dbPath, false))
+	if err != nil {
+		return fmt.Errorf("substate-cli db prune: %v", err)
+	}
+	defer db.Close()
+
+	start := time.Now()
+	stats, err := db.PruneSubstates(first, last, kinds, ctx.Int(research.WorkersFlag.Name))
+	if err != nil {
+		return fmt.Errorf("substate-cli db prune: %v", err)
+	}
+	fmt.Printf("substate-cli db prune: %v substates deleted from %v blocks\n", stats.NumSubstates, stats.NumBlocks)
+
+	gcStats, err := db.CollectGarbage()
+	if err != nil {
+		return fmt.Errorf("substate-cli db prune: %v", err)
+	}
+	fmt.Printf("substate-cli db prune: %v codes and %v accounts deleted\n", gcStats.NumCodes, gcStats.NumAccounts)
+
+	fmt.Printf("substate-cli db prune: compaction begin\n")
+	if err := db.CompactPruned(first, last); err != nil {
+		return fmt.Errorf("substate-cli db prune: %v", err)
+	}
+	fmt.Printf("substate-cli db prune: done in %v\n", time.Since(start).Round(1*time.Millisecond))
+
+	return nil
+}
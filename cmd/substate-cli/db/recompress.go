@@ -0,0 +1,78 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/research"
+	cli "gopkg.in/urfave/cli.v1"
+)
+
+var CompressionFlag = cli.StringFlag{
+	Name:  "compression",
+	Usage: "Compression of substate values: " + strings.Join(research.SubstateCompressorNames(), ", "),
+	Value: "snappy",
+}
+
+var RecompressCommand = cli.Command{
+	Action:    recompress,
+	Name:      "recompress",
+	Usage:     "Rewrite substate values with the given compression in place",
+	ArgsUsage: "<dbPath>",
+	Flags: []cli.Flag{
+		CompressionFlag,
+	},
+	Description: `
+The substate-cli db recompress command requires one argument:
+    <dbPath>
+<dbPath> is the substate database to recompress in place.
+
+Each substate value records its compression in its header, so substate DBs
+with mixed compression are read transparently by all substate-cli commands.
+Values that do not become smaller with compression are stored uncompressed.
+Run substate-cli db compact afterwards to reclaim disk space.`,
+}
+
+func recompress(ctx *cli.Context) error {
+	if len(ctx.Args()) != 1 {
+		return fmt.Errorf("substate-cli db recompress: command requires exactly 1 argument")
+	}
+
+	compressionName := ctx.String(CompressionFlag.Name)
+	compressor, err := research.SubstateCompressorByName(compressionName)
+	if err != nil {
+		return fmt.Errorf("substate-cli db recompress: %v", err)
+	}
+
+	dbPath := ctx.Args().Get(0)
+	db, err := research.OpenSubstateDBWithOptions(research.NewSubstateDBOptions(dbPath, false))
+	if err != nil {
+		return fmt.Errorf("substate-cli db recompress: %v", err)
+	}
+	defer db.Close()
+
+	sizes, err := db.KeySpaceSizes()
+	if err != nil {
+		return fmt.Errorf("substate-cli db recompress: %v", err)
+	}
+	fmt.Printf("substate-cli db recompress: size before recompression\n")
+	printKeySpaceSizes("substate-cli db recompress", sizes)
+
+	start := time.Now()
+	rewritten, err := db.Recompress(compressor)
+	if err != nil {
+		return fmt.Errorf("substate-cli db recompress: %v", err)
+	}
+	fmt.Printf("substate-cli db recompress: %v substates rewritten with %s compression in %v\n",
+		rewritten, compressionName, time.Since(start).Round(1*time.Millisecond))
+
+	sizes, err = db.KeySpaceSizes()
+	if err != nil {
+		return fmt.Errorf("substate-cli db recompress: %v", err)
+	}
+	fmt.Printf("substate-cli db recompress: size after recompression\n")
+	printKeySpaceSizes("substate-cli db recompress", sizes)
+
+	return nil
+}
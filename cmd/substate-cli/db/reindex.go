@@ -0,0 +1,81 @@
+package db
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/ethereum/go-ethereum/research"
+	cli "gopkg.in/urfave/cli.v1"
+)
+
+var ReindexCommand = cli.Command{
+	Action:    reindex,
+	Name:      "reindex",
+	Usage:     "Rewrite block summaries from substates",
+	ArgsUsage: "<dbPath> [<blockNumFirst> <blockNumLast>]",
+	Flags: []cli.Flag{
+		research.WorkersFlag,
+	},
+	Description: `
+The substate-cli db reindex command requires one or three arguments:
+    <dbPath> [<blockNumFirst> <blockNumLast>]
+<dbPath> is the substate database to reindex in place.
+<blockNumFirst> and <blockNumLast> are the first and last block of the
+inclusive range of blocks to reindex, all blocks by default.
+
+Block summaries let substate-cli skip blocks without decoding their substates.
+geth import writes them while recording, so only substate DBs recorded by
+older versions need to be reindexed. Summaries are written only for blocks
+with substates, because blocks without transactions cannot be told apart
+from blocks that were not recorded.`,
+}
+
+func reindex(ctx *cli.Context) error {
+	if len(ctx.Args()) != 1 && len(ctx.Args()) != 3 {
+		return fmt.Errorf("substate-cli db reindex: command requires exactly 1 or 3 arguments")
+	}
+
+	dbPath := ctx.Args().Get(0)
+	first, last, err := parseBlockRange(ctx.Args()[1:])
+	if err != nil {
+		return fmt.Errorf("substate-cli db reindex: %v", err)
+	}
+
+	db, err := research.OpenSubstateDBWithOptions(research.NewSubstateDBOptions(dbPath, false))
+	if err != nil {
+		return fmt.Errorf("substate-cli db reindex: %v", err)
+	}
+	defer db.Close()
+
+	start := time.Now()
+	numBlocks, err := db.Reindex(first, last, ctx.Int(research.WorkersFlag.Name))
+	if err != nil {
+		return fmt.Errorf("substate-cli db reindex: %v", err)
+	}
+	fmt.Printf("substate-cli db reindex: %v block summaries written in %v\n",
+		numBlocks, time.Since(start).Round(1*time.Millisecond))
+
+	return nil
+}
+
+// parseBlockRange parses optional <blockNumFirst> <blockNumLast> arguments,
+// all blocks if args is empty.
+func parseBlockRange(args []string) (first, last uint64, err error) {
+	if len(args) == 0 {
+		return 0, math.MaxUint64, nil
+	}
+	if len(args) != 2 {
+		return 0, 0, fmt.Errorf("error in parsing parameters: both first and last block are required")
+	}
+	first, ferr := strconv.ParseUint(args[0], 10, 64)
+	last, lerr := strconv.ParseUint(args[1], 10, 64)
+	if ferr != nil || lerr != nil {
+		return 0, 0, fmt.Errorf("error in parsing parameters: block number not an integer")
+	}
+	if first > last {
+		return 0, 0, fmt.Errorf("error: first block has larger number than last block")
+	}
+	return first, last, nil
+}
@@ -0,0 +1,125 @@
+package db
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/ethereum/go-ethereum/research"
+	"github.com/ethereum/go-ethereum/rpc"
+	cli "gopkg.in/urfave/cli.v1"
+)
+
+var HTTPFlag = cli.StringFlag{
+	Name:  "http",
+	Usage: "Listening address (host:port) of the JSON-RPC server over HTTP, empty to disable",
+	Value: "localhost:8547",
+}
+
+var WSFlag = cli.StringFlag{
+	Name:  "ws",
+	Usage: "Listening address (host:port) of the JSON-RPC server over WebSocket",
+}
+
+var IPCFlag = cli.StringFlag{
+	Name:  "ipc",
+	Usage: "Path of the IPC socket of the JSON-RPC server, must end with .ipc",
+}
+
+var ServeCommand = cli.Command{
+	Action:    serve,
+	Name:      "serve",
+	Usage:     "Serve a substate DB read-only over JSON-RPC",
+	ArgsUsage: "<dbPath>",
+	Flags: []cli.Flag{
+		HTTPFlag,
+		WSFlag,
+		IPCFlag,
+	},
+	Description: `
+The substate-cli db serve command requires one argument:
+    <dbPath>
+<dbPath> is the substate DB to serve read-only until interrupted.
+
+The substate DB is served in the "substate" namespace over HTTP, WebSocket
+and IPC as enabled by --http, --ws and --ipc. Give the endpoint, e.g.
+http://localhost:8547, as --substatedir of replay, replay-fork and
+redundancy-trace to read substates from the server.`,
+}
+
+func serve(ctx *cli.Context) error {
+	if len(ctx.Args()) != 1 {
+		return fmt.Errorf("substate-cli db serve: command requires exactly 1 argument")
+	}
+
+	httpAddr, wsAddr, ipcPath := ctx.String(HTTPFlag.Name), ctx.String(WSFlag.Name), ctx.String(IPCFlag.Name)
+	if httpAddr == "" && wsAddr == "" && ipcPath == "" {
+		return fmt.Errorf("substate-cli db serve: no endpoint enabled, use --http, --ws or --ipc")
+	}
+	if ipcPath != "" && !research.IsRemoteSubstateDB(ipcPath) {
+		return fmt.Errorf("substate-cli db serve: IPC path %s must end with .ipc", ipcPath)
+	}
+
+	dbPath := ctx.Args().Get(0)
+	db, err := research.OpenSubstateDBWithOptions(research.NewSubstateDBOptions(dbPath, true))
+	if err != nil {
+		return fmt.Errorf("substate-cli db serve: %v", err)
+	}
+	defer db.Close()
+
+	api := research.NewSubstateAPI(db)
+	server := rpc.NewServer()
+	if err := server.RegisterName("substate", api); err != nil {
+		return fmt.Errorf("substate-cli db serve: %v", err)
+	}
+	defer server.Stop()
+
+	errc := make(chan error, 3)
+	if httpAddr != "" {
+		listener, err := net.Listen("tcp", httpAddr)
+		if err != nil {
+			return fmt.Errorf("substate-cli db serve: %v", err)
+		}
+		defer listener.Close()
+		go func() { errc <- http.Serve(listener, server) }()
+		fmt.Printf("substate-cli db serve: serving %s at http://%s\n", dbPath, listener.Addr())
+	}
+	if wsAddr != "" {
+		listener, err := net.Listen("tcp", wsAddr)
+		if err != nil {
+			return fmt.Errorf("substate-cli db serve: %v", err)
+		}
+		defer listener.Close()
+		go func() { errc <- http.Serve(listener, server.WebsocketHandler([]string{"*"})) }()
+		fmt.Printf("substate-cli db serve: serving %s at ws://%s\n", dbPath, listener.Addr())
+	}
+	if ipcPath != "" {
+		listener, ipcServer, err := rpc.StartIPCEndpoint(ipcPath, []rpc.API{{
+			Namespace: "substate",
+			Version:   "1.0",
+			Service:   api,
+			Public:    true,
+		}})
+		if err != nil {
+			return fmt.Errorf("substate-cli db serve: %v", err)
+		}
+		defer ipcServer.Stop()
+		defer listener.Close()
+		fmt.Printf("substate-cli db serve: serving %s at %s\n", dbPath, ipcPath)
+	}
+
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigc)
+
+	select {
+	case <-sigc:
+		fmt.Println("substate-cli db serve: interrupted, shutting down")
+		return nil
+	case err := <-errc:
+		return fmt.Errorf("substate-cli db serve: %v", err)
+	}
+}
@@ -0,0 +1,116 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/research"
+	cli "gopkg.in/urfave/cli.v1"
+)
+
+var TopFlag = cli.IntFlag{
+	Name:  "top",
+	Usage: "Number of largest substates to list",
+	Value: 10,
+}
+
+var StatsCommand = cli.Command{
+	Action:    stats,
+	Name:      "stats",
+	Usage:     "Print size and content statistics of substates in a given range of blocks",
+	ArgsUsage: "<blockNumFirst> <blockNumLast>",
+	Flags: []cli.Flag{
+		research.SubstateDirFlag,
+		TopFlag,
+		JSONFlag,
+	},
+	Description: `
+The substate-cli db stats command requires two arguments:
+    <blockNumFirst> <blockNumLast>
+<blockNumFirst> and <blockNumLast> are the first and last block of the
+inclusive range of blocks to scan in the substate DB given by --substatedir.
+
+The command reports the number of substates and blocks with substates,
+stored bytes of substate values and RLP-encoded bytes of each component,
+distinct code blobs referenced by substates and their total size,
+substates per format and compression, and the largest substates.`,
+}
+
+func stats(ctx *cli.Context) error {
+	if len(ctx.Args()) != 2 {
+		return fmt.Errorf("substate-cli db stats: command requires exactly 2 arguments")
+	}
+
+	first, ferr := strconv.ParseUint(ctx.Args().Get(0), 10, 64)
+	last, lerr := strconv.ParseUint(ctx.Args().Get(1), 10, 64)
+	if ferr != nil || lerr != nil {
+		return fmt.Errorf("substate-cli db stats: error in parsing parameters: block number not an integer")
+	}
+	if first > last {
+		return fmt.Errorf("substate-cli db stats: error: first block has larger number than last block")
+	}
+
+	dbPath := ctx.String(research.SubstateDirFlag.Name)
+	db, err := research.OpenSubstateDBWithOptions(research.NewSubstateDBOptions(dbPath, true))
+	if err != nil {
+		return fmt.Errorf("substate-cli db stats: %v", err)
+	}
+	defer db.Close()
+
+	s, err := db.Stats(first, last, ctx.Int(TopFlag.Name))
+	if err != nil {
+		return fmt.Errorf("substate-cli db stats: %v", err)
+	}
+
+	if ctx.Bool(JSONFlag.Name) {
+		jbytes, err := json.MarshalIndent(s, "", "  ")
+		if err != nil {
+			return fmt.Errorf("substate-cli db stats: %v", err)
+		}
+		fmt.Printf("%s\n", jbytes)
+		return nil
+	}
+
+	fmt.Printf("block range:  %v %v\n", s.First, s.Last)
+	fmt.Printf("substates:    %12v\n", s.NumSubstates)
+	fmt.Printf("blocks:       %12v\n", s.NumBlocks)
+	fmt.Printf("values:       %12v\n", common.StorageSize(s.ValueBytes))
+	fmt.Printf("\ncomponent bytes (RLP, uncompressed):\n")
+	for _, c := range []struct {
+		name  string
+		bytes int64
+	}{
+		{"InputAlloc", s.InputAllocBytes},
+		{"OutputAlloc", s.OutputAllocBytes},
+		{"Env", s.EnvBytes},
+		{"Message", s.MessageBytes},
+		{"Result", s.ResultBytes},
+	} {
+		fmt.Printf("    %-12s %12v\n", c.name, common.StorageSize(c.bytes))
+	}
+	fmt.Printf("\ncodes:        %12v %12v\n", s.NumCodes, common.StorageSize(s.CodeBytes))
+	fmt.Printf("\nformats:\n")
+	printCounts(s.Formats)
+	fmt.Printf("\ncompression:\n")
+	printCounts(s.Compression)
+	fmt.Printf("\nlargest substates:\n")
+	for _, size := range s.Largest {
+		fmt.Printf("    %v_%v %12v\n", size.Block, size.Tx, common.StorageSize(size.Bytes))
+	}
+
+	return nil
+}
+
+func printCounts(counts map[string]int64) {
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Printf("    %-20s %12v\n", name, counts[name])
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"sync"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/params"
 	"github.com/ethereum/go-ethereum/research"
 	"github.com/syndtr/goleveldb/leveldb"
 	leveldb_opt "github.com/syndtr/goleveldb/leveldb/opt"
@@ -33,6 +34,10 @@ represents different data types as follows:
 - 1s: substateRLP, a key is "1s"+N+T with transaction index T at block N.
 T and N are encoded in a big-endian 64-bit binary.
 - 1c: code, a key is "1c"+codeHash where codeHash is Keccak256 hash of the bytecode.
+- 1m: metadata, a key is "1m"+name.
+
+<stage1-substate> is assumed to be recorded from mainnet, so the mainnet chain
+config and genesis hash are written to the metadata of <substate.ethereum>.
 `,
 }
 
@@ -148,5 +153,24 @@ func upgrade(ctx *cli.Context) error {
 	// wait
 	wg.Wait()
 
+	err = newSubstateDB.Close()
+	if err != nil {
+		panic(err)
+	}
+
+	// write metadata
+	db, err := research.OpenSubstateDBWithOptions(research.NewSubstateDBOptions(newPath, false))
+	if err != nil {
+		return fmt.Errorf("substate-cli db upgrade: %v", err)
+	}
+	defer db.Close()
+	err = db.PutMetadata(&research.SubstateDBMetadata{
+		ChainConfig: params.MainnetChainConfig,
+		GenesisHash: params.MainnetGenesisHash,
+	})
+	if err != nil {
+		return fmt.Errorf("substate-cli db upgrade: %v", err)
+	}
+
 	return nil
 }
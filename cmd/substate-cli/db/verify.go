@@ -0,0 +1,105 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/ethereum/go-ethereum/research"
+	cli "gopkg.in/urfave/cli.v1"
+)
+
+var JSONFlag = cli.BoolFlag{
+	Name:  "json",
+	Usage: "Print output as JSON",
+}
+
+var VerifyCommand = cli.Command{
+	Action:    verify,
+	Name:      "verify",
+	Usage:     "Check a substate DB for corruption",
+	ArgsUsage: "<dbPath> [<blockNumFirst> <blockNumLast>]",
+	Flags: []cli.Flag{
+		research.TxHashFlag,
+		research.AddressFlag,
+		JSONFlag,
+	},
+	Description: `
+The substate-cli db verify command requires one or three arguments:
+    <dbPath> [<blockNumFirst> <blockNumLast>]
+<dbPath> is the substate database to verify.
+<blockNumFirst> and <blockNumLast> are the first and last block of the
+inclusive range of blocks to verify, all blocks by default.
+With --tx-hash or --address, only the substates of selected transactions
+are verified, without checking tx-gap and orphaned-code.
+
+The following problems are reported with block and tx of the substate:
+    invalid-key    substate key that cannot be decoded
+    undecodable    substate value that cannot be decoded
+    missing-code   code referenced by an account or a CREATE message is missing
+    orphaned-code  code not referenced by any substate, only without a range
+    tx-gap         missing transaction indices within a block
+With --json, each problem is printed as a JSON object per line.
+The command exits with a non-zero status if any problem is found.`,
+}
+
+func verify(ctx *cli.Context) error {
+	if len(ctx.Args()) != 1 && len(ctx.Args()) != 3 {
+		return fmt.Errorf("substate-cli db verify: command requires exactly 1 or 3 arguments")
+	}
+
+	dbPath := ctx.Args().Get(0)
+	first, last, err := parseBlockRange(ctx.Args()[1:])
+	if err != nil {
+		return fmt.Errorf("substate-cli db verify: %v", err)
+	}
+	selector, err := research.ParseSubstateSelector(ctx)
+	if err != nil {
+		return fmt.Errorf("substate-cli db verify: %v", err)
+	}
+	orphans := len(ctx.Args()) == 1 && selector == nil
+
+	db, err := research.OpenSubstateDBWithOptions(research.NewSubstateDBOptions(dbPath, true))
+	if err != nil {
+		return fmt.Errorf("substate-cli db verify: %v", err)
+	}
+	defer db.Close()
+
+	jsonOutput := ctx.Bool(JSONFlag.Name)
+	encoder := json.NewEncoder(os.Stdout)
+	report := func(f *research.VerifyFinding) {
+		if jsonOutput {
+			encoder.Encode(f)
+		} else {
+			fmt.Printf("substate-cli db verify: %v\n", f)
+		}
+	}
+
+	start := time.Now()
+	var stats *research.VerifyStats
+	if selector != nil {
+		var keys []research.SubstateKey
+		keys, err = db.SelectSubstates(selector, first, last)
+		if err == nil {
+			stats, err = db.VerifySelected(keys, report)
+		}
+	} else {
+		stats, err = db.Verify(first, last, orphans, report)
+	}
+	if err != nil {
+		return fmt.Errorf("substate-cli db verify: %v", err)
+	}
+	if !jsonOutput {
+		fmt.Printf("substate-cli db verify: %v substates in %v blocks", stats.NumSubstates, stats.NumBlocks)
+		if orphans {
+			fmt.Printf(", %v codes", stats.NumCodes)
+		}
+		fmt.Printf(" verified in %v\n", time.Since(start).Round(1*time.Millisecond))
+	}
+	if stats.NumFindings > 0 {
+		return fmt.Errorf("substate-cli db verify: %v problems found", stats.NumFindings)
+	}
+
+	return nil
+}
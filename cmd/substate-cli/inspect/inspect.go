@@ -0,0 +1,302 @@
+package inspect
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/asm"
+	"github.com/ethereum/go-ethereum/research"
+	cli "gopkg.in/urfave/cli.v1"
+)
+
+var DisasmFlag = cli.BoolFlag{
+	Name:  "disasm",
+	Usage: "Disassemble the code of touched contracts and the init code of CREATE transactions",
+}
+
+var InspectCommand = cli.Command{
+	Action:    inspectAction,
+	Name:      "inspect",
+	Usage:     "Print the substate of a transaction in a human-readable form",
+	ArgsUsage: "[<blockNum> <txIndex>]",
+	Flags: []cli.Flag{
+		research.SubstateDirFlag,
+		research.TxHashFlag,
+		research.AddressFlag,
+		DisasmFlag,
+	},
+	Description: `
+The substate-cli inspect command requires two arguments:
+    <blockNum> <txIndex>
+<blockNum> and <txIndex> are the block number and the transaction index of
+the substate to print from the substate DB given by --substatedir.
+With --tx-hash or --address, the substates of the selected transactions are
+printed instead and no arguments are required.
+
+The command prints the block environment, the message with the 4-byte
+function selector and the arguments of calls split out, the result with its
+logs, and the changes from InputAlloc to OutputAlloc of every account.
+With --disasm, the code of every account and the init code of a CREATE
+transaction are disassembled.`,
+}
+
+func inspectAction(ctx *cli.Context) error {
+	selector, err := research.ParseSubstateSelector(ctx)
+	if err != nil {
+		return fmt.Errorf("substate-cli inspect: %v", err)
+	}
+	var keys []research.SubstateKey
+	if selector == nil {
+		if len(ctx.Args()) != 2 {
+			return fmt.Errorf("substate-cli inspect: command requires exactly 2 arguments, or none with --tx-hash or --address")
+		}
+		block, berr := strconv.ParseUint(ctx.Args().Get(0), 10, 64)
+		tx, terr := strconv.Atoi(ctx.Args().Get(1))
+		if berr != nil || terr != nil {
+			return fmt.Errorf("substate-cli inspect: error in parsing parameters: block number or tx index not an integer")
+		}
+		keys = append(keys, research.SubstateKey{Block: block, Tx: tx})
+	} else if len(ctx.Args()) != 0 {
+		return fmt.Errorf("substate-cli inspect: command requires no arguments with --tx-hash or --address")
+	}
+
+	substateOpts, err := research.SubstateDBOptionsFromFlags(ctx, true)
+	if err != nil {
+		return fmt.Errorf("substate-cli inspect: %v", err)
+	}
+	db, err := research.OpenSubstateDBWithOptions(substateOpts)
+	if err != nil {
+		return fmt.Errorf("substate-cli inspect: %v", err)
+	}
+	defer db.Close()
+
+	if selector != nil {
+		keys, err = db.SelectSubstates(selector, 0, math.MaxUint64)
+		if err != nil {
+			return fmt.Errorf("substate-cli inspect: %v", err)
+		}
+		if len(keys) == 0 {
+			return fmt.Errorf("substate-cli inspect: no substates selected")
+		}
+	}
+
+	for i, key := range keys {
+		if i > 0 {
+			fmt.Println()
+		}
+		if err := inspectSubstate(ctx, db, key.Block, key.Tx); err != nil {
+			return fmt.Errorf("substate-cli inspect: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// inspectSubstate prints the substate of a transaction.
+func inspectSubstate(ctx *cli.Context, db *research.SubstateDB, block uint64, tx int) error {
+	has, err := db.HasSubstate(block, tx)
+	if err != nil {
+		return err
+	}
+	if !has {
+		return fmt.Errorf("substate %v_%v not found", block, tx)
+	}
+	substate, err := db.GetSubstate(block, tx)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("substate %v_%v\n", block, tx)
+	printEnv(substate.Env)
+	printMessage(substate.Message)
+	printResult(substate.Result)
+	printAccounts(substate.InputAlloc, substate.OutputAlloc)
+	if ctx.Bool(DisasmFlag.Name) {
+		printDisasm(substate)
+	}
+
+	return nil
+}
+
+func formatBig(x *big.Int) string {
+	if x == nil {
+		return "-"
+	}
+	return x.String()
+}
+
+func printEnv(env *research.SubstateEnv) {
+	fmt.Printf("\nenv:\n")
+	fmt.Printf("  number:      %v\n", env.Number)
+	fmt.Printf("  timestamp:   %v\n", env.Timestamp)
+	fmt.Printf("  coinbase:    %s\n", env.Coinbase.Hex())
+	fmt.Printf("  difficulty:  %s\n", formatBig(env.Difficulty))
+	fmt.Printf("  gas limit:   %v\n", env.GasLimit)
+	fmt.Printf("  base fee:    %s\n", formatBig(env.BaseFee))
+
+	nums := make([]uint64, 0, len(env.BlockHashes))
+	for num := range env.BlockHashes {
+		nums = append(nums, num)
+	}
+	sort.Slice(nums, func(i, j int) bool { return nums[i] < nums[j] })
+	fmt.Printf("  block hashes:\n")
+	for _, num := range nums {
+		fmt.Printf("    %v: %s\n", num, env.BlockHashes[num].Hex())
+	}
+}
+
+func printMessage(msg *research.SubstateMessage) {
+	fmt.Printf("\nmessage:\n")
+	fmt.Printf("  from:        %s\n", msg.From.Hex())
+	if msg.To == nil {
+		fmt.Printf("  to:          - (contract creation)\n")
+	} else {
+		fmt.Printf("  to:          %s\n", msg.To.Hex())
+	}
+	fmt.Printf("  nonce:       %v\n", msg.Nonce)
+	fmt.Printf("  check nonce: %v\n", msg.CheckNonce)
+	fmt.Printf("  value:       %s\n", formatBig(msg.Value))
+	fmt.Printf("  gas:         %v\n", msg.Gas)
+	fmt.Printf("  gas price:   %s\n", formatBig(msg.GasPrice))
+	fmt.Printf("  gas fee cap: %s\n", formatBig(msg.GasFeeCap))
+	fmt.Printf("  gas tip cap: %s\n", formatBig(msg.GasTipCap))
+
+	switch {
+	case msg.To == nil:
+		fmt.Printf("  init code:   %v bytes\n", len(msg.Data))
+	case len(msg.Data) >= 4:
+		fmt.Printf("  selector:    %s\n", hexutil.Encode(msg.Data[:4]))
+		args := msg.Data[4:]
+		fmt.Printf("  arguments:   %v bytes\n", len(args))
+		for i := 0; i < len(args); i += 32 {
+			end := i + 32
+			if end > len(args) {
+				end = len(args)
+			}
+			fmt.Printf("    [%v] %s\n", i/32, hexutil.Encode(args[i:end]))
+		}
+	default:
+		fmt.Printf("  data:        %s\n", hexutil.Encode(msg.Data))
+	}
+
+	if len(msg.AccessList) > 0 {
+		fmt.Printf("  access list:\n")
+		for _, tuple := range msg.AccessList {
+			fmt.Printf("    %s\n", tuple.Address.Hex())
+			for _, key := range tuple.StorageKeys {
+				fmt.Printf("      %s\n", key.Hex())
+			}
+		}
+	}
+}
+
+func printResult(result *research.SubstateResult) {
+	fmt.Printf("\nresult:\n")
+	fmt.Printf("  status:      %v\n", result.Status)
+	fmt.Printf("  gas used:    %v\n", result.GasUsed)
+	if result.ContractAddress != (common.Address{}) {
+		fmt.Printf("  contract:    %s\n", result.ContractAddress.Hex())
+	}
+	fmt.Printf("  logs:        %v\n", len(result.Logs))
+	for i, log := range result.Logs {
+		fmt.Printf("    [%v] %s\n", i, log.Address.Hex())
+		for j, topic := range log.Topics {
+			fmt.Printf("        topic %v: %s\n", j, topic.Hex())
+		}
+		fmt.Printf("        data:    %s\n", hexutil.Encode(log.Data))
+	}
+}
+
+// sortedAddresses returns the addresses of input and output in ascending order.
+func sortedAddresses(input, output research.SubstateAlloc) []common.Address {
+	addrs := make([]common.Address, 0, len(input)+len(output))
+	for addr := range input {
+		addrs = append(addrs, addr)
+	}
+	for addr := range output {
+		if _, exist := input[addr]; !exist {
+			addrs = append(addrs, addr)
+		}
+	}
+	sort.Slice(addrs, func(i, j int) bool { return bytes.Compare(addrs[i][:], addrs[j][:]) < 0 })
+	return addrs
+}
+
+func printAccounts(input, output research.SubstateAlloc) {
+	fmt.Printf("\naccounts (InputAlloc -> OutputAlloc):\n")
+
+	for _, addr := range sortedAddresses(input, output) {
+		pre, post := input[addr], output[addr]
+		fields := research.DiffSubstateAllocs("", research.SubstateAlloc{addr: pre}, research.SubstateAlloc{addr: post})
+		switch {
+		case pre == nil:
+			fmt.Printf("  %s (only in OutputAlloc)\n", addr.Hex())
+			fmt.Printf("    %s\n", fields[0].B)
+		case post == nil:
+			fmt.Printf("  %s (only in InputAlloc)\n", addr.Hex())
+			fmt.Printf("    %s\n", fields[0].A)
+		case len(fields) == 0:
+			fmt.Printf("  %s (unchanged)\n", addr.Hex())
+		default:
+			fmt.Printf("  %s\n", addr.Hex())
+			for i := range fields {
+				a, b := fields[i].A, fields[i].B
+				if a == "" {
+					a = "-"
+				}
+				if b == "" {
+					b = "-"
+				}
+				fmt.Printf("    %s: %s -> %s\n", strings.TrimPrefix(fields[i].Field, addr.Hex()+"."), a, b)
+			}
+		}
+	}
+}
+
+func printDisasm(substate *research.Substate) {
+	codes := make(map[common.Address][]byte)
+	for addr, account := range substate.InputAlloc {
+		if len(account.Code) > 0 {
+			codes[addr] = account.Code
+		}
+	}
+	for addr, account := range substate.OutputAlloc {
+		if len(account.Code) > 0 {
+			codes[addr] = account.Code
+		}
+	}
+
+	if msg := substate.Message; msg.To == nil && len(msg.Data) > 0 {
+		fmt.Printf("\ninit code (%v bytes):\n", len(msg.Data))
+		printCode(msg.Data)
+	}
+	for _, addr := range sortedAddresses(substate.InputAlloc, substate.OutputAlloc) {
+		code, ok := codes[addr]
+		if !ok {
+			continue
+		}
+		fmt.Printf("\ncode of %s (%v bytes):\n", addr.Hex(), len(code))
+		printCode(code)
+	}
+}
+
+func printCode(code []byte) {
+	it := asm.NewInstructionIterator(code)
+	for it.Next() {
+		if it.Arg() != nil && 0 < len(it.Arg()) {
+			fmt.Printf("  %05x: %v %#x\n", it.PC(), it.Op(), it.Arg())
+		} else {
+			fmt.Printf("  %05x: %v\n", it.PC(), it.Op())
+		}
+	}
+	if err := it.Error(); err != nil {
+		fmt.Printf("  error: %v\n", err)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"os"
 
 	"github.com/ethereum/go-ethereum/cmd/substate-cli/db"
+	"github.com/ethereum/go-ethereum/cmd/substate-cli/inspect"
 	"github.com/ethereum/go-ethereum/cmd/substate-cli/replay"
 	"github.com/ethereum/go-ethereum/internal/flags"
 	cli "gopkg.in/urfave/cli.v1"
@@ -17,8 +18,23 @@ var (
 		Description: "",
 		Subcommands: []cli.Command{
 			db.UpgradeCommand,
+			db.InfoCommand,
 			db.CloneCommand,
 			db.CompactCommand,
+			db.MigrateCommand,
+			db.ConvertCommand,
+			db.RecompressCommand,
+			db.ReindexCommand,
+			db.IndexCommand,
+			db.VerifyCommand,
+			db.DiffCommand,
+			db.GapsCommand,
+			db.StatsCommand,
+			db.ExportCommand,
+			db.ImportCommand,
+			db.MergeCommand,
+			db.PruneCommand,
+			db.ServeCommand,
 		},
 	}
 )
@@ -36,6 +52,7 @@ func init() {
 		replay.ReplayCommand,
 		replay.ReplayForkCommand,
 		replay.RedundancyTraceCommand,
+		inspect.InspectCommand,
 		dbCommand,
 	}
 	cli.CommandHelpTemplate = flags.OriginCommandHelpTemplate
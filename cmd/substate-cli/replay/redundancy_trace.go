@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"math/big"
 	"os"
+	"path/filepath"
 	"strconv"
 
 	"github.com/ethereum/go-ethereum/common"
@@ -30,10 +31,19 @@ var RedundancyTraceCommand = cli.Command{
 	ArgsUsage: "<blockNumFirst> <blockNumLast>",
 	Flags: []cli.Flag{
 		research.WorkersFlag,
+		research.TxsPerTaskFlag,
 		research.SkipTransferTxsFlag,
 		research.SkipCallTxsFlag,
 		research.SkipCreateTxsFlag,
+		research.TxHashFlag,
+		research.AddressFlag,
+		research.FilterFlag,
 		research.SubstateDirFlag,
+		research.CodeCacheFlag,
+		research.KeepGoingFlag,
+		research.FailureFileFlag,
+		research.CheckpointDirFlag,
+		research.ResumeFlag,
 		OutputPath,
 	},
 	Description: `
@@ -65,10 +75,7 @@ func RedTraceWorkerAction(block uint64, tx int, substate *research.Substate) (re
 
 	vmConfig = vm.Config{}
 
-	chainConfig = &params.ChainConfig{}
-	*chainConfig = *params.MainnetChainConfig
-	// disable DAOForkSupport, otherwise account states will be overwritten
-	chainConfig.DAOForkSupport = false
+	chainConfig = ReplayChainConfig
 
 	getTracerFn = func(txIndex int, txHash common.Hash) (tracer vm.EVMLogger, err error) {
 		return nil, nil
@@ -163,25 +170,56 @@ func RedTraceWorkerAction(block uint64, tx int, substate *research.Substate) (re
 func redTrace(ctx *cli.Context) error {
 	var err error
 
-	if len(ctx.Args()) != 2 {
-		return fmt.Errorf("substate-cli replay command requires exactly 2 arguments")
+	selector, err := research.ParseSubstateSelector(ctx)
+	if err != nil {
+		return fmt.Errorf("substate-cli redundancy-trace: %v", err)
+	}
+	filter, err := research.ParseSubstateFilter(ctx)
+	if err != nil {
+		return fmt.Errorf("substate-cli redundancy-trace: %v", err)
+	}
+	if len(ctx.Args()) != 2 && !(selector != nil && len(ctx.Args()) == 0) {
+		return fmt.Errorf("substate-cli replay command requires exactly 2 arguments, or none with --tx-hash or --address")
 	}
 
-	first, ferr := strconv.ParseInt(ctx.Args().Get(0), 10, 64)
-	last, lerr := strconv.ParseInt(ctx.Args().Get(1), 10, 64)
-	if ferr != nil || lerr != nil {
-		return fmt.Errorf("substate-cli replay: error in parsing parameters: block number not an integer")
+	var first, last int64
+	if len(ctx.Args()) == 2 {
+		var ferr, lerr error
+		first, ferr = strconv.ParseInt(ctx.Args().Get(0), 10, 64)
+		last, lerr = strconv.ParseInt(ctx.Args().Get(1), 10, 64)
+		if ferr != nil || lerr != nil {
+			return fmt.Errorf("substate-cli replay: error in parsing parameters: block number not an integer")
+		}
+		if first < 0 || last < 0 {
+			return fmt.Errorf("substate-cli replay: error: block number must be greater than 0")
+		}
+		if first > last {
+			return fmt.Errorf("substate-cli replay: error: first block has larger number than last block")
+		}
 	}
-	if first < 0 || last < 0 {
-		return fmt.Errorf("substate-cli replay: error: block number must be greater than 0")
+
+	substateOpts, err := research.SubstateDBOptionsFromFlags(ctx, true)
+	if err != nil {
+		return fmt.Errorf("substate-cli redundancy-trace: %v", err)
 	}
-	if first > last {
-		return fmt.Errorf("substate-cli replay: error: first block has larger number than last block")
+	substateDB, err := research.OpenSubstateDBWithOptions(substateOpts)
+	if err != nil {
+		return fmt.Errorf("substate-cli redundancy-trace: %v", err)
+	}
+	defer substateDB.Close()
+
+	if len(ctx.Args()) == 0 {
+		f, l, err := substateDB.SelectedBlockRange(selector)
+		if err != nil {
+			return fmt.Errorf("substate-cli redundancy-trace: %v", err)
+		}
+		first, last = int64(f), int64(l)
 	}
 
-	research.SetSubstateFlags(ctx)
-	research.OpenSubstateDBReadOnly()
-	defer research.CloseSubstateDB()
+	err = loadReplayChainConfig(substateDB)
+	if err != nil {
+		return fmt.Errorf("substate-cli redundancy-trace: %v", err)
+	}
 
 	path := ctx.String(OutputPath.Name)
 	collectorAction := func(result research.BlockResult, prev *research.CollectorResult) error {
@@ -203,7 +241,13 @@ func redTrace(ctx *cli.Context) error {
 	taskPool := research.NewSubstateTaskPool(
 		"substate-cli redundancy trace",
 		RedTraceWorkerAction, collectorAction, research.VanillaCollectorInit,
-		uint64(first), uint64(last), ctx)
+		uint64(first), uint64(last), substateDB, ctx)
+	taskPool.Selector = selector
+	taskPool.Filter = filter
+	// checkpoints are written next to the traces unless --checkpoint-dir is given
+	if taskPool.CheckpointDir == "" {
+		taskPool.CheckpointDir = filepath.Join(path, "checkpoint")
+	}
 	_, err = taskPool.Execute()
 	return err
 }
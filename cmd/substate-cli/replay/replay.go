@@ -24,17 +24,47 @@ var ReplayCommand = cli.Command{
 	ArgsUsage: "<blockNumFirst> <blockNumLast>",
 	Flags: []cli.Flag{
 		research.WorkersFlag,
+		research.TxsPerTaskFlag,
 		research.SkipTransferTxsFlag,
 		research.SkipCallTxsFlag,
 		research.SkipCreateTxsFlag,
+		research.TxHashFlag,
+		research.AddressFlag,
+		research.FilterFlag,
 		research.SubstateDirFlag,
+		research.CodeCacheFlag,
+		research.KeepGoingFlag,
+		research.FailureFileFlag,
 	},
 	Description: `
 The substate-cli replay command requires two arguments:
 <blockNumFirst> <blockNumLast>
 
 <blockNumFirst> and <blockNumLast> are the first and
-last block of the inclusive range of blocks to replay transactions.`,
+last block of the inclusive range of blocks to replay transactions.
+With --tx-hash or --address, only selected transactions are replayed and
+the block range is optional.`,
+}
+
+// ReplayChainConfig is the chain config used by replay and redundancy-trace
+// commands, loaded by loadReplayChainConfig.
+var ReplayChainConfig *params.ChainConfig = &params.ChainConfig{}
+
+// loadReplayChainConfig sets ReplayChainConfig to the chain config stored in
+// the metadata of the substate DB, or mainnet chain config if there is none.
+func loadReplayChainConfig(db *research.SubstateDB) error {
+	metadata, err := db.GetMetadata()
+	if err != nil {
+		return err
+	}
+	if metadata.ChainConfig != nil {
+		*ReplayChainConfig = *metadata.ChainConfig
+	} else {
+		*ReplayChainConfig = *params.MainnetChainConfig
+	}
+	// disable DAOForkSupport, otherwise account states will be overwritten
+	ReplayChainConfig.DAOForkSupport = false
+	return nil
 }
 
 // replayWorkerAction replays a transaction substate, and checks the result
@@ -58,10 +88,7 @@ func replayWorkerAction(block uint64, tx int, substate *research.Substate) (ret
 
 	vmConfig = vm.Config{}
 
-	chainConfig = &params.ChainConfig{}
-	*chainConfig = *params.MainnetChainConfig
-	// disable DAOForkSupport, otherwise account states will be overwritten
-	chainConfig.DAOForkSupport = false
+	chainConfig = ReplayChainConfig
 
 	getTracerFn = func(txIndex int, txHash common.Hash) (tracer vm.EVMLogger, err error) {
 		return nil, nil
@@ -188,30 +215,63 @@ func replayWorkerAction(block uint64, tx int, substate *research.Substate) (ret
 func replayAction(ctx *cli.Context) error {
 	var err error
 
-	if len(ctx.Args()) != 2 {
-		return fmt.Errorf("substate-cli replay command requires exactly 2 arguments")
+	selector, err := research.ParseSubstateSelector(ctx)
+	if err != nil {
+		return fmt.Errorf("substate-cli replay: %v", err)
+	}
+	filter, err := research.ParseSubstateFilter(ctx)
+	if err != nil {
+		return fmt.Errorf("substate-cli replay: %v", err)
+	}
+	if len(ctx.Args()) != 2 && !(selector != nil && len(ctx.Args()) == 0) {
+		return fmt.Errorf("substate-cli replay command requires exactly 2 arguments, or none with --tx-hash or --address")
+	}
+
+	var first, last int64
+	if len(ctx.Args()) == 2 {
+		var ferr, lerr error
+		first, ferr = strconv.ParseInt(ctx.Args().Get(0), 10, 64)
+		last, lerr = strconv.ParseInt(ctx.Args().Get(1), 10, 64)
+		if ferr != nil || lerr != nil {
+			return fmt.Errorf("substate-cli replay: error in parsing parameters: block number not an integer")
+		}
+		if first < 0 || last < 0 {
+			return fmt.Errorf("substate-cli replay: error: block number must be greater than 0")
+		}
+		if first > last {
+			return fmt.Errorf("substate-cli replay: error: first block has larger number than last block")
+		}
 	}
 
-	first, ferr := strconv.ParseInt(ctx.Args().Get(0), 10, 64)
-	last, lerr := strconv.ParseInt(ctx.Args().Get(1), 10, 64)
-	if ferr != nil || lerr != nil {
-		return fmt.Errorf("substate-cli replay: error in parsing parameters: block number not an integer")
+	substateOpts, err := research.SubstateDBOptionsFromFlags(ctx, true)
+	if err != nil {
+		return fmt.Errorf("substate-cli replay: %v", err)
 	}
-	if first < 0 || last < 0 {
-		return fmt.Errorf("substate-cli replay: error: block number must be greater than 0")
+	substateDB, err := research.OpenSubstateDBWithOptions(substateOpts)
+	if err != nil {
+		return fmt.Errorf("substate-cli replay: %v", err)
 	}
-	if first > last {
-		return fmt.Errorf("substate-cli replay: error: first block has larger number than last block")
+	defer substateDB.Close()
+
+	if len(ctx.Args()) == 0 {
+		f, l, err := substateDB.SelectedBlockRange(selector)
+		if err != nil {
+			return fmt.Errorf("substate-cli replay: %v", err)
+		}
+		first, last = int64(f), int64(l)
 	}
 
-	research.SetSubstateFlags(ctx)
-	research.OpenSubstateDBReadOnly()
-	defer research.CloseSubstateDB()
+	err = loadReplayChainConfig(substateDB)
+	if err != nil {
+		return fmt.Errorf("substate-cli replay: %v", err)
+	}
 
 	taskPool := research.NewSubstateTaskPool(
         "substate-cli replay",
 		replayWorkerAction, research.VanillaCollectorAction, research.VanillaCollectorInit,
-        uint64(first), uint64(last), ctx)
+        uint64(first), uint64(last), substateDB, ctx)
+	taskPool.Selector = selector
+	taskPool.Filter = filter
 	_, err = taskPool.Execute()
 	return err
 }
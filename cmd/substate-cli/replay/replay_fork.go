@@ -2,13 +2,13 @@ package replay
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"math/big"
 	"sort"
 	"strconv"
 	"strings"
-	"sync"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core"
@@ -29,11 +29,20 @@ var ReplayForkCommand = cli.Command{
 	ArgsUsage: "<blockNumFirst> <blockNumLast>",
 	Flags: []cli.Flag{
 		research.WorkersFlag,
+		research.TxsPerTaskFlag,
 		research.SkipTransferTxsFlag,
 		research.SkipCallTxsFlag,
 		research.SkipCreateTxsFlag,
+		research.TxHashFlag,
+		research.AddressFlag,
+		research.FilterFlag,
 		HardForkFlag,
 		research.SubstateDirFlag,
+		research.CodeCacheFlag,
+		research.KeepGoingFlag,
+		research.FailureFileFlag,
+		research.CheckpointDirFlag,
+		research.ResumeFlag,
 	},
 	Description: `
 The replay-fork command requires two arguments:
@@ -41,6 +50,8 @@ The replay-fork command requires two arguments:
 
 <blockNumFirst> and <blockNumLast> are the first and
 last block of the inclusive range of blocks to replay transactions.
+With --tx-hash or --address, only selected transactions are replayed and
+the block range is optional.
 
 --hard-fork parameter is recommended for this command.`,
 }
@@ -96,8 +107,49 @@ type ReplayForkStat struct {
 	ErrStr string
 }
 
-var ReplayForkStatChan chan *ReplayForkStat = make(chan *ReplayForkStat, 1_000_000)
-var ReplayForkStatMap map[string]*ReplayForkStat = make(map[string]*ReplayForkStat)
+// ReplayForkResult is the worker result of replay-fork, Stat is nil if the
+// transaction has the same output with the hard-fork.
+type ReplayForkResult struct {
+	BlockId uint64
+	TxId    int
+	Stat    *ReplayForkStat
+}
+
+// ReplayForkStats is the collector result of replay-fork that counts
+// transactions by error string. It implements encoding.BinaryMarshaler and
+// encoding.BinaryUnmarshaler to be saved in checkpoints for --resume.
+type ReplayForkStats struct {
+	Counts map[string]int64 `json:"counts"`
+}
+
+func ReplayForkCollectorInit() research.CollectorResult {
+	return &ReplayForkStats{Counts: make(map[string]int64)}
+}
+
+func ReplayForkCollectorAction(result research.BlockResult, prev *research.CollectorResult) error {
+	stats := (*prev).(*ReplayForkStats)
+	for _, txResult := range result.Results {
+		if stat := txResult.(ReplayForkResult).Stat; stat != nil {
+			stats.Counts[stat.ErrStr] += stat.Count
+		}
+	}
+	return nil
+}
+
+func (stats *ReplayForkStats) MarshalBinary() ([]byte, error) {
+	return json.Marshal(stats)
+}
+
+func (stats *ReplayForkStats) UnmarshalBinary(data []byte) error {
+	stats.Counts = nil
+	if err := json.Unmarshal(data, stats); err != nil {
+		return err
+	}
+	if stats.Counts == nil {
+		stats.Counts = make(map[string]int64)
+	}
+	return nil
+}
 
 var (
 	ErrReplayForkOutOfGas     = errors.New("out of gas in replay-fork")
@@ -113,8 +165,8 @@ func replayForkTask(block uint64, tx int, substate *research.Substate) (ret rese
 	result.TxId = tx
 	var stat *ReplayForkStat
 	defer func() {
-		if stat != nil {
-			ReplayForkStatChan <- stat
+		if err == nil {
+			ret = ReplayForkResult{BlockId: block, TxId: tx, Stat: stat}
 		}
 	}()
 	inputAlloc := substate.InputAlloc
@@ -336,20 +388,32 @@ func replayForkTask(block uint64, tx int, substate *research.Substate) (ret rese
 func replayForkAction(ctx *cli.Context) error {
 	var err error
 
-	if len(ctx.Args()) != 2 {
-		return fmt.Errorf("substate-cli replay-fork command requires exactly 2 arguments")
+	selector, err := research.ParseSubstateSelector(ctx)
+	if err != nil {
+		return fmt.Errorf("substate-cli replay-fork: %v", err)
 	}
-
-	first, ferr := strconv.ParseInt(strings.ReplaceAll(ctx.Args().Get(0), "_", ""), 10, 64)
-	last, lerr := strconv.ParseInt(strings.ReplaceAll(ctx.Args().Get(1), "_", ""), 10, 64)
-	if ferr != nil || lerr != nil {
-		return fmt.Errorf("substate-cli replay-fork: error in parsing parameters: block number not an integer")
+	filter, err := research.ParseSubstateFilter(ctx)
+	if err != nil {
+		return fmt.Errorf("substate-cli replay-fork: %v", err)
 	}
-	if first < 0 || last < 0 {
-		return fmt.Errorf("substate-cli replay-fork: error: block number must be greater than 0")
+	if len(ctx.Args()) != 2 && !(selector != nil && len(ctx.Args()) == 0) {
+		return fmt.Errorf("substate-cli replay-fork command requires exactly 2 arguments, or none with --tx-hash or --address")
 	}
-	if first > last {
-		return fmt.Errorf("substate-cli replay-fork: error: first block has larger number than last block")
+
+	var first, last int64
+	if len(ctx.Args()) == 2 {
+		var ferr, lerr error
+		first, ferr = strconv.ParseInt(strings.ReplaceAll(ctx.Args().Get(0), "_", ""), 10, 64)
+		last, lerr = strconv.ParseInt(strings.ReplaceAll(ctx.Args().Get(1), "_", ""), 10, 64)
+		if ferr != nil || lerr != nil {
+			return fmt.Errorf("substate-cli replay-fork: error in parsing parameters: block number not an integer")
+		}
+		if first < 0 || last < 0 {
+			return fmt.Errorf("substate-cli replay-fork: error: block number must be greater than 0")
+		}
+		if first > last {
+			return fmt.Errorf("substate-cli replay-fork: error: first block has larger number than last block")
+		}
 	}
 
 	hardFork := ctx.Int64(HardForkFlag.Name)
@@ -379,46 +443,41 @@ func replayForkAction(ctx *cli.Context) error {
 		*ReplayForkChainConfig = *tests.Forks["London"]
 	}
 
-	research.SetSubstateFlags(ctx)
-	research.OpenSubstateDBReadOnly()
-	defer research.CloseSubstateDB()
-
-	statWg := &sync.WaitGroup{}
-	statWg.Add(1)
-	go func() {
-		for stat := range ReplayForkStatChan {
-			count := stat.Count
-			errstr := stat.ErrStr
-
-			if ReplayForkStatMap[errstr] == nil {
-				ReplayForkStatMap[errstr] = &ReplayForkStat{
-					Count:  0,
-					ErrStr: errstr,
-				}
-			}
+	substateOpts, err := research.SubstateDBOptionsFromFlags(ctx, true)
+	if err != nil {
+		return fmt.Errorf("substate-cli replay-fork: %v", err)
+	}
+	substateDB, err := research.OpenSubstateDBWithOptions(substateOpts)
+	if err != nil {
+		return fmt.Errorf("substate-cli replay-fork: %v", err)
+	}
+	defer substateDB.Close()
 
-			ReplayForkStatMap[errstr].Count += count
+	if len(ctx.Args()) == 0 {
+		f, l, err := substateDB.SelectedBlockRange(selector)
+		if err != nil {
+			return fmt.Errorf("substate-cli replay-fork: %v", err)
 		}
-		statWg.Done()
-	}()
-
-	taskPool := research.NewSubstateTaskPool("substate-cli replay-fork",
-        replayForkTask, research.VanillaCollectorAction, research.VanillaCollectorInit,
-        uint64(first), uint64(last), ctx)
-	_, err = taskPool.Execute()
-	if err == nil {
-		close(ReplayForkStatChan)
+		first, last = int64(f), int64(l)
 	}
 
-	statWg.Wait()
-	errstrSlice := make([]string, 0, len(ReplayForkStatMap))
-	for errstr := range ReplayForkStatMap {
+	taskPool := research.NewSubstateTaskPool("substate-cli replay-fork",
+		replayForkTask, ReplayForkCollectorAction, ReplayForkCollectorInit,
+		uint64(first), uint64(last), substateDB, ctx)
+	taskPool.Selector = selector
+	taskPool.Filter = filter
+	// the collector result has the statistics of all collected blocks, even
+	// with an error
+	result, err := taskPool.Execute()
+
+	stats := result.(*ReplayForkStats)
+	errstrSlice := make([]string, 0, len(stats.Counts))
+	for errstr := range stats.Counts {
 		errstrSlice = append(errstrSlice, errstr)
 	}
+	sort.Strings(errstrSlice)
 	for _, errstr := range errstrSlice {
-		stat := ReplayForkStatMap[errstr]
-		count := stat.Count
-		fmt.Printf("substate-cli replay-fork: %12v %s\n", count, errstr)
+		fmt.Printf("substate-cli replay-fork: %12v %s\n", stats.Counts[errstr], errstr)
 	}
 
 	return err
@@ -1363,7 +1363,16 @@ func (bc *BlockChain) InsertChain(chain types.Blocks) (int, error) {
 		return 0, errChainStopped
 	}
 	defer bc.chainmu.Unlock()
-	return bc.insertChain(chain, true, true)
+	n, err := bc.insertChain(chain, true, true)
+
+	// record-replay: write recorded blocks after each batch, as the substate
+	// DB may not be closed if geth exits on an error
+	if p, ok := bc.processor.(*StateProcessor); ok {
+		if flushErr := p.flushRecordedBlocks(); flushErr != nil && err == nil {
+			err = flushErr
+		}
+	}
+	return n, err
 }
 
 // insertChain is the internal implementation of InsertChain, which assumes that
@@ -1639,6 +1648,12 @@ func (bc *BlockChain) insertChain(chain types.Blocks, verifySeals, setHead bool)
 		if err != nil {
 			return it.index, err
 		}
+		// record-replay: mark the block as recorded once it is inserted
+		if p, ok := bc.processor.(*StateProcessor); ok {
+			if err := p.recordBlock(block); err != nil {
+				return it.index, err
+			}
+		}
 		// Update the metrics touched during block commit
 		accountCommitTimer.Update(statedb.AccountCommits)   // Account commits are complete, we can mark them
 		storageCommitTimer.Update(statedb.StorageCommits)   // Storage commits are complete, we can mark them
@@ -29,6 +29,9 @@ import (
 	"github.com/ethereum/go-ethereum/event"
 	"github.com/ethereum/go-ethereum/params"
 	"github.com/ethereum/go-ethereum/rlp"
+
+	// record-replay: import research
+	"github.com/ethereum/go-ethereum/research"
 )
 
 // CurrentHeader retrieves the current head header of the canonical chain. The
@@ -324,6 +327,14 @@ func (bc *BlockChain) Validator() Validator {
 	return bc.validator
 }
 
+// record-replay: SetSubstateDB sets the substate DB that the state processor
+// records transaction substates into.
+func (bc *BlockChain) SetSubstateDB(substateDB *research.SubstateDB) {
+	if p, ok := bc.processor.(*StateProcessor); ok {
+		p.SetSubstateDB(substateDB)
+	}
+}
+
 // Processor returns the current processor.
 func (bc *BlockChain) Processor() Processor {
 	return bc.processor
@@ -39,6 +39,14 @@ type StateProcessor struct {
 	config *params.ChainConfig // Chain configuration options
 	bc     *BlockChain         // Canonical block chain
 	engine consensus.Engine    // Consensus engine used for block rewards
+
+	// record-replay: substate DB to record transaction substates, nil disables recording
+	substateDB *research.SubstateDB
+
+	// record-replay: summary of the last processed block, written by
+	// recordBlock once the block is inserted
+	researchBlock   common.Hash
+	researchSummary *research.BlockSummary
 }
 
 // NewStateProcessor initialises a new StateProcessor.
@@ -50,6 +58,42 @@ func NewStateProcessor(config *params.ChainConfig, bc *BlockChain, engine consen
 	}
 }
 
+// record-replay: SetSubstateDB sets the substate DB that transaction substates
+// are recorded into. A nil substateDB disables recording.
+func (p *StateProcessor) SetSubstateDB(substateDB *research.SubstateDB) {
+	p.substateDB = substateDB
+}
+
+// record-replay: recordBlock writes the summary of a processed block and
+// marks the block as recorded. It is called after the block is validated and
+// written, so that blocks that fail validation are never marked.
+func (p *StateProcessor) recordBlock(block *types.Block) error {
+	if p.substateDB == nil {
+		return nil
+	}
+	if p.researchSummary == nil || p.researchBlock != block.Hash() {
+		return fmt.Errorf("record-replay: block %v was not processed before insert", block.NumberU64())
+	}
+	summary := p.researchSummary
+	p.researchSummary = nil
+	if err := p.substateDB.PutBlockSummary(block.NumberU64(), summary); err != nil {
+		return fmt.Errorf("record-replay: could not record block summary: %w", err)
+	}
+	if err := p.substateDB.AddRecordedBlocks(block.NumberU64(), block.NumberU64()); err != nil {
+		return fmt.Errorf("record-replay: could not record block: %w", err)
+	}
+	return nil
+}
+
+// record-replay: flushRecordedBlocks writes the blocks marked by recordBlock
+// to the substate DB.
+func (p *StateProcessor) flushRecordedBlocks() error {
+	if p.substateDB == nil {
+		return nil
+	}
+	return p.substateDB.FlushRecordedBlocks()
+}
+
 // Process processes the state changes according to the Ethereum rules by running
 // the transaction messages using the statedb and applying any rewards to both
 // the processor (coinbase) and any included uncles.
@@ -66,6 +110,8 @@ func (p *StateProcessor) Process(block *types.Block, statedb *state.StateDB, cfg
 		blockNumber = block.Number()
 		allLogs     []*types.Log
 		gp          = new(GasPool).AddGas(block.GasLimit())
+
+		researchSummary research.BlockSummary // record-replay: summary of recorded substates
 	)
 	// Mutate the block and state according to any hard-fork specs
 	if p.config.DAOForkSupport && p.config.DAOForkBlock != nil && p.config.DAOForkBlock.Cmp(block.Number()) == 0 {
@@ -95,20 +141,34 @@ func (p *StateProcessor) Process(block *types.Block, statedb *state.StateDB, cfg
 		}
 
 		// record-replay: save tx substate into DBs, merge block hashes to env
-		researchSubstate := research.NewSubstate(
-			statedb.ResearchPreAlloc,
-			statedb.ResearchPostAlloc,
-			research.NewSubstateEnv(block, statedb.ResearchBlockHashes),
-			research.NewSubstateMessage(&msg),
-			research.NewSubstateResult(receipt),
-		)
-		research.PutSubstate(block.NumberU64(), i, researchSubstate)
+		if p.substateDB != nil {
+			researchSubstate := research.NewSubstate(
+				statedb.ResearchPreAlloc,
+				statedb.ResearchPostAlloc,
+				research.NewSubstateEnv(block, statedb.ResearchBlockHashes),
+				research.NewSubstateMessage(&msg),
+				research.NewSubstateResult(receipt),
+			)
+			if err := p.substateDB.PutSubstate(block.NumberU64(), i, researchSubstate); err != nil {
+				return nil, nil, 0, fmt.Errorf("record-replay: could not record tx %d [%v]: %w", i, tx.Hash().Hex(), err)
+			}
+			if err := p.substateDB.PutTxHash(block.NumberU64(), i, tx.Hash()); err != nil {
+				return nil, nil, 0, fmt.Errorf("record-replay: could not record tx %d [%v]: %w", i, tx.Hash().Hex(), err)
+			}
+			researchSummary.Add(researchSubstate)
+		}
 		receipts = append(receipts, receipt)
 		allLogs = append(allLogs, receipt.Logs...)
 	}
 	// Finalize the block, applying any consensus engine specific extras (e.g. block rewards)
 	p.engine.Finalize(p.bc, header, statedb, block.Transactions(), block.Uncles())
 
+	// record-replay: keep block summary until the block is inserted, also for
+	// blocks without transactions
+	if p.substateDB != nil {
+		p.researchBlock, p.researchSummary = blockHash, &researchSummary
+	}
+
 	return receipts, allLogs, *usedGas, nil
 }
 
@@ -0,0 +1,358 @@
+package research
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// SubstateTxKind classifies transactions the same way as --skip-* flags.
+type SubstateTxKind int
+
+const (
+	TransferTx SubstateTxKind = iota // transaction to an account without bytecode
+	CallTx                           // transaction to an account with bytecode
+	CreateTx                         // contract creation transaction
+)
+
+func (k SubstateTxKind) String() string {
+	switch k {
+	case TransferTx:
+		return "transfer"
+	case CallTx:
+		return "call"
+	case CreateTx:
+		return "create"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(k))
+	}
+}
+
+// ParseSubstateTxKind parses the name of a kind as printed by String.
+func ParseSubstateTxKind(name string) (SubstateTxKind, error) {
+	switch name {
+	case "transfer":
+		return TransferTx, nil
+	case "call":
+		return CallTx, nil
+	case "create":
+		return CreateTx, nil
+	default:
+		return TransferTx, fmt.Errorf("unknown transaction kind %q", name)
+	}
+}
+
+// NumTxsOf returns the number of transactions of the given kind.
+func (s *BlockSummary) NumTxsOf(kind SubstateTxKind) uint64 {
+	switch kind {
+	case TransferTx:
+		return s.NumTransferTxs
+	case CallTx:
+		return s.NumCallTxs
+	case CreateTx:
+		return s.NumCreateTxs
+	default:
+		return 0
+	}
+}
+
+// TxKind returns the kind of the transaction of the substate.
+func (substate *Substate) TxKind() SubstateTxKind {
+	to := substate.Message.To
+	if to == nil {
+		return CreateTx
+	}
+	if account, exist := substate.InputAlloc[*to]; exist && account != nil && len(account.Code) > 0 {
+		return CallTx
+	}
+	return TransferTx
+}
+
+// BlockSummary summarizes the substates of a block, so that blocks can be
+// selected without decoding their substates.
+type BlockSummary struct {
+	NumTxs         uint64
+	GasUsed        uint64
+	NumTransferTxs uint64
+	NumCallTxs     uint64
+	NumCreateTxs   uint64
+	To             []common.Address // distinct recipients in ascending order
+
+	// PrunedTxs are the indices of transactions whose substates were deleted
+	// by PruneSubstates with kinds, in ascending order. NumTxs does not
+	// count them.
+	PrunedTxs []uint64 `rlp:"optional"`
+}
+
+// Add adds a transaction substate to the summary.
+func (s *BlockSummary) Add(substate *Substate) {
+	s.NumTxs++
+	s.GasUsed += substate.Result.GasUsed
+
+	switch substate.TxKind() {
+	case TransferTx:
+		s.NumTransferTxs++
+	case CallTx:
+		s.NumCallTxs++
+	case CreateTx:
+		s.NumCreateTxs++
+	}
+
+	if to := substate.Message.To; to != nil {
+		i := sort.Search(len(s.To), func(i int) bool {
+			return bytes.Compare(s.To[i].Bytes(), to.Bytes()) >= 0
+		})
+		if i == len(s.To) || s.To[i] != *to {
+			s.To = append(s.To, common.Address{})
+			copy(s.To[i+1:], s.To[i:])
+			s.To[i] = *to
+		}
+	}
+}
+
+// setPrunedTxs sets PrunedTxs to the given transaction indices except those
+// that have substates in the block, see rebuildBlockSummary and Reindex.
+func (s *BlockSummary) setPrunedTxs(pruned []uint64, hasSubstate func(tx int) bool) {
+	seen := make(map[uint64]struct{}, len(pruned))
+	s.PrunedTxs = nil
+	for _, tx := range pruned {
+		if _, ok := seen[tx]; ok || hasSubstate(int(tx)) {
+			continue
+		}
+		seen[tx] = struct{}{}
+		s.PrunedTxs = append(s.PrunedTxs, tx)
+	}
+	sort.Slice(s.PrunedTxs, func(i, j int) bool { return s.PrunedTxs[i] < s.PrunedTxs[j] })
+}
+
+// isPruned reports whether PrunedTxs contains transaction index tx. A nil
+// summary has no pruned transactions.
+func (s *BlockSummary) isPruned(tx int) bool {
+	if s == nil || tx < 0 {
+		return false
+	}
+	i := sort.Search(len(s.PrunedTxs), func(i int) bool { return s.PrunedTxs[i] >= uint64(tx) })
+	return i < len(s.PrunedTxs) && s.PrunedTxs[i] == uint64(tx)
+}
+
+// missingTxs calls fn for every run of transaction indices from tx to last
+// (inclusive) that are not pruned, see FindGaps and Verify.
+func (s *BlockSummary) missingTxs(tx, last int, fn func(first, last int)) {
+	for tx <= last {
+		if s.isPruned(tx) {
+			tx++
+			continue
+		}
+		end := tx
+		for end < last && !s.isPruned(end+1) {
+			end++
+		}
+		fn(tx, end)
+		tx = end + 1
+	}
+}
+
+// HasTo reports whether a transaction of the block was sent to addr.
+func (s *BlockSummary) HasTo(addr common.Address) bool {
+	i := sort.Search(len(s.To), func(i int) bool {
+		return bytes.Compare(s.To[i].Bytes(), addr.Bytes()) >= 0
+	})
+	return i < len(s.To) && s.To[i] == addr
+}
+
+func Stage1BlockSummaryKey(block uint64) []byte {
+	prefix := []byte(stage1BlockSummaryPrefix)
+
+	blockBytes := make([]byte, 8)
+	binary.BigEndian.PutUint64(blockBytes[0:8], block)
+
+	return append(prefix, blockBytes...)
+}
+
+func DecodeStage1BlockSummaryKey(key []byte) (block uint64, err error) {
+	prefix := stage1BlockSummaryPrefix
+	if len(key) != len(prefix)+8 {
+		err = fmt.Errorf("invalid length of stage1 block summary key: %v", len(key))
+		return
+	}
+	if p := string(key[:len(prefix)]); p != prefix {
+		err = fmt.Errorf("invalid prefix of stage1 block summary key: %#x", p)
+		return
+	}
+	block = binary.BigEndian.Uint64(key[len(prefix):])
+	return
+}
+
+func (db *SubstateDB) PutBlockSummary(block uint64, summary *BlockSummary) error {
+	return putBlockSummary(db.backend, block, summary)
+}
+
+func putBlockSummary(w ethdb.KeyValueWriter, block uint64, summary *BlockSummary) error {
+	value, err := rlp.EncodeToBytes(summary)
+	if err != nil {
+		return fmt.Errorf("record-replay: error encoding block summary %v: %v", block, err)
+	}
+	err = w.Put(Stage1BlockSummaryKey(block), value)
+	if err != nil {
+		return fmt.Errorf("record-replay: error putting block summary %v: %v", block, err)
+	}
+	return nil
+}
+
+// GetBlockSummary returns the summary of a block, or nil if the block has no
+// summary record.
+func (db *SubstateDB) GetBlockSummary(block uint64) (*BlockSummary, error) {
+	key := Stage1BlockSummaryKey(block)
+	has, err := db.backend.Has(key)
+	if err != nil {
+		return nil, fmt.Errorf("record-replay: error checking block summary %v: %v", block, err)
+	}
+	if !has {
+		return nil, nil
+	}
+	value, err := db.backend.Get(key)
+	if err != nil {
+		return nil, fmt.Errorf("record-replay: error getting block summary %v: %v", block, err)
+	}
+	summary := BlockSummary{}
+	if err := rlp.DecodeBytes(value, &summary); err != nil {
+		return nil, fmt.Errorf("record-replay: error decoding block summary %v: %v", block, err)
+	}
+	return &summary, nil
+}
+
+func (db *SubstateDB) DeleteBlockSummary(block uint64) error {
+	err := db.backend.Delete(Stage1BlockSummaryKey(block))
+	if err != nil {
+		return fmt.Errorf("record-replay: error deleting block summary %v: %v", block, err)
+	}
+	return nil
+}
+
+// rebuildBlockSummary rewrites the summary of a block from its substates.
+// Pruned transactions of the old summary and the given pruned transactions
+// are kept unless the block has substates of them.
+func (db *SubstateDB) rebuildBlockSummary(block uint64, pruned []uint64) error {
+	substates, err := db.GetBlockSubstates(block)
+	if err != nil {
+		return err
+	}
+	old, err := db.GetBlockSummary(block)
+	if err != nil {
+		return err
+	}
+	if old != nil {
+		pruned = append(append([]uint64(nil), old.PrunedTxs...), pruned...)
+	}
+	txs := make([]int, 0, len(substates))
+	for tx := range substates {
+		txs = append(txs, tx)
+	}
+	sort.Ints(txs)
+	summary := &BlockSummary{}
+	for _, tx := range txs {
+		summary.Add(substates[tx])
+	}
+	summary.setPrunedTxs(pruned, func(tx int) bool {
+		_, ok := substates[tx]
+		return ok
+	})
+	return db.PutBlockSummary(block, summary)
+}
+
+// ForEachBlockSummary calls fn on block summaries from block first to block
+// last (inclusive) in ascending block order.
+func (db *SubstateDB) ForEachBlockSummary(first, last uint64, fn func(block uint64, summary *BlockSummary) error) error {
+	start := make([]byte, 8)
+	binary.BigEndian.PutUint64(start, first)
+	iter := db.backend.NewIterator([]byte(stage1BlockSummaryPrefix), start)
+	defer iter.Release()
+
+	for iter.Next() {
+		key := iter.Key()
+		block, err := DecodeStage1BlockSummaryKey(key)
+		if err != nil {
+			return fmt.Errorf("record-replay: invalid block summary key %#x: %v", key, err)
+		}
+		if block > last {
+			break
+		}
+		summary := BlockSummary{}
+		if err := rlp.DecodeBytes(iter.Value(), &summary); err != nil {
+			return fmt.Errorf("record-replay: error decoding block summary %v: %v", block, err)
+		}
+		if err := fn(block, &summary); err != nil {
+			return err
+		}
+	}
+	return iter.Error()
+}
+
+// Reindex rewrites block summaries of all blocks with substates from block
+// first to block last (inclusive). Blocks without substates are left
+// untouched because a missing substate cannot be told apart from a block
+// without transactions. Pruned transactions of old summaries are kept.
+func (db *SubstateDB) Reindex(first, last uint64, workers int) (numBlocks int64, err error) {
+	batch := db.backend.NewBatch()
+
+	var (
+		block   uint64
+		summary *BlockSummary
+		txs     map[int]struct{} // transactions of block with substates
+	)
+	flush := func() error {
+		if summary == nil {
+			return nil
+		}
+		old, err := db.GetBlockSummary(block)
+		if err != nil {
+			return err
+		}
+		if old != nil {
+			summary.setPrunedTxs(old.PrunedTxs, func(tx int) bool {
+				_, ok := txs[tx]
+				return ok
+			})
+		}
+		if err := putBlockSummary(batch, block, summary); err != nil {
+			return err
+		}
+		numBlocks++
+		if batch.ValueSize() >= ethdb.IdealBatchSize {
+			if err := batch.Write(); err != nil {
+				return err
+			}
+			batch.Reset()
+		}
+		return nil
+	}
+
+	iter := db.NewSubstateIterator(first, last, workers)
+	defer iter.Release()
+	for iter.Next() {
+		entry := iter.Value()
+		if summary == nil || entry.Block != block {
+			if err := flush(); err != nil {
+				return numBlocks, err
+			}
+			block = entry.Block
+			summary = &BlockSummary{}
+			txs = make(map[int]struct{})
+		}
+		summary.Add(entry.Substate)
+		txs[entry.Tx] = struct{}{}
+	}
+	if err := iter.Error(); err != nil {
+		return numBlocks, err
+	}
+	if err := flush(); err != nil {
+		return numBlocks, err
+	}
+
+	return numBlocks, batch.Write()
+}
@@ -14,26 +14,45 @@ var (
 		Usage: "Data directory for substate recorder/replayer",
 		Value: "substate.ethereum",
 	}
-	substateDir      = SubstateDirFlag.Value
+	SubstateLayoutFlag = cli.StringFlag{
+		Name:  "substate-layout",
+		Usage: "Layout of recorded substates: inline, or dedup to store each distinct account state once",
+		Value: InlineAccountLayout.String(),
+	}
+	SubstateCompressionFlag = cli.StringFlag{
+		Name:  "substate-compression",
+		Usage: "Compression of recorded substates: none or snappy",
+		Value: "none",
+	}
+	CodeCacheFlag = cli.IntFlag{
+		Name:  "code-cache",
+		Usage: "Memory allowance (MB) for caching code blobs read from the substate DB, 0 to disable",
+		Value: 64,
+	}
+	substateDir = SubstateDirFlag.Value
+
+	// staticSubstateDB is a package-global handle kept for compatibility.
+	// New code should open its own handle with OpenSubstateDBWithOptions
+	// and pass it explicitly.
 	staticSubstateDB *SubstateDB
 )
 
 func OpenSubstateDB() {
 	fmt.Println("record-replay: OpenSubstateDB")
-	backend, err := rawdb.NewLevelDBDatabase(substateDir, 1024, 100, "substatedir", false)
+	db, err := OpenSubstateDBWithOptions(NewSubstateDBOptions(substateDir, false))
 	if err != nil {
-		panic(fmt.Errorf("error opening substate leveldb %s: %v", substateDir, err))
+		panic(err)
 	}
-	staticSubstateDB = NewSubstateDB(backend)
+	staticSubstateDB = db
 }
 
 func OpenSubstateDBReadOnly() {
 	fmt.Println("record-replay: OpenSubstateDB")
-	backend, err := rawdb.NewLevelDBDatabase(substateDir, 1024, 100, "substatedir", true)
+	db, err := OpenSubstateDBWithOptions(NewSubstateDBOptions(substateDir, true))
 	if err != nil {
-		panic(fmt.Errorf("error opening substate leveldb %s: %v", substateDir, err))
+		panic(err)
 	}
-	staticSubstateDB = NewSubstateDB(backend)
+	staticSubstateDB = db
 }
 
 func CloseSubstateDB() {
@@ -64,39 +83,70 @@ func CloseFakeSubstateDB() {
 	staticSubstateDB.Close()
 }
 
+// StaticSubstateDB returns the substate DB opened by OpenSubstateDB.
+func StaticSubstateDB() *SubstateDB {
+	return staticSubstateDB
+}
+
 func SetSubstateFlags(ctx *cli.Context) {
 	substateDir = ctx.String(SubstateDirFlag.Name)
 	fmt.Printf("record-replay: --substatedir=%s\n", substateDir)
 }
 
 func HasCode(codeHash common.Hash) bool {
-	return staticSubstateDB.HasCode(codeHash)
+	has, err := staticSubstateDB.HasCode(codeHash)
+	if err != nil {
+		panic(err)
+	}
+	return has
 }
 
 func GetCode(codeHash common.Hash) []byte {
-	return staticSubstateDB.GetCode(codeHash)
+	code, err := staticSubstateDB.GetCode(codeHash)
+	if err != nil {
+		panic(err)
+	}
+	return code
 }
 
 func PutCode(code []byte) {
-	staticSubstateDB.PutCode(code)
+	err := staticSubstateDB.PutCode(code)
+	if err != nil {
+		panic(err)
+	}
 }
 
 func HasSubstate(block uint64, tx int) bool {
-	return staticSubstateDB.HasSubstate(block, tx)
+	has, _ := staticSubstateDB.HasSubstate(block, tx)
+	return has
 }
 
 func GetSubstate(block uint64, tx int) *Substate {
-	return staticSubstateDB.GetSubstate(block, tx)
+	substate, err := staticSubstateDB.GetSubstate(block, tx)
+	if err != nil {
+		panic(fmt.Errorf("record-replay: %v", err))
+	}
+	return substate
 }
 
 func GetBlockSubstates(block uint64) map[int]*Substate {
-	return staticSubstateDB.GetBlockSubstates(block)
+	txSubstate, err := staticSubstateDB.GetBlockSubstates(block)
+	if err != nil {
+		panic(fmt.Errorf("record-replay: %v", err))
+	}
+	return txSubstate
 }
 
 func PutSubstate(block uint64, tx int, substate *Substate) {
-	staticSubstateDB.PutSubstate(block, tx, substate)
+	err := staticSubstateDB.PutSubstate(block, tx, substate)
+	if err != nil {
+		panic(fmt.Errorf("record-replay: %v", err))
+	}
 }
 
 func DeleteSubstate(block uint64, tx int) {
-	staticSubstateDB.DeleteSubstate(block, tx)
+	err := staticSubstateDB.DeleteSubstate(block, tx)
+	if err != nil {
+		panic(fmt.Errorf("record-replay: %v", err))
+	}
 }
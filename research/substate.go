@@ -129,7 +129,7 @@ func (x *SubstateEnv) Equal(y *SubstateEnv) bool {
 		x.Number == y.Number &&
 		x.Timestamp == y.Timestamp &&
 		len(x.BlockHashes) == len(y.BlockHashes) &&
-		x.BaseFee.Cmp(y.BaseFee) == 0)
+		(x.BaseFee == y.BaseFee || (x.BaseFee != nil && y.BaseFee != nil && x.BaseFee.Cmp(y.BaseFee) == 0)))
 	if !equal {
 		return false
 	}
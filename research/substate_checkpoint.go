@@ -0,0 +1,199 @@
+package research
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	cli "gopkg.in/urfave/cli.v1"
+)
+
+var (
+	CheckpointDirFlag = cli.StringFlag{
+		Name:  "checkpoint-dir",
+		Usage: "Directory to write checkpoints of the collected blocks to, no checkpoints if empty",
+	}
+	ResumeFlag = cli.BoolFlag{
+		Name:  "resume",
+		Usage: "Resume from the checkpoint in --checkpoint-dir instead of starting from the first block",
+	}
+)
+
+// checkpointFileName is the name of the checkpoint file in the checkpoint
+// directory of a SubstateTaskPool
+const checkpointFileName = "checkpoint.json"
+
+// checkpointInterval is the minimum time between two checkpoints written
+// while the task pool is running
+const checkpointInterval = 1 * time.Minute
+
+// TaskCheckpoint records the progress of a SubstateTaskPool. All blocks from
+// First to Block (inclusive) of the transactions described by Selection have
+// been passed to CollectorAction, and State is the collector result after the
+// last of them. State is nil unless the collector result implements
+// encoding.BinaryMarshaler.
+type TaskCheckpoint struct {
+	Name      string `json:"name"`
+	First     uint64 `json:"first"`
+	Last      uint64 `json:"last"`
+	Selection string `json:"selection,omitempty"`
+	Block     uint64 `json:"block"`
+	State     []byte `json:"state,omitempty"`
+}
+
+func checkpointPath(dir string) string {
+	return filepath.Join(dir, checkpointFileName)
+}
+
+// ReadTaskCheckpoint reads the checkpoint from the given directory. It
+// returns nil and no error if there is no checkpoint.
+func ReadTaskCheckpoint(dir string) (*TaskCheckpoint, error) {
+	data, err := ioutil.ReadFile(checkpointPath(dir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	cp := &TaskCheckpoint{}
+	if err := json.Unmarshal(data, cp); err != nil {
+		return nil, fmt.Errorf("invalid checkpoint %s: %v", checkpointPath(dir), err)
+	}
+	return cp, nil
+}
+
+// WriteTaskCheckpoint replaces the checkpoint in the given directory, which
+// is created if it does not exist. The new checkpoint is written to a
+// temporary file first so that a crash never leaves a partially written
+// checkpoint behind.
+func WriteTaskCheckpoint(dir string, cp *TaskCheckpoint) error {
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp := checkpointPath(dir) + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, checkpointPath(dir))
+}
+
+// selection describes the transactions executed by the task pool besides
+// its block range, see TaskCheckpoint.
+func (pool *SubstateTaskPool) selection() string {
+	var parts []string
+	if sel := pool.Selector; sel != nil {
+		for _, txHash := range sel.TxHashes {
+			parts = append(parts, fmt.Sprintf("--%s=%s", TxHashFlag.Name, txHash.Hex()))
+		}
+		for _, addr := range sel.Addresses {
+			parts = append(parts, fmt.Sprintf("--%s=%s", AddressFlag.Name, addr.Hex()))
+		}
+	}
+	if pool.Filter != nil {
+		parts = append(parts, fmt.Sprintf("--%s=%q", FilterFlag.Name, pool.Filter.String()))
+	}
+	for _, skip := range []struct {
+		flag cli.BoolFlag
+		set  bool
+	}{
+		{SkipTransferTxsFlag, pool.SkipTransferTxs},
+		{SkipCallTxsFlag, pool.SkipCallTxs},
+		{SkipCreateTxsFlag, pool.SkipCreateTxs},
+	} {
+		if skip.set {
+			parts = append(parts, "--"+skip.flag.Name)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// loadCheckpoint returns the first block to execute and restores the
+// collector result from the checkpoint of a previous run with --resume. The
+// checkpoint must be of the same task, block range and selection of
+// transactions, and must have a collector state unless the collector result
+// is a VanillaCollectorResult.
+func (pool *SubstateTaskPool) loadCheckpoint(collectorResult CollectorResult) (first uint64, done bool, err error) {
+	first = pool.First
+	if !pool.Resume {
+		return first, false, nil
+	}
+	if pool.CheckpointDir == "" {
+		return first, false, fmt.Errorf("--%s requires --%s", ResumeFlag.Name, CheckpointDirFlag.Name)
+	}
+
+	cp, err := ReadTaskCheckpoint(pool.CheckpointDir)
+	if err != nil {
+		return first, false, err
+	}
+	if cp == nil {
+		fmt.Printf("%s: no checkpoint in %s, start from block %v\n", pool.Name, pool.CheckpointDir, first)
+		return first, false, nil
+	}
+	if cp.Name != pool.Name {
+		return first, false, fmt.Errorf("checkpoint of %q does not match %q", cp.Name, pool.Name)
+	}
+	if cp.First != pool.First || cp.Last != pool.Last {
+		return first, false, fmt.Errorf("checkpoint of block range %v %v does not match block range %v %v",
+			cp.First, cp.Last, pool.First, pool.Last)
+	}
+	if selection := pool.selection(); cp.Selection != selection {
+		return first, false, fmt.Errorf("checkpoint of transactions selected by %q does not match %q", cp.Selection, selection)
+	}
+	if cp.Block < cp.First || cp.Block > cp.Last {
+		return first, false, fmt.Errorf("checkpoint block %v out of block range %v %v", cp.Block, cp.First, cp.Last)
+	}
+
+	if cp.State == nil {
+		// the collector result of the blocks before the checkpoint is lost
+		if _, ok := collectorResult.(*VanillaCollectorResult); !ok {
+			return first, false, fmt.Errorf("checkpoint has no state to restore collector result %T", collectorResult)
+		}
+	} else {
+		u, ok := collectorResult.(encoding.BinaryUnmarshaler)
+		if !ok {
+			return first, false, fmt.Errorf("collector result %T cannot restore checkpoint state", collectorResult)
+		}
+		if err := u.UnmarshalBinary(cp.State); err != nil {
+			return first, false, fmt.Errorf("error restoring checkpoint state: %v", err)
+		}
+	}
+
+	fmt.Printf("%s: resume from checkpoint at block %v\n", pool.Name, cp.Block)
+	if cp.Block == pool.Last {
+		return first, true, nil
+	}
+	return cp.Block + 1, false, nil
+}
+
+// saveCheckpoint writes a checkpoint for all blocks collected up to block
+// (inclusive) if the pool has a checkpoint directory.
+func (pool *SubstateTaskPool) saveCheckpoint(block uint64, collectorResult CollectorResult) error {
+	if pool.CheckpointDir == "" {
+		return nil
+	}
+
+	cp := &TaskCheckpoint{
+		Name:      pool.Name,
+		First:     pool.First,
+		Last:      pool.Last,
+		Selection: pool.selection(),
+		Block:     block,
+	}
+	if m, ok := collectorResult.(encoding.BinaryMarshaler); ok {
+		state, err := m.MarshalBinary()
+		if err != nil {
+			return fmt.Errorf("error saving checkpoint state: %v", err)
+		}
+		cp.State = state
+	}
+	return WriteTaskCheckpoint(pool.CheckpointDir, cp)
+}
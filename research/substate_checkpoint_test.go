@@ -0,0 +1,154 @@
+package research
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// checkpointedBlocks is a collectedBlocks that is saved in checkpoints.
+type checkpointedBlocks struct {
+	Blocks []uint64 `json:"blocks"`
+	Txs    [][]int  `json:"txs"`
+}
+
+func (c *checkpointedBlocks) MarshalBinary() ([]byte, error) {
+	return json.Marshal(c)
+}
+
+func (c *checkpointedBlocks) UnmarshalBinary(data []byte) error {
+	return json.Unmarshal(data, c)
+}
+
+func collectCheckpointedBlocks(result BlockResult, prev *CollectorResult) error {
+	c := (*prev).(*checkpointedBlocks)
+	c.Blocks = append(c.Blocks, result.BlockId)
+	var txs []int
+	for _, res := range result.Results {
+		txs = append(txs, res.(*VanillaWorkerResult).TxId)
+	}
+	c.Txs = append(c.Txs, txs)
+	return nil
+}
+
+func TestSubstateTaskPoolResume(t *testing.T) {
+	txs := []int{1, 2, 0, 3, 1, 1, 2, 0, 4, 1, 2, 1, 3, 0, 1, 2}
+	db := newTestTaskDB(t, txs)
+	dir := t.TempDir()
+
+	errFail := errors.New("interrupted")
+	newPool := func(failBlock uint64) *SubstateTaskPool {
+		return &SubstateTaskPool{
+			Name: "test",
+			WorkerAction: func(block uint64, tx int, substate *Substate) (WorkerResult, error) {
+				if block == failBlock {
+					return nil, errFail
+				}
+				return &VanillaWorkerResult{BlockId: block, TxId: tx}, nil
+			},
+			CollectorAction: collectCheckpointedBlocks,
+			CollectorInit:   func() CollectorResult { return &checkpointedBlocks{} },
+			First:           1,
+			Last:            uint64(len(txs) - 1),
+			Workers:         1,
+			DB:              db,
+		}
+	}
+
+	// uninterrupted run without checkpoints
+	want, err := newPool(0).Execute()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// stop at block 9
+	pool := newPool(9)
+	pool.CheckpointDir = dir
+	if _, err := pool.Execute(); err == nil {
+		t.Fatal("no error at block 9")
+	}
+	cp, err := ReadTaskCheckpoint(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cp == nil || cp.Block < pool.First || cp.Block >= 9 || cp.State == nil {
+		t.Fatalf("checkpoint %+v, want collected blocks before block 9 with state", cp)
+	}
+
+	// resume from the checkpoint
+	pool = newPool(0)
+	pool.CheckpointDir = dir
+	pool.Resume = true
+	got, err := pool.Execute()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("resumed result %+v, want %+v", got, want)
+	}
+	if cp, err := ReadTaskCheckpoint(dir); err != nil || cp.Block != pool.Last {
+		t.Fatalf("final checkpoint %+v, error %v", cp, err)
+	}
+
+	// resuming a finished run does not execute anything
+	pool = newPool(1)
+	pool.CheckpointDir = dir
+	pool.Resume = true
+	if got, err = pool.Execute(); err != nil || !reflect.DeepEqual(got, want) {
+		t.Fatalf("resumed finished result %+v, error %v", got, err)
+	}
+}
+
+func TestSubstateTaskPoolResumeMismatch(t *testing.T) {
+	txs := []int{1, 2, 0, 3, 1}
+	db := newTestTaskDB(t, txs)
+	filter, err := CompileSubstateFilter("status == 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		cp     TaskCheckpoint
+		filter *SubstateFilter
+		state  bool // collector result can be saved in checkpoints
+		ok     bool
+	}{
+		{"checkpoint", TaskCheckpoint{Name: "test", First: 1, Last: 4, Block: 2, State: []byte("{}")}, nil, true, true},
+		{"other task", TaskCheckpoint{Name: "other", First: 1, Last: 4, Block: 2, State: []byte("{}")}, nil, true, false},
+		{"other range", TaskCheckpoint{Name: "test", First: 0, Last: 4, Block: 2, State: []byte("{}")}, nil, true, false},
+		{"other filter", TaskCheckpoint{Name: "test", First: 1, Last: 4, Block: 2, State: []byte("{}")}, filter, true, false},
+		{"filter", TaskCheckpoint{Name: "test", First: 1, Last: 4, Selection: `--filter="status == 1"`, Block: 2, State: []byte("{}")}, filter, true, true},
+		{"no state", TaskCheckpoint{Name: "test", First: 1, Last: 4, Block: 2}, nil, true, false},
+		{"no state of vanilla collector", TaskCheckpoint{Name: "test", First: 1, Last: 4, Block: 2}, nil, false, true},
+	}
+	for _, test := range tests {
+		dir := t.TempDir()
+		if err := WriteTaskCheckpoint(dir, &test.cp); err != nil {
+			t.Fatal(err)
+		}
+		pool := &SubstateTaskPool{
+			Name: "test",
+			WorkerAction: func(block uint64, tx int, substate *Substate) (WorkerResult, error) {
+				return &VanillaWorkerResult{BlockId: block, TxId: tx}, nil
+			},
+			CollectorAction: collectCheckpointedBlocks,
+			CollectorInit:   func() CollectorResult { return &checkpointedBlocks{} },
+			First:           1,
+			Last:            uint64(len(txs) - 1),
+			Workers:         1,
+			DB:              db,
+			Filter:          test.filter,
+			CheckpointDir:   dir,
+			Resume:          true,
+		}
+		if !test.state {
+			pool.CollectorAction = VanillaCollectorAction
+			pool.CollectorInit = VanillaCollectorInit
+		}
+		if _, err := pool.Execute(); (err == nil) != test.ok {
+			t.Errorf("%s: resumed with error %v, want success %v", test.name, err, test.ok)
+		}
+	}
+}
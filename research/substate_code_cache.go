@@ -0,0 +1,132 @@
+package research
+
+import (
+	"math"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/metrics"
+	"github.com/hashicorp/golang-lru/simplelru"
+)
+
+var (
+	codeCacheHitCounter  = metrics.NewRegisteredCounterForced("substate/codecache/hit", nil)
+	codeCacheMissCounter = metrics.NewRegisteredCounterForced("substate/codecache/miss", nil)
+)
+
+// codeCache is an LRU cache of code blobs bounded by their total size.
+type codeCache struct {
+	lock    sync.Mutex
+	codes   *simplelru.LRU // code hash -> code blob
+	size    int            // total size of cached code blobs
+	maxSize int
+
+	hits, misses int64
+}
+
+func newCodeCache(maxSize int) *codeCache {
+	c := &codeCache{maxSize: maxSize}
+	// the number of code blobs is bounded by their size, not by the LRU
+	c.codes, _ = simplelru.NewLRU(math.MaxInt32, func(key, value interface{}) {
+		c.size -= len(value.([]byte))
+	})
+	return c
+}
+
+func (c *codeCache) has(codeHash common.Hash) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.codes.Contains(codeHash)
+}
+
+func (c *codeCache) get(codeHash common.Hash) ([]byte, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	value, ok := c.codes.Get(codeHash)
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	// callers own the returned code blob, as with a read from the backend
+	return common.CopyBytes(value.([]byte)), true
+}
+
+func (c *codeCache) add(codeHash common.Hash, code []byte) {
+	if len(code) > c.maxSize {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.codes.Contains(codeHash) {
+		return
+	}
+	c.codes.Add(codeHash, common.CopyBytes(code))
+	c.size += len(code)
+	for c.size > c.maxSize {
+		c.codes.RemoveOldest()
+	}
+}
+
+func (c *codeCache) purge() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.codes.Purge()
+}
+
+func (c *codeCache) stats() (hits, misses int64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.hits, c.misses
+}
+
+// SetCodeCache sets the memory allowance (MB) for caching code blobs read by
+// GetCode, 0 disables the cache. Code blobs of popular contracts are read for
+// almost every substate, so the cache saves most reads of the backend. The
+// cache is safe for concurrent use and evicts the least recently read code
+// blobs when the total size of cached code blobs exceeds the allowance.
+func (db *SubstateDB) SetCodeCache(size int) {
+	if size <= 0 {
+		db.codeCache = nil
+		return
+	}
+	db.codeCache = newCodeCache(size * 1024 * 1024)
+}
+
+// CodeCacheStats returns the number of GetCode calls of the substate DB
+// served by the code cache and the number of calls that read the backend,
+// both zero if the code cache is disabled.
+func (db *SubstateDB) CodeCacheStats() (hits, misses int64) {
+	if db.codeCache == nil {
+		return 0, 0
+	}
+	return db.codeCache.stats()
+}
+
+// getCachedCode returns the cached code blob of codeHash.
+func (db *SubstateDB) getCachedCode(codeHash common.Hash) ([]byte, bool) {
+	if db.codeCache == nil {
+		return nil, false
+	}
+	code, ok := db.codeCache.get(codeHash)
+	if ok {
+		codeCacheHitCounter.Inc(1)
+	} else {
+		codeCacheMissCounter.Inc(1)
+	}
+	return code, ok
+}
+
+// cacheCode caches the code blob of codeHash.
+func (db *SubstateDB) cacheCode(codeHash common.Hash, code []byte) {
+	if db.codeCache != nil {
+		db.codeCache.add(codeHash, code)
+	}
+}
+
+// resetCodeCache drops all cached code blobs after code blobs are deleted.
+func (db *SubstateDB) resetCodeCache() {
+	if db.codeCache != nil {
+		db.codeCache.purge()
+	}
+}
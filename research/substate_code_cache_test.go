@@ -0,0 +1,77 @@
+package research
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/core/rawdb"
+)
+
+func TestCodeCacheLargeCode(t *testing.T) {
+	db := NewSubstateDB(rawdb.NewMemoryDatabase())
+	db.SetCodeCache(32)
+
+	// creation code can be larger than the 24KB limit of deployed code
+	code := bytes.Repeat([]byte{0x5b}, 100*1024)
+	if err := db.PutCode(code); err != nil {
+		t.Fatal(err)
+	}
+	codeHash := CodeHash(code)
+	if _, err := db.GetCode(codeHash); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.backend.Delete(Stage1CodeKey(codeHash)); err != nil {
+		t.Fatal(err)
+	}
+
+	cached, err := db.GetCode(codeHash)
+	if err != nil {
+		t.Fatalf("code not cached: %v", err)
+	}
+	if !bytes.Equal(cached, code) {
+		t.Fatalf("cached code has %v bytes, want %v", len(cached), len(code))
+	}
+	if has, err := db.HasCode(codeHash); err != nil || !has {
+		t.Fatalf("cached code not found: %v", err)
+	}
+}
+
+func TestCodeCacheEviction(t *testing.T) {
+	db := NewSubstateDB(rawdb.NewMemoryDatabase())
+	db.SetCodeCache(1)
+
+	// two of three code blobs fit into the cache
+	var codes [][]byte
+	for i := 0; i < 3; i++ {
+		code := bytes.Repeat([]byte{byte(i)}, 400*1024)
+		if err := db.PutCode(code); err != nil {
+			t.Fatal(err)
+		}
+		codes = append(codes, code)
+	}
+	read := func(i int) {
+		if _, err := db.GetCode(CodeHash(codes[i])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	read(0)
+	read(1)
+	read(0) // code 1 is now the least recently read
+	read(2)
+
+	for i, want := range []bool{true, false, true} {
+		if cached := db.codeCache.has(CodeHash(codes[i])); cached != want {
+			t.Errorf("code %v cached %v, want %v", i, cached, want)
+		}
+	}
+	if hits, misses := db.CodeCacheStats(); hits != 1 || misses != 3 {
+		t.Fatalf("code cache stats %v hits, %v misses, want 1 and 3", hits, misses)
+	}
+
+	// code cache stats are counted per substate DB
+	other := NewSubstateDB(rawdb.NewMemoryDatabase())
+	other.SetCodeCache(1)
+	if hits, misses := other.CodeCacheStats(); hits != 0 || misses != 0 {
+		t.Fatalf("code cache stats of other substate DB %v hits, %v misses, want none", hits, misses)
+	}
+}
@@ -0,0 +1,214 @@
+package research
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/golang/snappy"
+)
+
+// Compressed substate values start with compressedSubstateFlag|ID of the
+// compressor, followed by the compressed value. Format bytes are
+// below compressedSubstateFlag and RLP lists start at 0xc0, so the ID of a
+// compressor must be between 1 and 63.
+const compressedSubstateFlag = 0x80
+
+// SubstateCompressor compresses substate values.
+type SubstateCompressor interface {
+	ID() byte     // stored in the value header, between 1 and 63
+	Name() string // used in command line flags
+	Compress(src []byte) ([]byte, error)
+	Decompress(src []byte) ([]byte, error)
+}
+
+var (
+	substateCompressorsLock sync.RWMutex
+	substateCompressors     = make(map[byte]SubstateCompressor)
+)
+
+// RegisterSubstateCompressor makes a compressor available for reading and
+// writing substate values.
+func RegisterSubstateCompressor(c SubstateCompressor) error {
+	substateCompressorsLock.Lock()
+	defer substateCompressorsLock.Unlock()
+
+	id := c.ID()
+	if id == 0 || id >= 0xc0-compressedSubstateFlag {
+		return fmt.Errorf("invalid substate compressor ID %v for %s", id, c.Name())
+	}
+	if prev, exist := substateCompressors[id]; exist {
+		return fmt.Errorf("substate compressor ID %v of %s is already used by %s", id, c.Name(), prev.Name())
+	}
+	substateCompressors[id] = c
+	return nil
+}
+
+// SubstateCompressorByName returns the registered compressor with the given
+// name. It returns nil for "none" and the empty name.
+func SubstateCompressorByName(name string) (SubstateCompressor, error) {
+	if name == "" || name == "none" {
+		return nil, nil
+	}
+
+	substateCompressorsLock.RLock()
+	defer substateCompressorsLock.RUnlock()
+
+	for _, c := range substateCompressors {
+		if c.Name() == name {
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown substate compression %q", name)
+}
+
+// SubstateCompressorNames returns the names of registered compressors.
+func SubstateCompressorNames() []string {
+	substateCompressorsLock.RLock()
+	defer substateCompressorsLock.RUnlock()
+
+	names := []string{"none"}
+	for _, c := range substateCompressors {
+		names = append(names, c.Name())
+	}
+	sort.Strings(names[1:])
+	return names
+}
+
+func substateCompressorByID(id byte) (SubstateCompressor, error) {
+	substateCompressorsLock.RLock()
+	defer substateCompressorsLock.RUnlock()
+
+	c, exist := substateCompressors[id]
+	if !exist {
+		return nil, fmt.Errorf("unknown substate compressor ID %v", id)
+	}
+	return c, nil
+}
+
+type snappyCompressor struct{}
+
+func (snappyCompressor) ID() byte     { return 1 }
+func (snappyCompressor) Name() string { return "snappy" }
+
+func (snappyCompressor) Compress(src []byte) ([]byte, error) {
+	return snappy.Encode(nil, src), nil
+}
+
+func (snappyCompressor) Decompress(src []byte) ([]byte, error) {
+	return snappy.Decode(nil, src)
+}
+
+func init() {
+	if err := RegisterSubstateCompressor(snappyCompressor{}); err != nil {
+		panic(err)
+	}
+}
+
+func isCompressedSubstateValue(value []byte) bool {
+	return len(value) > 0 && value[0] >= compressedSubstateFlag && value[0] < 0xc0
+}
+
+// UnwrapSubstateValue decompresses a substate value. It returns the
+// uncompressed value and the compressor that was used, or nil if the value
+// is not compressed.
+func UnwrapSubstateValue(value []byte) ([]byte, SubstateCompressor, error) {
+	if !isCompressedSubstateValue(value) {
+		return value, nil, nil
+	}
+	c, err := substateCompressorByID(value[0] - compressedSubstateFlag)
+	if err != nil {
+		return nil, nil, err
+	}
+	inner, err := c.Decompress(value[1:])
+	if err != nil {
+		return nil, nil, fmt.Errorf("error decompressing %s substate value: %v", c.Name(), err)
+	}
+	if isCompressedSubstateValue(inner) {
+		return nil, nil, fmt.Errorf("nested compression of substate value")
+	}
+	return inner, c, nil
+}
+
+// WrapSubstateValue compresses an uncompressed substate value with c. The
+// value is returned as it is if c is nil or compression does not save space.
+func WrapSubstateValue(value []byte, c SubstateCompressor) ([]byte, error) {
+	if c == nil {
+		return value, nil
+	}
+	compressed, err := c.Compress(value)
+	if err != nil {
+		return nil, fmt.Errorf("error compressing substate value with %s: %v", c.Name(), err)
+	}
+	if len(compressed)+1 >= len(value) {
+		return value, nil
+	}
+	return append([]byte{compressedSubstateFlag + c.ID()}, compressed...), nil
+}
+
+// SetCompressor sets the compressor of substate values written by
+// PutSubstate, nil disables compression. Values are read transparently with
+// any registered compressor.
+func (db *SubstateDB) SetCompressor(c SubstateCompressor) {
+	db.compressor = c
+}
+
+func (db *SubstateDB) Compressor() SubstateCompressor {
+	return db.compressor
+}
+
+// Recompress rewrites all substate values with the given compressor, nil
+// stores values uncompressed, and sets the compressor of the substate DB.
+// Values are not decoded, so their formats and layouts are preserved.
+func (db *SubstateDB) Recompress(c SubstateCompressor) (rewritten int64, err error) {
+	db.compressor = c
+
+	batch := db.backend.NewBatch()
+	iter := db.backend.NewIterator([]byte(stage1SubstatePrefix), nil)
+	defer iter.Release()
+
+	for iter.Next() {
+		key := iter.Key()
+		value := iter.Value()
+
+		block, tx, err := DecodeStage1SubstateKey(key)
+		if err != nil {
+			return rewritten, fmt.Errorf("record-replay: invalid substate key %#x: %v", key, err)
+		}
+		inner, prev, err := UnwrapSubstateValue(value)
+		if err != nil {
+			return rewritten, &SubstateError{Block: block, Tx: tx, Err: err}
+		}
+		if prev == c {
+			continue
+		}
+		newValue, err := WrapSubstateValue(inner, c)
+		if err != nil {
+			return rewritten, &SubstateError{Block: block, Tx: tx, Err: err}
+		}
+		if bytes.Equal(newValue, value) {
+			continue
+		}
+		if err := batch.Put(common.CopyBytes(key), newValue); err != nil {
+			return rewritten, err
+		}
+		rewritten++
+		if rewritten%1_000_000 == 0 {
+			fmt.Printf("record-replay: recompress: %dM substates, at block %v\n", rewritten/1_000_000, block)
+		}
+		if batch.ValueSize() >= ethdb.IdealBatchSize {
+			if err := batch.Write(); err != nil {
+				return rewritten, err
+			}
+			batch.Reset()
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return rewritten, err
+	}
+
+	return rewritten, batch.Write()
+}
@@ -4,18 +4,50 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"sync"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/ethdb"
-	"github.com/ethereum/go-ethereum/rlp"
 )
 
 const (
 	stage1SubstatePrefix = "1s" // stage1SubstatePrefix + block (64-bit) + tx (64-bit) -> substateRLP
 	stage1CodePrefix     = "1c" // stage1CodePrefix + codeHash (256-bit) -> code
+	stage1AccountPrefix  = "1a" // stage1AccountPrefix + accountHash (256-bit) -> SubstateAccountRLP
+
+	stage1BlockSummaryPrefix = "1b" // stage1BlockSummaryPrefix + block (64-bit) -> BlockSummary
+	stage1MetadataPrefix     = "1m" // stage1MetadataPrefix + name -> metadata record
+
+	stage1TxHashPrefix       = "1t" // stage1TxHashPrefix + block (64-bit) + tx (64-bit) -> txHash
+	stage1TxIndexPrefix      = "1h" // stage1TxIndexPrefix + txHash (256-bit) -> block (64-bit) + tx (64-bit)
+	stage1AddressIndexPrefix = "1i" // stage1AddressIndexPrefix + address (160-bit) + block (64-bit) + tx (64-bit) -> empty
 )
 
+// KeySpaceName returns a description of the data stored under a key prefix.
+func KeySpaceName(prefix string) string {
+	switch prefix {
+	case stage1SubstatePrefix:
+		return "substate"
+	case stage1CodePrefix:
+		return "code"
+	case stage1AccountPrefix:
+		return "account"
+	case stage1BlockSummaryPrefix:
+		return "block summary"
+	case stage1MetadataPrefix:
+		return "metadata"
+	case stage1TxHashPrefix:
+		return "tx hash"
+	case stage1TxIndexPrefix:
+		return "tx hash index"
+	case stage1AddressIndexPrefix:
+		return "address index"
+	default:
+		return "unknown"
+	}
+}
+
 func Stage1SubstateKey(block uint64, tx int) []byte {
 	prefix := []byte(stage1SubstatePrefix)
 
@@ -70,6 +102,25 @@ func DecodeStage1CodeKey(key []byte) (codeHash common.Hash, err error) {
 	return
 }
 
+func Stage1AccountKey(accountHash common.Hash) []byte {
+	prefix := []byte(stage1AccountPrefix)
+	return append(prefix, accountHash.Bytes()...)
+}
+
+func DecodeStage1AccountKey(key []byte) (accountHash common.Hash, err error) {
+	prefix := stage1AccountPrefix
+	if len(key) != len(prefix)+32 {
+		err = fmt.Errorf("invalid length of stage1 account key: %v", len(key))
+		return
+	}
+	if p := string(key[:len(prefix)]); p != prefix {
+		err = fmt.Errorf("invalid prefix of stage1 account key: %#x", p)
+		return
+	}
+	accountHash = common.BytesToHash(key[len(prefix):])
+	return
+}
+
 type BackendDatabase interface {
 	ethdb.KeyValueReader
 	ethdb.KeyValueWriter
@@ -81,18 +132,39 @@ type BackendDatabase interface {
 }
 
 type SubstateDB struct {
-	backend BackendDatabase
+	backend    BackendDatabase
+	layout     SubstateLayout     // layout of substate values written by PutSubstate
+	compressor SubstateCompressor // compressor of substate values written by PutSubstate, nil if uncompressed
+	codeCache  *codeCache         // cached code blobs, nil if disabled
+
+	blocksLock  sync.Mutex
+	blocks      []BlockInterval // recorded blocks, nil if not loaded yet
+	blocksDirty bool            // blocks has changes not written by FlushRecordedBlocks
 }
 
 func NewSubstateDB(backend BackendDatabase) *SubstateDB {
 	return &SubstateDB{backend: backend}
 }
 
+// readerFor returns the backend that holds code blobs and account records
+// written together with substates of block.
+func (db *SubstateDB) readerFor(block uint64) ethdb.KeyValueReader {
+	if sharded, ok := db.backend.(*shardedBackend); ok {
+		return sharded.reader(block)
+	}
+	return db.backend
+}
+
 func (db *SubstateDB) Compact(start []byte, limit []byte) error {
 	return db.backend.Compact(start, limit)
 }
 
+// Close flushes recorded blocks and closes the backend database.
 func (db *SubstateDB) Close() error {
+	if err := db.FlushRecordedBlocks(); err != nil {
+		db.backend.Close()
+		return err
+	}
 	return db.backend.Close()
 }
 
@@ -102,181 +174,229 @@ func CodeHash(code []byte) common.Hash {
 
 var EmptyCodeHash = CodeHash(nil)
 
-func (db *SubstateDB) HasCode(codeHash common.Hash) bool {
+// SubstateError is returned when the substate of a transaction cannot be
+// read from or written to the substate DB.
+type SubstateError struct {
+	Block uint64
+	Tx    int
+	Err   error
+}
+
+func (e *SubstateError) Error() string {
+	return fmt.Sprintf("substate %v_%v: %v", e.Block, e.Tx, e.Err)
+}
+
+func (e *SubstateError) Unwrap() error {
+	return e.Err
+}
+
+// HasCode reports whether a code blob is stored. Code blobs are addressed by
+// hash, so on a sharded substate DB it checks all shards rather than the
+// shard of a block.
+func (db *SubstateDB) HasCode(codeHash common.Hash) (bool, error) {
 	if codeHash == EmptyCodeHash {
-		return false
+		return false, nil
+	}
+	if db.codeCache != nil && db.codeCache.has(codeHash) {
+		return true, nil
 	}
 	key := Stage1CodeKey(codeHash)
 	has, err := db.backend.Has(key)
 	if err != nil {
-		panic(fmt.Errorf("record-replay: error checking bytecode for codeHash %s: %v", codeHash.Hex(), err))
+		return false, fmt.Errorf("record-replay: error checking bytecode for codeHash %s: %v", codeHash.Hex(), err)
 	}
-	return has
+	return has, nil
 }
 
-func (db *SubstateDB) GetCode(codeHash common.Hash) []byte {
+// GetCode returns a code blob. Like HasCode, it reads the code blob from the
+// first shard that has it on a sharded substate DB.
+func (db *SubstateDB) GetCode(codeHash common.Hash) ([]byte, error) {
 	if codeHash == EmptyCodeHash {
-		return nil
+		return nil, nil
+	}
+	if code, ok := db.getCachedCode(codeHash); ok {
+		return code, nil
 	}
 	key := Stage1CodeKey(codeHash)
 	code, err := db.backend.Get(key)
 	if err != nil {
-		panic(fmt.Errorf("record-replay: error getting code %s: %v", codeHash.Hex(), err))
+		return nil, fmt.Errorf("record-replay: error getting code %s: %v", codeHash.Hex(), err)
 	}
-	return code
+	db.cacheCode(codeHash, code)
+	return code, nil
 }
 
-func (db *SubstateDB) PutCode(code []byte) {
+func (db *SubstateDB) PutCode(code []byte) error {
+	return putCode(db.backend, code)
+}
+
+func putCode(w ethdb.KeyValueWriter, code []byte) error {
 	if len(code) == 0 {
-		return
+		return nil
 	}
 	codeHash := crypto.Keccak256Hash(code)
 	key := Stage1CodeKey(codeHash)
-	err := db.backend.Put(key, code)
+	err := w.Put(key, code)
 	if err != nil {
-		panic(fmt.Errorf("record-replay: error putting code %s: %v", codeHash.Hex(), err))
+		return fmt.Errorf("record-replay: error putting code %s: %v", codeHash.Hex(), err)
 	}
+	return nil
 }
 
-func (db *SubstateDB) HasSubstate(block uint64, tx int) bool {
+func (db *SubstateDB) HasSubstate(block uint64, tx int) (bool, error) {
 	key := Stage1SubstateKey(block, tx)
-	has, _ := db.backend.Has(key)
-	return has
+	has, err := db.backend.Has(key)
+	if err != nil {
+		return false, &SubstateError{Block: block, Tx: tx, Err: err}
+	}
+	return has, nil
 }
 
-func (db *SubstateDB) GetSubstate(block uint64, tx int) *Substate {
-	var err error
+// decodeSubstate decodes a substate value and resolves its code hashes.
+func (db *SubstateDB) decodeSubstate(value []byte) (*Substate, error) {
+	substateRLP, _, err := db.DecodeSubstateRLP(value)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding substateRLP: %v", err)
+	}
 
-	key := Stage1SubstateKey(block, tx)
-	value, err := db.backend.Get(key)
+	substate := Substate{}
+	err = substate.SetRLP(substateRLP, db)
 	if err != nil {
-		panic(fmt.Errorf("record-replay: error getting substate %v_%v from substate DB: %v,", block, tx, err))
+		return nil, err
 	}
 
-	// try decoding as substates from latest hard forks
-	substateRLP := SubstateRLP{}
-	err = rlp.DecodeBytes(value, &substateRLP)
+	return &substate, nil
+}
 
+func (db *SubstateDB) GetSubstate(block uint64, tx int) (*Substate, error) {
+	key := Stage1SubstateKey(block, tx)
+	value, err := db.backend.Get(key)
 	if err != nil {
-		// try decoding as legacy substates between Berlin and London hard forks
-		berlinRLP := berlinSubstateRLP{}
-		err = rlp.DecodeBytes(value, &berlinRLP)
-		if err == nil {
-			substateRLP.setBerlinRLP(&berlinRLP)
-		}
+		return nil, &SubstateError{Block: block, Tx: tx, Err: fmt.Errorf("error getting substate from substate DB: %v", err)}
 	}
 
+	substate, err := db.decodeSubstate(value)
 	if err != nil {
-		// try decoding as legacy substates before Berlin hard fork
-		legacyRLP := legacySubstateRLP{}
-		err = rlp.DecodeBytes(value, &legacyRLP)
-		if err != nil {
-			panic(fmt.Errorf("error decoding substateRLP %v_%v: %v", block, tx, err))
-		}
-		substateRLP.setLegacyRLP(&legacyRLP)
+		return nil, &SubstateError{Block: block, Tx: tx, Err: err}
 	}
 
-	substate := Substate{}
-	substate.SetRLP(&substateRLP, db)
-
-	return &substate
+	return substate, nil
 }
 
-func (db *SubstateDB) GetBlockSubstates(block uint64) map[int]*Substate {
-	var err error
-
+// GetBlockSubstates returns all substates of the given block. If a substate
+// cannot be decoded, the returned error is a *SubstateError of that transaction.
+func (db *SubstateDB) GetBlockSubstates(block uint64) (map[int]*Substate, error) {
 	txSubstate := make(map[int]*Substate)
 
 	prefix := Stage1SubstateBlockPrefix(block)
 
 	iter := db.backend.NewIterator(prefix, nil)
+	defer iter.Release()
 	for iter.Next() {
 		key := iter.Key()
 		value := iter.Value()
 
 		b, tx, err := DecodeStage1SubstateKey(key)
 		if err != nil {
-			panic(fmt.Errorf("record-replay: invalid substate key found for block %v: %v", block, err))
+			return nil, fmt.Errorf("record-replay: invalid substate key %#x found for block %v: %v", key, block, err)
 		}
 
 		if block != b {
-			panic(fmt.Errorf("record-replay: GetBlockSubstates(%v) iterated substates from block %v", block, b))
+			return nil, fmt.Errorf("record-replay: GetBlockSubstates(%v) iterated substates from block %v", block, b)
 		}
 
-		// try decoding as substates from latest hard forks
-		substateRLP := SubstateRLP{}
-		err = rlp.DecodeBytes(value, &substateRLP)
-
+		substate, err := db.decodeSubstate(value)
 		if err != nil {
-			// try decoding as legacy substates between Berlin and London hard forks
-			berlinRLP := berlinSubstateRLP{}
-			err = rlp.DecodeBytes(value, &berlinRLP)
-			if err == nil {
-				substateRLP.setBerlinRLP(&berlinRLP)
-			}
+			return nil, &SubstateError{Block: block, Tx: tx, Err: err}
 		}
 
-		if err != nil {
-			// try decoding as legacy substates before Berlin hard fork
-			legacyRLP := legacySubstateRLP{}
-			err = rlp.DecodeBytes(value, &legacyRLP)
-			if err != nil {
-				panic(fmt.Errorf("error decoding substateRLP %v_%v: %v", block, tx, err))
-			}
-			substateRLP.setLegacyRLP(&legacyRLP)
-		}
-
-		substate := Substate{}
-		substate.SetRLP(&substateRLP, db)
-
-		txSubstate[tx] = &substate
+		txSubstate[tx] = substate
 	}
-	iter.Release()
-	err = iter.Error()
-	if err != nil {
-		panic(err)
+	if err := iter.Error(); err != nil {
+		return nil, fmt.Errorf("record-replay: error iterating substates of block %v: %v", block, err)
 	}
 
-	return txSubstate
+	return txSubstate, nil
 }
 
-func (db *SubstateDB) PutSubstate(block uint64, tx int, substate *Substate) {
+// PutSubstate writes the substate of a transaction. The tx hash and index
+// entries of a substate it overwrites are deleted.
+func (db *SubstateDB) PutSubstate(block uint64, tx int, substate *Substate) error {
 	var err error
 
+	// write the substate value with its code, account records and address index
+	batch := db.backend.NewBatch()
+	key := Stage1SubstateKey(block, tx)
+
+	// drop the tx hash and index entries of an overwritten substate
+	has, err := db.backend.Has(key)
+	if err != nil {
+		return &SubstateError{Block: block, Tx: tx, Err: err}
+	}
+	if has {
+		old, err := db.backend.Get(key)
+		if err != nil {
+			return &SubstateError{Block: block, Tx: tx, Err: err}
+		}
+		if err := db.deleteSubstateIndex(batch, block, tx, old); err != nil {
+			return &SubstateError{Block: block, Tx: tx, Err: err}
+		}
+	}
+
 	// put deployed/creation code
 	for _, account := range substate.InputAlloc {
-		db.PutCode(account.Code)
+		if err = putCode(batch, account.Code); err != nil {
+			return &SubstateError{Block: block, Tx: tx, Err: err}
+		}
 	}
 	for _, account := range substate.OutputAlloc {
-		db.PutCode(account.Code)
+		if err = putCode(batch, account.Code); err != nil {
+			return &SubstateError{Block: block, Tx: tx, Err: err}
+		}
 	}
 	if msg := substate.Message; msg.To == nil {
-		db.PutCode(msg.Data)
-	}
-
-	key := Stage1SubstateKey(block, tx)
-	defer func() {
-		if err != nil {
-			panic(fmt.Errorf("record-replay: error putting substate %v_%v into substate DB: %v", block, tx, err))
+		if err = putCode(batch, msg.Data); err != nil {
+			return &SubstateError{Block: block, Tx: tx, Err: err}
 		}
-	}()
+	}
 
 	substateRLP := NewSubstateRLP(substate)
-	value, err := rlp.EncodeToBytes(substateRLP)
+	value, err := db.encodeSubstateRLP(block, substateRLP, batch)
 	if err != nil {
-		panic(err)
+		return &SubstateError{Block: block, Tx: tx, Err: fmt.Errorf("error encoding substateRLP: %v", err)}
+	}
+	if err = putAddressIndex(batch, block, tx, substateRLP); err != nil {
+		return &SubstateError{Block: block, Tx: tx, Err: err}
 	}
 
-	err = db.backend.Put(key, value)
+	if err = batch.Put(key, value); err != nil {
+		return &SubstateError{Block: block, Tx: tx, Err: err}
+	}
+	err = batch.Write()
 	if err != nil {
-		panic(err)
+		return &SubstateError{Block: block, Tx: tx, Err: fmt.Errorf("error putting substate into substate DB: %v", err)}
 	}
+
+	return nil
 }
 
-func (db *SubstateDB) DeleteSubstate(block uint64, tx int) {
+// DeleteSubstate deletes the substate of a transaction with its tx hash and
+// index entries.
+func (db *SubstateDB) DeleteSubstate(block uint64, tx int) error {
 	key := Stage1SubstateKey(block, tx)
-	err := db.backend.Delete(key)
+	value, err := db.backend.Get(key)
+	if err != nil {
+		return &SubstateError{Block: block, Tx: tx, Err: err}
+	}
+
+	batch := db.backend.NewBatch()
+	if err := db.deleteSubstateIndex(batch, block, tx, value); err != nil {
+		return &SubstateError{Block: block, Tx: tx, Err: err}
+	}
+	batch.Delete(key)
+	err = batch.Write()
 	if err != nil {
-		panic(err)
+		return &SubstateError{Block: block, Tx: tx, Err: err}
 	}
+	return nil
 }
@@ -0,0 +1,325 @@
+package research
+
+import (
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// SubstateLayout selects how PutSubstate stores account states.
+type SubstateLayout int
+
+const (
+	// InlineAccountLayout embeds full account states in substate values.
+	InlineAccountLayout SubstateLayout = iota
+	// DedupAccountLayout stores each distinct account state once under
+	// stage1AccountPrefix, content-addressed by the Keccak256 hash of its
+	// SubstateAccountRLP, and references it by hash from substate values.
+	DedupAccountLayout
+)
+
+func (l SubstateLayout) String() string {
+	switch l {
+	case InlineAccountLayout:
+		return "inline"
+	case DedupAccountLayout:
+		return "dedup"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(l))
+	}
+}
+
+// ParseSubstateLayout parses the name of a layout as printed by String.
+func ParseSubstateLayout(name string) (SubstateLayout, error) {
+	switch name {
+	case "", "inline":
+		return InlineAccountLayout, nil
+	case "dedup":
+		return DedupAccountLayout, nil
+	default:
+		return InlineAccountLayout, fmt.Errorf("unknown substate layout %q", name)
+	}
+}
+
+// SetLayout sets the layout of substate values written by PutSubstate.
+// Values are read transparently in any layout.
+func (db *SubstateDB) SetLayout(layout SubstateLayout) {
+	db.layout = layout
+}
+
+func (db *SubstateDB) Layout() SubstateLayout {
+	return db.layout
+}
+
+// SubstateAllocRefRLP is SubstateAllocRLP with accounts referenced by hash.
+type SubstateAllocRefRLP struct {
+	Addresses     []common.Address
+	AccountHashes []common.Hash
+}
+
+// SubstateRefRLP is SubstateRLP with accounts referenced by hash.
+type SubstateRefRLP struct {
+	InputAlloc  SubstateAllocRefRLP
+	OutputAlloc SubstateAllocRefRLP
+	Env         *SubstateEnvRLP
+	Message     *SubstateMessageRLP
+	Result      *SubstateResultRLP
+}
+
+// encodeSubstateRLP encodes substateRLP of a transaction in the given block
+// in the layout and with the compressor of the substate DB. Account records
+// of DedupAccountLayout are written to w.
+func (db *SubstateDB) encodeSubstateRLP(block uint64, substateRLP *SubstateRLP, w ethdb.KeyValueWriter) ([]byte, error) {
+	value, err := db.encodeSubstateLayout(block, substateRLP, w)
+	if err != nil {
+		return nil, err
+	}
+	return WrapSubstateValue(value, db.compressor)
+}
+
+func (db *SubstateDB) encodeSubstateLayout(block uint64, substateRLP *SubstateRLP, w ethdb.KeyValueWriter) ([]byte, error) {
+	if db.layout != DedupAccountLayout {
+		return EncodeSubstateRLP(substateRLP)
+	}
+
+	var err error
+	refRLP := SubstateRefRLP{
+		Env:     substateRLP.Env,
+		Message: substateRLP.Message,
+		Result:  substateRLP.Result,
+	}
+	refRLP.InputAlloc, err = db.putAllocRefs(block, substateRLP.InputAlloc, w)
+	if err != nil {
+		return nil, err
+	}
+	refRLP.OutputAlloc, err = db.putAllocRefs(block, substateRLP.OutputAlloc, w)
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := rlp.EncodeToBytes(&refRLP)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{byte(SubstateFormatLondonDedup)}, value...), nil
+}
+
+func (db *SubstateDB) putAllocRefs(block uint64, allocRLP SubstateAllocRLP, w ethdb.KeyValueWriter) (SubstateAllocRefRLP, error) {
+	refRLP := SubstateAllocRefRLP{
+		Addresses:     allocRLP.Addresses,
+		AccountHashes: make([]common.Hash, len(allocRLP.Accounts)),
+	}
+	for i, saRLP := range allocRLP.Accounts {
+		value, err := rlp.EncodeToBytes(saRLP)
+		if err != nil {
+			return refRLP, err
+		}
+		accountHash := crypto.Keccak256Hash(value)
+		refRLP.AccountHashes[i] = accountHash
+
+		key := Stage1AccountKey(accountHash)
+		has, err := db.readerFor(block).Has(key)
+		if err != nil {
+			return refRLP, fmt.Errorf("record-replay: error checking account %s: %v", accountHash.Hex(), err)
+		}
+		if has {
+			continue
+		}
+		if err := w.Put(key, value); err != nil {
+			return refRLP, fmt.Errorf("record-replay: error putting account %s: %v", accountHash.Hex(), err)
+		}
+	}
+	return refRLP, nil
+}
+
+// GetAccountRLP returns the account record stored under accountHash. Account
+// records are addressed by hash, so on a sharded substate DB it reads the
+// record from the first shard that has it.
+func (db *SubstateDB) GetAccountRLP(accountHash common.Hash) (*SubstateAccountRLP, error) {
+	value, err := db.backend.Get(Stage1AccountKey(accountHash))
+	if err != nil {
+		return nil, fmt.Errorf("record-replay: error getting account %s: %v", accountHash.Hex(), err)
+	}
+	saRLP := SubstateAccountRLP{}
+	if err := rlp.DecodeBytes(value, &saRLP); err != nil {
+		return nil, fmt.Errorf("record-replay: error decoding account %s: %v", accountHash.Hex(), err)
+	}
+	return &saRLP, nil
+}
+
+func (db *SubstateDB) getAllocRefs(refRLP SubstateAllocRefRLP) (SubstateAllocRLP, error) {
+	if len(refRLP.Addresses) != len(refRLP.AccountHashes) {
+		return SubstateAllocRLP{}, fmt.Errorf("%v addresses and %v account hashes", len(refRLP.Addresses), len(refRLP.AccountHashes))
+	}
+	allocRLP := SubstateAllocRLP{
+		Addresses: refRLP.Addresses,
+		Accounts:  make([]*SubstateAccountRLP, len(refRLP.AccountHashes)),
+	}
+	for i, accountHash := range refRLP.AccountHashes {
+		saRLP, err := db.GetAccountRLP(accountHash)
+		if err != nil {
+			return allocRLP, err
+		}
+		allocRLP.Accounts[i] = saRLP
+	}
+	return allocRLP, nil
+}
+
+func (db *SubstateDB) setRefRLP(substateRLP *SubstateRLP, refRLP *SubstateRefRLP) error {
+	var err error
+
+	substateRLP.InputAlloc, err = db.getAllocRefs(refRLP.InputAlloc)
+	if err != nil {
+		return fmt.Errorf("InputAlloc: %v", err)
+	}
+	substateRLP.OutputAlloc, err = db.getAllocRefs(refRLP.OutputAlloc)
+	if err != nil {
+		return fmt.Errorf("OutputAlloc: %v", err)
+	}
+	substateRLP.Env = refRLP.Env
+	substateRLP.Message = refRLP.Message
+	substateRLP.Result = refRLP.Result
+
+	return nil
+}
+
+// DecodeSubstateRLP decodes a substate value in any format and layout,
+// resolving account records from the substate DB.
+func (db *SubstateDB) DecodeSubstateRLP(value []byte) (*SubstateRLP, SubstateFormat, error) {
+	return decodeSubstateValue(value, db)
+}
+
+// ConvertLayout rewrites all substate values in the given layout and sets
+// the layout of the substate DB. Values keep the compressor they were
+// written with. After converting to InlineAccountLayout, all account records
+// are deleted because no value references them.
+func (db *SubstateDB) ConvertLayout(layout SubstateLayout) (converted int64, err error) {
+	db.layout = layout
+
+	converted, err = db.convertSubstates(layout)
+	if err != nil {
+		return converted, err
+	}
+	if layout == InlineAccountLayout {
+		err = db.deleteKeySpace([]byte(stage1AccountPrefix))
+	}
+	return converted, err
+}
+
+func (db *SubstateDB) convertSubstates(layout SubstateLayout) (converted int64, err error) {
+	target := SubstateFormatLatest
+	if layout == DedupAccountLayout {
+		target = SubstateFormatLondonDedup
+	}
+
+	batch := db.backend.NewBatch()
+	iter := db.backend.NewIterator([]byte(stage1SubstatePrefix), nil)
+	defer iter.Release()
+
+	for iter.Next() {
+		key := iter.Key()
+		value := iter.Value()
+
+		block, tx, err := DecodeStage1SubstateKey(key)
+		if err != nil {
+			return converted, fmt.Errorf("record-replay: invalid substate key %#x: %v", key, err)
+		}
+		inner, compressor, err := UnwrapSubstateValue(value)
+		if err != nil {
+			return converted, &SubstateError{Block: block, Tx: tx, Err: err}
+		}
+		if IsVersionedSubstateValue(inner) && SubstateFormat(inner[0]) == target {
+			continue
+		}
+		substateRLP, _, err := db.DecodeSubstateRLP(inner)
+		if err != nil {
+			return converted, &SubstateError{Block: block, Tx: tx, Err: err}
+		}
+
+		// keep the compression of the value
+		newValue, err := db.encodeSubstateLayout(block, substateRLP, batch)
+		if err == nil {
+			newValue, err = WrapSubstateValue(newValue, compressor)
+		}
+		if err != nil {
+			return converted, &SubstateError{Block: block, Tx: tx, Err: err}
+		}
+		if err := batch.Put(common.CopyBytes(key), newValue); err != nil {
+			return converted, err
+		}
+		converted++
+		if converted%1_000_000 == 0 {
+			fmt.Printf("record-replay: convert: %dM substates, at block %v\n", converted/1_000_000, block)
+		}
+		if batch.ValueSize() >= ethdb.IdealBatchSize {
+			if err := batch.Write(); err != nil {
+				return converted, err
+			}
+			batch.Reset()
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return converted, err
+	}
+
+	return converted, batch.Write()
+}
+
+// deleteKeySpace deletes all entries under the given key prefix.
+func (db *SubstateDB) deleteKeySpace(prefix []byte) error {
+	batch := db.backend.NewBatch()
+	iter := db.backend.NewIterator(prefix, nil)
+	defer iter.Release()
+
+	for iter.Next() {
+		if err := batch.Delete(common.CopyBytes(iter.Key())); err != nil {
+			return err
+		}
+		if batch.ValueSize() >= ethdb.IdealBatchSize {
+			if err := batch.Write(); err != nil {
+				return err
+			}
+			batch.Reset()
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+
+	return batch.Write()
+}
+
+// KeySpaceSize is the number of entries in a key space of the substate DB
+// and their total size in bytes, including keys.
+type KeySpaceSize struct {
+	Prefix string
+	Count  int64
+	Bytes  int64
+}
+
+// KeySpaceSizes scans the entire substate DB and returns the size of each
+// key space in key order. Key spaces are identified by the first 2 bytes of
+// their keys.
+func (db *SubstateDB) KeySpaceSizes() ([]*KeySpaceSize, error) {
+	var sizes []*KeySpaceSize
+
+	iter := db.backend.NewIterator(nil, nil)
+	defer iter.Release()
+	for iter.Next() {
+		key := iter.Key()
+		prefix := string(key)
+		if len(prefix) > 2 {
+			prefix = prefix[:2]
+		}
+		if len(sizes) == 0 || sizes[len(sizes)-1].Prefix != prefix {
+			sizes = append(sizes, &KeySpaceSize{Prefix: prefix})
+		}
+		size := sizes[len(sizes)-1]
+		size.Count++
+		size.Bytes += int64(len(key) + len(iter.Value()))
+	}
+	return sizes, iter.Error()
+}
@@ -0,0 +1,50 @@
+package research
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/core/rawdb"
+)
+
+func TestConvertLayoutCompressed(t *testing.T) {
+	backend := rawdb.NewMemoryDatabase()
+	snappy, err := SubstateCompressorByName("snappy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	written := NewSubstateDB(backend)
+	written.SetCompressor(snappy)
+	for block := uint64(1); block <= 3; block++ {
+		if err := written.PutSubstate(block, 0, newTestSubstate(block, true)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the converting substate DB has no compressor, like db convert
+	db := NewSubstateDB(backend)
+	for _, layout := range []SubstateLayout{DedupAccountLayout, InlineAccountLayout} {
+		converted, err := db.ConvertLayout(layout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if converted != 3 {
+			t.Fatalf("converted %v substates to %v layout, want 3", converted, layout)
+		}
+		for block := uint64(1); block <= 3; block++ {
+			value, err := backend.Get(Stage1SubstateKey(block, 0))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, c, err := UnwrapSubstateValue(value); err != nil || c == nil || c.Name() != snappy.Name() {
+				t.Fatalf("%v layout: substate of block %v has compressor %v: %v", layout, block, c, err)
+			}
+			substate, err := db.GetSubstate(block, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !substate.Equal(newTestSubstate(block, true)) {
+				t.Fatalf("%v layout: substate of block %v differs", layout, block)
+			}
+		}
+	}
+}
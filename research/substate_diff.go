@@ -0,0 +1,490 @@
+package research
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// Kinds of differences reported by DiffSubstateDBs
+const (
+	MissingSubstateDiff   = "missing"   // substate only in the first substate DB
+	ExtraSubstateDiff     = "extra"     // substate only in the second substate DB
+	DifferentSubstateDiff = "different" // substates of the same transaction differ
+)
+
+// SubstateFieldDiff is a field that differs between two substates. A and B
+// are the values of the field in the first and second substate, empty if the
+// field is missing.
+type SubstateFieldDiff struct {
+	Component string `json:"component"`
+	Field     string `json:"field"`
+	A         string `json:"a"`
+	B         string `json:"b"`
+}
+
+func (d *SubstateFieldDiff) String() string {
+	a, b := d.A, d.B
+	if a == "" {
+		a = "-"
+	}
+	if b == "" {
+		b = "-"
+	}
+	return fmt.Sprintf("%s %s: %s -> %s", d.Component, d.Field, a, b)
+}
+
+// SubstateDiff is a transaction whose substates differ between two substate
+// DBs. Components and Fields are only set for DifferentSubstateDiff.
+type SubstateDiff struct {
+	Kind       string              `json:"kind"`
+	Block      uint64              `json:"block"`
+	Tx         int                 `json:"tx"`
+	Components []string            `json:"components,omitempty"`
+	Fields     []SubstateFieldDiff `json:"fields,omitempty"`
+}
+
+func (d *SubstateDiff) String() string {
+	if d.Kind == DifferentSubstateDiff {
+		return fmt.Sprintf("%v_%v: %s in %s", d.Block, d.Tx, d.Kind, strings.Join(d.Components, ", "))
+	}
+	return fmt.Sprintf("%v_%v: %s", d.Block, d.Tx, d.Kind)
+}
+
+// DiffStats counts what DiffSubstateDBs compared.
+type DiffStats struct {
+	NumCommon    int64 // substates in both substate DBs
+	NumMissing   int64
+	NumExtra     int64
+	NumDifferent int64
+}
+
+// NumDiffs returns the number of reported differences.
+func (stats *DiffStats) NumDiffs() int64 {
+	return stats.NumMissing + stats.NumExtra + stats.NumDifferent
+}
+
+// DiffSubstateDBs compares substates from block first to block last
+// (inclusive) of substate DBs a and b, and calls report for every
+// transaction with a substate missing in b, an extra substate in b, or
+// different substates. Substates are compared after decoding, so substate
+// DBs with different layouts and compression can be compared.
+func DiffSubstateDBs(a, b *SubstateDB, first, last uint64, workers int, report func(*SubstateDiff)) (*DiffStats, error) {
+	stats := &DiffStats{}
+
+	iterA := a.NewSubstateIterator(first, last, workers)
+	defer iterA.Release()
+	iterB := b.NewSubstateIterator(first, last, workers)
+	defer iterB.Release()
+
+	okA, okB := iterA.Next(), iterB.Next()
+	for okA || okB {
+		var ea, eb *SubstateEntry
+		if okA {
+			ea = iterA.Value()
+		}
+		if okB {
+			eb = iterB.Value()
+		}
+
+		switch {
+		case eb == nil || (ea != nil && compareSubstateEntries(ea, eb) < 0):
+			stats.NumMissing++
+			report(&SubstateDiff{Kind: MissingSubstateDiff, Block: ea.Block, Tx: ea.Tx})
+			okA = iterA.Next()
+
+		case ea == nil || compareSubstateEntries(ea, eb) > 0:
+			stats.NumExtra++
+			report(&SubstateDiff{Kind: ExtraSubstateDiff, Block: eb.Block, Tx: eb.Tx})
+			okB = iterB.Next()
+
+		default:
+			diffCommonSubstates(ea, eb, stats, report)
+			okA, okB = iterA.Next(), iterB.Next()
+		}
+	}
+	if err := iterA.Error(); err != nil {
+		return stats, fmt.Errorf("record-replay: error iterating first substate DB: %v", err)
+	}
+	if err := iterB.Error(); err != nil {
+		return stats, fmt.Errorf("record-replay: error iterating second substate DB: %v", err)
+	}
+
+	return stats, nil
+}
+
+// diffCommonSubstates reports the substates of the same transaction in
+// both substate DBs if they differ.
+func diffCommonSubstates(ea, eb *SubstateEntry, stats *DiffStats, report func(*SubstateDiff)) {
+	stats.NumCommon++
+	components, fields := DiffSubstates(ea.Substate, eb.Substate)
+	if len(components) > 0 {
+		stats.NumDifferent++
+		report(&SubstateDiff{
+			Kind:       DifferentSubstateDiff,
+			Block:      ea.Block,
+			Tx:         ea.Tx,
+			Components: components,
+			Fields:     fields,
+		})
+	}
+}
+
+// DiffSelectedSubstates compares substates from block first to block last
+// (inclusive) selected by sel like DiffSubstateDBs. Transaction hashes and
+// addresses are looked up in the indices of both substate DBs, so that
+// transactions indexed in only one of them are reported as missing or extra.
+// Transaction hashes indexed in neither substate DB are an error.
+func DiffSelectedSubstates(a, b *SubstateDB, sel *SubstateSelector, first, last uint64, report func(*SubstateDiff)) (*DiffStats, error) {
+	stats := &DiffStats{}
+
+	selected := make(map[SubstateKey]struct{})
+	for _, txHash := range sel.TxHashes {
+		var found bool
+		for _, db := range []*SubstateDB{a, b} {
+			block, tx, ok, err := db.FindTx(txHash)
+			if err != nil {
+				return stats, err
+			}
+			if ok && block >= first && block <= last {
+				selected[SubstateKey{Block: block, Tx: tx}] = struct{}{}
+			}
+			found = found || ok
+		}
+		if !found {
+			return stats, fmt.Errorf("record-replay: tx %s not found in tx hash index", txHash.Hex())
+		}
+	}
+	for _, addr := range sel.Addresses {
+		for _, db := range []*SubstateDB{a, b} {
+			keys, err := db.GetAddressSubstates(addr, first, last)
+			if err != nil {
+				return stats, err
+			}
+			for _, key := range keys {
+				selected[key] = struct{}{}
+			}
+		}
+	}
+
+	getEntry := func(db *SubstateDB, key SubstateKey) (*SubstateEntry, error) {
+		has, err := db.HasSubstate(key.Block, key.Tx)
+		if err != nil || !has {
+			return nil, err
+		}
+		substate, err := db.GetSubstate(key.Block, key.Tx)
+		if err != nil {
+			return nil, err
+		}
+		return &SubstateEntry{Block: key.Block, Tx: key.Tx, Substate: substate}, nil
+	}
+	for _, key := range sortedSubstateKeys(selected) {
+		ea, err := getEntry(a, key)
+		if err != nil {
+			return stats, fmt.Errorf("record-replay: error reading first substate DB: %v", err)
+		}
+		eb, err := getEntry(b, key)
+		if err != nil {
+			return stats, fmt.Errorf("record-replay: error reading second substate DB: %v", err)
+		}
+
+		switch {
+		case ea == nil && eb == nil:
+			// selected by an outdated index
+		case eb == nil:
+			stats.NumMissing++
+			report(&SubstateDiff{Kind: MissingSubstateDiff, Block: key.Block, Tx: key.Tx})
+		case ea == nil:
+			stats.NumExtra++
+			report(&SubstateDiff{Kind: ExtraSubstateDiff, Block: key.Block, Tx: key.Tx})
+		default:
+			diffCommonSubstates(ea, eb, stats, report)
+		}
+	}
+
+	return stats, nil
+}
+
+func compareSubstateEntries(x, y *SubstateEntry) int {
+	switch {
+	case x.Block < y.Block:
+		return -1
+	case x.Block > y.Block:
+		return 1
+	case x.Tx < y.Tx:
+		return -1
+	case x.Tx > y.Tx:
+		return 1
+	}
+	return 0
+}
+
+// DiffSubstates returns the components of x and y that differ according to
+// their Equal methods, and the fields that differ within these components.
+// Every differing component has at least one field; a component whose
+// fields all format equally is reported with the field "*".
+func DiffSubstates(x, y *Substate) (components []string, fields []SubstateFieldDiff) {
+	diff := func(component string, componentFields []SubstateFieldDiff) {
+		components = append(components, component)
+		if len(componentFields) == 0 {
+			componentFields = []SubstateFieldDiff{{Component: component, Field: "*", A: "not equal", B: "not equal"}}
+		}
+		fields = append(fields, componentFields...)
+	}
+	if !x.InputAlloc.Equal(y.InputAlloc) {
+		diff("InputAlloc", DiffSubstateAllocs("InputAlloc", x.InputAlloc, y.InputAlloc))
+	}
+	if !x.OutputAlloc.Equal(y.OutputAlloc) {
+		diff("OutputAlloc", DiffSubstateAllocs("OutputAlloc", x.OutputAlloc, y.OutputAlloc))
+	}
+	if !x.Env.Equal(y.Env) {
+		diff("Env", diffEnvs(x.Env, y.Env))
+	}
+	if !x.Message.Equal(y.Message) {
+		diff("Message", diffMessages(x.Message, y.Message))
+	}
+	if !x.Result.Equal(y.Result) {
+		diff("Result", diffResults(x.Result, y.Result))
+	}
+	return components, fields
+}
+
+// fieldDiffer collects differences of fields of a component.
+type fieldDiffer struct {
+	component string
+	fields    []SubstateFieldDiff
+}
+
+func (d *fieldDiffer) add(field, a, b string) {
+	if a != b {
+		d.fields = append(d.fields, SubstateFieldDiff{Component: d.component, Field: field, A: a, B: b})
+	}
+}
+
+func formatBig(x *big.Int) string {
+	if x == nil {
+		return "nil"
+	}
+	return x.String()
+}
+
+// formatData formats a byte slice as its hash and length, which is shorter
+// than its hex encoding for code and call data.
+func formatData(data []byte) string {
+	if len(data) == 0 {
+		return "0x"
+	}
+	return fmt.Sprintf("%s (%d bytes)", crypto.Keccak256Hash(data).Hex(), len(data))
+}
+
+func formatAccount(sa *SubstateAccount) string {
+	return fmt.Sprintf("nonce %v, balance %v, code %s, %v storage slots", sa.Nonce, formatBig(sa.Balance), formatData(sa.Code), len(sa.Storage))
+}
+
+// DiffSubstateAllocs returns the fields of accounts that differ between x
+// and y, ordered by address and storage key. Fields are named after the
+// address of their account, e.g. "0x....Storage[0x...]", and an account
+// missing in x or y is reported as a single field named after its address.
+func DiffSubstateAllocs(component string, x, y SubstateAlloc) []SubstateFieldDiff {
+	d := &fieldDiffer{component: component}
+
+	addrs := make(map[common.Address]struct{})
+	for addr := range x {
+		addrs[addr] = struct{}{}
+	}
+	for addr := range y {
+		addrs[addr] = struct{}{}
+	}
+	sorted := make([]common.Address, 0, len(addrs))
+	for addr := range addrs {
+		sorted = append(sorted, addr)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return bytes.Compare(sorted[i][:], sorted[j][:]) < 0 })
+
+	for _, addr := range sorted {
+		xa, ya := x[addr], y[addr]
+		if xa == nil || ya == nil {
+			var a, b string
+			if xa != nil {
+				a = formatAccount(xa)
+			}
+			if ya != nil {
+				b = formatAccount(ya)
+			}
+			d.add(addr.Hex(), a, b)
+			continue
+		}
+		if xa.Equal(ya) {
+			continue
+		}
+
+		d.add(addr.Hex()+".Nonce", fmt.Sprint(xa.Nonce), fmt.Sprint(ya.Nonce))
+		d.add(addr.Hex()+".Balance", formatBig(xa.Balance), formatBig(ya.Balance))
+		if !bytes.Equal(xa.Code, ya.Code) {
+			d.add(addr.Hex()+".Code", formatData(xa.Code), formatData(ya.Code))
+		}
+
+		keys := make([]common.Hash, 0, len(xa.Storage)+len(ya.Storage))
+		for key := range xa.Storage {
+			keys = append(keys, key)
+		}
+		for key := range ya.Storage {
+			if _, exist := xa.Storage[key]; !exist {
+				keys = append(keys, key)
+			}
+		}
+		sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i][:], keys[j][:]) < 0 })
+		for _, key := range keys {
+			var a, b string
+			if value, exist := xa.Storage[key]; exist {
+				a = value.Hex()
+			}
+			if value, exist := ya.Storage[key]; exist {
+				b = value.Hex()
+			}
+			d.add(fmt.Sprintf("%s.Storage[%s]", addr.Hex(), key.Hex()), a, b)
+		}
+	}
+
+	return d.fields
+}
+
+func diffEnvs(x, y *SubstateEnv) []SubstateFieldDiff {
+	d := &fieldDiffer{component: "Env"}
+	if x == nil || y == nil {
+		d.add("exists", fmt.Sprint(x != nil), fmt.Sprint(y != nil))
+		return d.fields
+	}
+
+	d.add("Coinbase", x.Coinbase.Hex(), y.Coinbase.Hex())
+	d.add("Difficulty", formatBig(x.Difficulty), formatBig(y.Difficulty))
+	d.add("GasLimit", fmt.Sprint(x.GasLimit), fmt.Sprint(y.GasLimit))
+	d.add("Number", fmt.Sprint(x.Number), fmt.Sprint(y.Number))
+	d.add("Timestamp", fmt.Sprint(x.Timestamp), fmt.Sprint(y.Timestamp))
+
+	nums := make([]uint64, 0, len(x.BlockHashes)+len(y.BlockHashes))
+	for num := range x.BlockHashes {
+		nums = append(nums, num)
+	}
+	for num := range y.BlockHashes {
+		if _, exist := x.BlockHashes[num]; !exist {
+			nums = append(nums, num)
+		}
+	}
+	sort.Slice(nums, func(i, j int) bool { return nums[i] < nums[j] })
+	for _, num := range nums {
+		var a, b string
+		if hash, exist := x.BlockHashes[num]; exist {
+			a = hash.Hex()
+		}
+		if hash, exist := y.BlockHashes[num]; exist {
+			b = hash.Hex()
+		}
+		d.add(fmt.Sprintf("BlockHashes[%v]", num), a, b)
+	}
+
+	d.add("BaseFee", formatBig(x.BaseFee), formatBig(y.BaseFee))
+	return d.fields
+}
+
+func formatTo(to *common.Address) string {
+	if to == nil {
+		return "nil"
+	}
+	return to.Hex()
+}
+
+func formatAccessTuple(tuple *types.AccessTuple) string {
+	keys := make([]string, len(tuple.StorageKeys))
+	for i, key := range tuple.StorageKeys {
+		keys[i] = key.Hex()
+	}
+	return fmt.Sprintf("%s [%s]", tuple.Address.Hex(), strings.Join(keys, " "))
+}
+
+func diffMessages(x, y *SubstateMessage) []SubstateFieldDiff {
+	d := &fieldDiffer{component: "Message"}
+	if x == nil || y == nil {
+		d.add("exists", fmt.Sprint(x != nil), fmt.Sprint(y != nil))
+		return d.fields
+	}
+
+	d.add("Nonce", fmt.Sprint(x.Nonce), fmt.Sprint(y.Nonce))
+	d.add("CheckNonce", fmt.Sprint(x.CheckNonce), fmt.Sprint(y.CheckNonce))
+	d.add("GasPrice", formatBig(x.GasPrice), formatBig(y.GasPrice))
+	d.add("Gas", fmt.Sprint(x.Gas), fmt.Sprint(y.Gas))
+	d.add("From", x.From.Hex(), y.From.Hex())
+	d.add("To", formatTo(x.To), formatTo(y.To))
+	d.add("Value", formatBig(x.Value), formatBig(y.Value))
+	if !bytes.Equal(x.Data, y.Data) {
+		d.add("Data", formatData(x.Data), formatData(y.Data))
+	}
+
+	for i := 0; i < len(x.AccessList) || i < len(y.AccessList); i++ {
+		var a, b string
+		if i < len(x.AccessList) {
+			a = formatAccessTuple(&x.AccessList[i])
+		}
+		if i < len(y.AccessList) {
+			b = formatAccessTuple(&y.AccessList[i])
+		}
+		d.add(fmt.Sprintf("AccessList[%v]", i), a, b)
+	}
+
+	d.add("GasFeeCap", formatBig(x.GasFeeCap), formatBig(y.GasFeeCap))
+	d.add("GasTipCap", formatBig(x.GasTipCap), formatBig(y.GasTipCap))
+	return d.fields
+}
+
+func formatLog(log *types.Log) string {
+	return fmt.Sprintf("address %s, %v topics, data %s", log.Address.Hex(), len(log.Topics), hexutil.Encode(log.Data))
+}
+
+func diffResults(x, y *SubstateResult) []SubstateFieldDiff {
+	d := &fieldDiffer{component: "Result"}
+	if x == nil || y == nil {
+		d.add("exists", fmt.Sprint(x != nil), fmt.Sprint(y != nil))
+		return d.fields
+	}
+
+	d.add("Status", fmt.Sprint(x.Status), fmt.Sprint(y.Status))
+	d.add("Bloom", hexutil.Encode(x.Bloom[:]), hexutil.Encode(y.Bloom[:]))
+	d.add("ContractAddress", x.ContractAddress.Hex(), y.ContractAddress.Hex())
+	d.add("GasUsed", fmt.Sprint(x.GasUsed), fmt.Sprint(y.GasUsed))
+
+	for i := 0; i < len(x.Logs) || i < len(y.Logs); i++ {
+		if i >= len(x.Logs) || i >= len(y.Logs) {
+			var a, b string
+			if i < len(x.Logs) {
+				a = formatLog(x.Logs[i])
+			}
+			if i < len(y.Logs) {
+				b = formatLog(y.Logs[i])
+			}
+			d.add(fmt.Sprintf("Logs[%v]", i), a, b)
+			continue
+		}
+
+		xl, yl := x.Logs[i], y.Logs[i]
+		d.add(fmt.Sprintf("Logs[%v].Address", i), xl.Address.Hex(), yl.Address.Hex())
+		for j := 0; j < len(xl.Topics) || j < len(yl.Topics); j++ {
+			var a, b string
+			if j < len(xl.Topics) {
+				a = xl.Topics[j].Hex()
+			}
+			if j < len(yl.Topics) {
+				b = yl.Topics[j].Hex()
+			}
+			d.add(fmt.Sprintf("Logs[%v].Topics[%v]", i, j), a, b)
+		}
+		d.add(fmt.Sprintf("Logs[%v].Data", i), hexutil.Encode(xl.Data), hexutil.Encode(yl.Data))
+	}
+	return d.fields
+}
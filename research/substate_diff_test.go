@@ -0,0 +1,202 @@
+package research
+
+import (
+	"math/big"
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+)
+
+func TestDiffSubstates(t *testing.T) {
+	to := common.Address{0x02}
+	tests := []struct {
+		name       string
+		modifyA    func(s *Substate)
+		modifyB    func(s *Substate)
+		components []string
+		fields     []SubstateFieldDiff
+	}{
+		{
+			name: "equal",
+		},
+		{
+			name:       "storage slot",
+			modifyB:    func(s *Substate) { s.OutputAlloc[to].Storage[common.Hash{0x01}] = common.Hash{0x04} },
+			components: []string{"OutputAlloc"},
+			fields: []SubstateFieldDiff{{
+				Component: "OutputAlloc",
+				Field:     to.Hex() + ".Storage[" + common.Hash{0x01}.Hex() + "]",
+				A:         common.Hash{0x03}.Hex(),
+				B:         common.Hash{0x04}.Hex(),
+			}},
+		},
+		{
+			name:       "new storage slot",
+			modifyB:    func(s *Substate) { s.InputAlloc[to].Storage[common.Hash{0x05}] = common.Hash{0x06} },
+			components: []string{"InputAlloc"},
+			fields: []SubstateFieldDiff{{
+				Component: "InputAlloc",
+				Field:     to.Hex() + ".Storage[" + common.Hash{0x05}.Hex() + "]",
+				B:         common.Hash{0x06}.Hex(),
+			}},
+		},
+		{
+			name:       "log topic",
+			modifyB:    func(s *Substate) { s.Result.Logs[0].Topics[0] = common.Hash{0x0d} },
+			components: []string{"Result"},
+			fields: []SubstateFieldDiff{{
+				Component: "Result",
+				Field:     "Logs[0].Topics[0]",
+				A:         common.Hash{0x0c}.Hex(),
+				B:         common.Hash{0x0d}.Hex(),
+			}},
+		},
+		{
+			name: "env fields",
+			modifyB: func(s *Substate) {
+				s.Env.Timestamp++
+				s.Env.BaseFee = big.NewInt(7)
+			},
+			components: []string{"Env"},
+			fields: []SubstateFieldDiff{
+				{Component: "Env", Field: "Timestamp", A: "1600000000", B: "1600000001"},
+				{Component: "Env", Field: "BaseFee", A: "nil", B: "7"},
+			},
+		},
+		{
+			// nil and empty maps are equal
+			name: "empty block hashes and storage",
+			modifyA: func(s *Substate) {
+				s.Env.BlockHashes = map[uint64]common.Hash{}
+				s.InputAlloc[to].Storage = map[common.Hash]common.Hash{}
+			},
+			modifyB: func(s *Substate) {
+				s.Env.BlockHashes = nil
+				s.InputAlloc[to].Storage = nil
+			},
+		},
+		{
+			// a nil account has no fields to format
+			name:       "nil account",
+			modifyA:    func(s *Substate) { s.InputAlloc[common.Address{0x03}] = nil },
+			components: []string{"InputAlloc"},
+			fields:     []SubstateFieldDiff{{Component: "InputAlloc", Field: "*", A: "not equal", B: "not equal"}},
+		},
+	}
+	for _, test := range tests {
+		x, y := newTestSubstate(10, false), newTestSubstate(10, false)
+		if test.modifyA != nil {
+			test.modifyA(x)
+		}
+		if test.modifyB != nil {
+			test.modifyB(y)
+		}
+
+		components, fields := DiffSubstates(x, y)
+		if !reflect.DeepEqual(components, test.components) {
+			t.Errorf("%s: components %v, want %v", test.name, components, test.components)
+		}
+		if !reflect.DeepEqual(fields, test.fields) {
+			t.Errorf("%s: fields %v, want %v", test.name, fields, test.fields)
+		}
+	}
+}
+
+func TestDiffSubstateDBs(t *testing.T) {
+	a := NewSubstateDB(rawdb.NewMemoryDatabase())
+	b := NewSubstateDB(rawdb.NewMemoryDatabase())
+	put := func(db *SubstateDB, block uint64, tx int, substate *Substate) {
+		if err := db.PutSubstate(block, tx, substate); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 1_0 in both, 2_0 only in a, 2_1 only in b, 3_0 differs and 4_0 is
+	// out of range
+	put(a, 1, 0, newTestSubstate(1, false))
+	put(b, 1, 0, newTestSubstate(1, false))
+	put(a, 2, 0, newTestSubstate(2, false))
+	put(b, 2, 1, newTestSubstate(2, false))
+	put(a, 3, 0, newTestSubstate(3, false))
+	different := newTestSubstate(3, false)
+	different.Result.GasUsed++
+	put(b, 3, 0, different)
+	put(a, 4, 0, newTestSubstate(4, false))
+
+	var diffs []*SubstateDiff
+	stats, err := DiffSubstateDBs(a, b, 1, 3, 2, func(d *SubstateDiff) { diffs = append(diffs, d) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*SubstateDiff{
+		{Kind: MissingSubstateDiff, Block: 2, Tx: 0},
+		{Kind: ExtraSubstateDiff, Block: 2, Tx: 1},
+		{
+			Kind:       DifferentSubstateDiff,
+			Block:      3,
+			Tx:         0,
+			Components: []string{"Result"},
+			Fields:     []SubstateFieldDiff{{Component: "Result", Field: "GasUsed", A: "30000", B: "30001"}},
+		},
+	}
+	if !reflect.DeepEqual(diffs, want) {
+		t.Fatalf("diffs %v, want %v", diffs, want)
+	}
+	wantStats := &DiffStats{NumCommon: 2, NumMissing: 1, NumExtra: 1, NumDifferent: 1}
+	if !reflect.DeepEqual(stats, wantStats) {
+		t.Fatalf("stats %+v, want %+v", stats, wantStats)
+	}
+}
+
+func TestDiffSelectedSubstates(t *testing.T) {
+	a := NewSubstateDB(rawdb.NewMemoryDatabase())
+	b := NewSubstateDB(rawdb.NewMemoryDatabase())
+	put := func(db *SubstateDB, block uint64, tx int, substate *Substate, txHash common.Hash) {
+		if err := db.PutSubstate(block, tx, substate); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.PutTxHash(block, tx, txHash); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 2_0 only in a, 2_1 only in b, 3_0 differs and 1_0 is not selected
+	put(a, 1, 0, newTestSubstate(1, false), common.Hash{0x01})
+	put(b, 1, 0, newTestSubstate(1, false), common.Hash{0x01})
+	put(a, 2, 0, newTestSubstate(2, false), common.Hash{0x02})
+	put(b, 2, 1, newTestSubstate(2, false), common.Hash{0x03})
+	put(a, 3, 0, newTestSubstate(3, false), common.Hash{0x04})
+	different := newTestSubstate(3, false)
+	different.Env.Coinbase = common.Address{0x0a}
+	put(b, 3, 0, different, common.Hash{0x04})
+
+	sel := &SubstateSelector{TxHashes: []common.Hash{{0x04}, {0x03}, {0x02}}}
+	var diffs []*SubstateDiff
+	stats, err := DiffSelectedSubstates(a, b, sel, 0, 100, func(d *SubstateDiff) { diffs = append(diffs, d) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*SubstateDiff{
+		{Kind: MissingSubstateDiff, Block: 2, Tx: 0},
+		{Kind: ExtraSubstateDiff, Block: 2, Tx: 1},
+		{
+			Kind:       DifferentSubstateDiff,
+			Block:      3,
+			Tx:         0,
+			Components: []string{"Env"},
+			Fields:     []SubstateFieldDiff{{Component: "Env", Field: "Coinbase", A: common.Address{0x09}.Hex(), B: common.Address{0x0a}.Hex()}},
+		},
+	}
+	if !reflect.DeepEqual(diffs, want) {
+		t.Fatalf("diffs %v, want %v", diffs, want)
+	}
+	wantStats := &DiffStats{NumCommon: 1, NumMissing: 1, NumExtra: 1, NumDifferent: 1}
+	if !reflect.DeepEqual(stats, wantStats) {
+		t.Fatalf("stats %+v, want %+v", stats, wantStats)
+	}
+
+	sel = &SubstateSelector{TxHashes: []common.Hash{{0x05}}}
+	if _, err := DiffSelectedSubstates(a, b, sel, 0, 100, func(d *SubstateDiff) {}); err == nil {
+		t.Fatal("no error for a tx hash indexed in neither substate DB")
+	}
+}
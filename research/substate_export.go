@@ -0,0 +1,155 @@
+package research
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// SubstateExportHeader is the first line of substate JSON Lines files
+// written by ExportSubstates. It lists the recorded blocks of the exported
+// block range, see AddRecordedBlocks. Files without a header, i.e. exports of
+// selected substates and failure files, may contain only part of a block.
+type SubstateExportHeader struct {
+	First    uint64          `json:"first"`
+	Last     uint64          `json:"last"`
+	Recorded []BlockInterval `json:"recorded"`
+}
+
+// ExportSubstates writes substates from block first to block last
+// (inclusive) to w in JSON Lines format: a SubstateExportHeader line
+// {"header": H} followed by one SubstateEntry per line in key order, with
+// the tx hash if it was recorded. Values are decoded on the given number of
+// goroutines.
+func (db *SubstateDB) ExportSubstates(w io.Writer, first, last uint64, workers int) (exported int64, err error) {
+	recorded, err := db.getRecordedBlocks()
+	if err != nil {
+		return 0, err
+	}
+	header := &SubstateExportHeader{
+		First:    first,
+		Last:     last,
+		Recorded: IntersectBlockIntervals(recorded, first, last),
+	}
+	if err := json.NewEncoder(w).Encode(struct {
+		Header *SubstateExportHeader `json:"header"`
+	}{header}); err != nil {
+		return 0, err
+	}
+
+	iter := db.NewSubstateIterator(first, last, workers)
+	defer iter.Release()
+	return db.exportSubstates(w, iter)
+}
+
+// ExportSelectedSubstates is ExportSubstates for the substates of keys, see
+// SelectSubstates. The output has no SubstateExportHeader.
+func (db *SubstateDB) ExportSelectedSubstates(w io.Writer, keys []SubstateKey, workers int) (exported int64, err error) {
+	iter := db.NewSelectedSubstateIterator(keys, workers)
+	defer iter.Release()
+	return db.exportSubstates(w, iter)
+}
+
+func (db *SubstateDB) exportSubstates(w io.Writer, iter *SubstateIterator) (exported int64, err error) {
+	encoder := json.NewEncoder(w)
+	for iter.Next() {
+		entry := iter.Value()
+		txHash, err := db.GetTxHash(entry.Block, entry.Tx)
+		if err != nil {
+			return exported, err
+		}
+		if txHash != (common.Hash{}) {
+			entry.TxHash = &txHash
+		}
+		if err := encoder.Encode(entry); err != nil {
+			return exported, &SubstateError{Block: entry.Block, Tx: entry.Tx, Err: err}
+		}
+		exported++
+	}
+	return exported, iter.Error()
+}
+
+// ImportSubstates reads substates in JSON Lines format written by
+// ExportSubstates, or failures written by SubstateTaskPool with KeepGoing,
+// from r and writes them with PutSubstate, which also writes the address
+// index, and PutTxHash if a line has a tx hash. Failures without a substate
+// are skipped. Block summaries of imported blocks are rebuilt from all their
+// substates in the substate DB afterwards. Only the recorded blocks listed
+// in a SubstateExportHeader are marked as recorded, as files without a
+// header may contain only part of a block.
+func (db *SubstateDB) ImportSubstates(r io.Reader) (imported int64, err error) {
+	decoder := json.NewDecoder(r)
+
+	var (
+		header *SubstateExportHeader
+		blocks []uint64 // imported blocks in file order
+		last   uint64
+	)
+	for lines := 0; ; lines++ {
+		line := struct {
+			SubstateEntry
+			Error  string                `json:"error"`  // lines of failure files
+			Header *SubstateExportHeader `json:"header"` // first line of block range exports
+		}{}
+		err := decoder.Decode(&line)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return imported, fmt.Errorf("record-replay: error decoding substate JSON after %v substates: %v", imported, err)
+		}
+		if line.Header != nil {
+			if lines > 0 {
+				return imported, fmt.Errorf("record-replay: export header after %v substates", imported)
+			}
+			header = line.Header
+			continue
+		}
+		entry := line.SubstateEntry
+		if entry.Substate == nil {
+			if line.Error != "" {
+				// failure of a substate that could not be decoded
+				continue
+			}
+			return imported, &SubstateError{Block: entry.Block, Tx: entry.Tx, Err: fmt.Errorf("missing substate")}
+		}
+
+		if err := db.PutSubstate(entry.Block, entry.Tx, entry.Substate); err != nil {
+			return imported, err
+		}
+		if entry.TxHash != nil {
+			if err := db.PutTxHash(entry.Block, entry.Tx, *entry.TxHash); err != nil {
+				return imported, err
+			}
+		}
+		if imported == 0 || entry.Block != last {
+			blocks = append(blocks, entry.Block)
+			last = entry.Block
+		}
+		imported++
+	}
+
+	// failure files are not ordered by block
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i] < blocks[j] })
+	for i, block := range blocks {
+		if i > 0 && block == blocks[i-1] {
+			continue
+		}
+		if err := db.rebuildBlockSummary(block, nil); err != nil {
+			return imported, err
+		}
+	}
+
+	if header == nil {
+		return imported, nil
+	}
+	for _, interval := range header.Recorded {
+		if err := db.AddRecordedBlocks(interval.First, interval.Last); err != nil {
+			return imported, err
+		}
+	}
+	return imported, db.FlushRecordedBlocks()
+}
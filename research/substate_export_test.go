@@ -0,0 +1,155 @@
+package research
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+)
+
+func TestSubstateExportImport(t *testing.T) {
+	src := NewSubstateDB(rawdb.NewMemoryDatabase())
+	for block := uint64(10); block <= 12; block++ {
+		for tx := 0; tx < 2; tx++ {
+			substate := newTestSubstate(block, true)
+			if err := src.PutSubstate(block, tx, substate); err != nil {
+				t.Fatal(err)
+			}
+			// block 11 has no tx hashes
+			if block != 11 {
+				if err := src.PutTxHash(block, tx, common.Hash{byte(block), byte(tx)}); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+
+	// blocks 9 to 11 are recorded, block 12 is incomplete
+	if err := src.AddRecordedBlocks(9, 11); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	exported, err := src.ExportSubstates(&buf, 10, 12, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exported != 6 {
+		t.Fatalf("exported %v substates, want 6", exported)
+	}
+
+	dst := NewSubstateDB(rawdb.NewMemoryDatabase())
+	imported, err := dst.ImportSubstates(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported != 6 {
+		t.Fatalf("imported %v substates, want 6", imported)
+	}
+
+	for block := uint64(10); block <= 12; block++ {
+		for tx := 0; tx < 2; tx++ {
+			want, err := src.backend.Get(Stage1SubstateKey(block, tx))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := dst.backend.Get(Stage1SubstateKey(block, tx))
+			if err != nil {
+				t.Fatalf("substate %v_%v not imported: %v", block, tx, err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Fatalf("substate %v_%v differs after import", block, tx)
+			}
+
+			txHash, err := dst.GetTxHash(block, tx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var wantHash common.Hash
+			if block != 11 {
+				wantHash = common.Hash{byte(block), byte(tx)}
+			}
+			if txHash != wantHash {
+				t.Fatalf("substate %v_%v has tx hash %v, want %v", block, tx, txHash.Hex(), wantHash.Hex())
+			}
+			if block != 11 {
+				b, i, found, err := dst.FindTx(wantHash)
+				if err != nil || !found || b != block || i != tx {
+					t.Fatalf("tx %v found at %v_%v (%v, %v), want %v_%v", wantHash.Hex(), b, i, found, err, block, tx)
+				}
+			}
+		}
+	}
+
+	keys, err := dst.GetAddressSubstates(common.Address{0x02}, 0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 6 {
+		t.Fatalf("address index has %v substates, want 6", len(keys))
+	}
+
+	blocks, err := dst.getRecordedBlocks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []BlockInterval{{10, 11}}; !reflect.DeepEqual(blocks, want) {
+		t.Fatalf("recorded blocks %v, want %v", blocks, want)
+	}
+	for block := uint64(10); block <= 12; block++ {
+		summary, err := dst.GetBlockSummary(block)
+		if err != nil || summary == nil || summary.NumTxs != 2 {
+			t.Fatalf("block summary %v is %+v after import: %v", block, summary, err)
+		}
+	}
+}
+
+func TestSubstateImportSelected(t *testing.T) {
+	src := NewSubstateDB(rawdb.NewMemoryDatabase())
+	dst := NewSubstateDB(rawdb.NewMemoryDatabase())
+	for block := uint64(10); block <= 11; block++ {
+		for tx := 0; tx < 3; tx++ {
+			if err := src.PutSubstate(block, tx, newTestSubstate(block, false)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := src.AddRecordedBlocks(10, 11); err != nil {
+		t.Fatal(err)
+	}
+	// dst has all substates of block 10
+	for tx := 0; tx < 3; tx++ {
+		if err := dst.PutSubstate(10, tx, newTestSubstate(10, false)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := dst.rebuildBlockSummary(10, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	keys := []SubstateKey{{Block: 10, Tx: 1}, {Block: 11, Tx: 2}}
+	if _, err := src.ExportSelectedSubstates(&buf, keys, 1); err != nil {
+		t.Fatal(err)
+	}
+	if imported, err := dst.ImportSubstates(&buf); err != nil || imported != 2 {
+		t.Fatalf("imported %v substates: %v", imported, err)
+	}
+
+	// summaries count all substates in dst and no block is recorded
+	for block, numTxs := range map[uint64]uint64{10: 3, 11: 1} {
+		summary, err := dst.GetBlockSummary(block)
+		if err != nil || summary == nil || summary.NumTxs != numTxs {
+			t.Fatalf("block summary %v is %+v, want %v transactions: %v", block, summary, numTxs, err)
+		}
+	}
+	blocks, err := dst.getRecordedBlocks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blocks) != 0 {
+		t.Fatalf("recorded blocks %v after importing selected substates", blocks)
+	}
+}
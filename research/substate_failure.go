@@ -0,0 +1,254 @@
+package research
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+
+	cli "gopkg.in/urfave/cli.v1"
+)
+
+var (
+	KeepGoingFlag = cli.BoolFlag{
+		Name:  "keep-going",
+		Usage: "Continue after transactions fail or panic, and report all failures at the end",
+	}
+	FailureFileFlag = cli.StringFlag{
+		Name:  "failure-file",
+		Usage: "JSON Lines file to write substates of failed transactions to with --keep-going",
+		Value: "failures.jsonl",
+	}
+)
+
+// TxFailure is a transaction whose WorkerAction returned an error or
+// panicked, or whose substate cannot be decoded. Its JSON form is a line of a
+// failure file, which can be imported with ImportSubstates to reproduce the
+// failure.
+type TxFailure struct {
+	Block    uint64    `json:"block"`
+	Tx       int       `json:"tx"`
+	Substate *Substate `json:"substate"` // nil if the substate cannot be decoded
+	Error    string    `json:"error"`
+	Stack    string    `json:"stack,omitempty"` // stack trace if WorkerAction panicked
+	Location string    `json:"-"`               // function that panicked
+}
+
+func (f *TxFailure) String() string {
+	return fmt.Sprintf("%v_%v: %s", f.Block, f.Tx, f.Error)
+}
+
+var (
+	hexSignatureRegexp = regexp.MustCompile(`0x[0-9a-fA-F]+`)
+	numSignatureRegexp = regexp.MustCompile(`\b[0-9]+\b`)
+)
+
+// Signature returns the error of the failure without hex strings and
+// numbers, so that failures of the same cause have the same signature.
+func (f *TxFailure) Signature() string {
+	sig := hexSignatureRegexp.ReplaceAllString(f.Error, "0x?")
+	sig = numSignatureRegexp.ReplaceAllString(sig, "?")
+	if f.Location != "" {
+		sig += " in " + f.Location
+	}
+	return sig
+}
+
+// panicLocation returns the function that called panic in a stack trace
+// returned by debug.Stack, skipping functions of the runtime package.
+func panicLocation(stack []byte) string {
+	scanner := bufio.NewScanner(bytes.NewReader(stack))
+	panicked := false
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "\t") {
+			// file and line of the previous function
+			continue
+		}
+		if strings.HasPrefix(line, "panic(") {
+			panicked = true
+			continue
+		}
+		if panicked && !strings.HasPrefix(line, "runtime.") {
+			if i := strings.LastIndex(line, "("); i > 0 {
+				return line[:i]
+			}
+			return line
+		}
+	}
+	return ""
+}
+
+// callWorkerAction calls WorkerAction and returns a TxFailure if it returns
+// an error or panics.
+func (pool *SubstateTaskPool) callWorkerAction(block uint64, tx int, substate *Substate) (res WorkerResult, failure *TxFailure) {
+	defer func() {
+		if r := recover(); r != nil {
+			stack := debug.Stack()
+			res = nil
+			failure = &TxFailure{
+				Block:    block,
+				Tx:       tx,
+				Substate: substate,
+				Error:    fmt.Sprintf("panic: %v", r),
+				Stack:    string(stack),
+				Location: panicLocation(stack),
+			}
+		}
+	}()
+
+	res, err := pool.WorkerAction(block, tx, substate)
+	if err != nil {
+		return nil, &TxFailure{Block: block, Tx: tx, Substate: substate, Error: err.Error()}
+	}
+	return res, nil
+}
+
+// txFailureGroup counts failures of the same signature
+type txFailureGroup struct {
+	signature string
+	count     int64
+	first     *TxFailure // failed transaction with the lowest block and tx
+}
+
+// txFailureLog writes failures of a SubstateTaskPool with --keep-going to
+// the failure file and groups them by signature for the final summary.
+type txFailureLog struct {
+	lock    sync.Mutex
+	path    string
+	file    *os.File
+	encoder *json.Encoder
+	count   int64
+	groups  map[string]*txFailureGroup
+}
+
+// openTxFailureLog creates the failure file. If resume is true, failures of
+// blocks before block first, which were collected before the checkpoint of
+// a previous run, are kept in the failure file and counted in the summary.
+// Failures of later blocks are dropped because these blocks are executed
+// again.
+func openTxFailureLog(path string, resume bool, first uint64) (*txFailureLog, error) {
+	var kept []*TxFailure
+	if resume {
+		var err error
+		kept, err = readTxFailures(path, first)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	log := &txFailureLog{
+		path:    path,
+		file:    file,
+		encoder: json.NewEncoder(file),
+		groups:  make(map[string]*txFailureGroup),
+	}
+	for _, f := range kept {
+		if err := log.add(f); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	return log, nil
+}
+
+// readTxFailures reads failures of blocks before block first from a failure
+// file. A missing failure file has no failures.
+func readTxFailures(path string, first uint64) ([]*TxFailure, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var failures []*TxFailure
+	decoder := json.NewDecoder(bufio.NewReader(file))
+	for {
+		f := &TxFailure{}
+		err := decoder.Decode(f)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading failure file %s: %v", path, err)
+		}
+		if f.Block >= first {
+			continue
+		}
+		if f.Stack != "" {
+			f.Location = panicLocation([]byte(f.Stack))
+		}
+		failures = append(failures, f)
+	}
+	return failures, nil
+}
+
+// add writes a failure to the failure file. The substate of the failure is
+// not kept in memory.
+func (log *txFailureLog) add(f *TxFailure) error {
+	log.lock.Lock()
+	defer log.lock.Unlock()
+
+	if err := log.encoder.Encode(f); err != nil {
+		return fmt.Errorf("error writing failure file %s: %v", log.path, err)
+	}
+	log.count++
+
+	sig := f.Signature()
+	group, ok := log.groups[sig]
+	if !ok {
+		group = &txFailureGroup{signature: sig}
+		log.groups[sig] = group
+	}
+	if first := group.first; first == nil || f.Block < first.Block || (f.Block == first.Block && f.Tx < first.Tx) {
+		first := *f
+		first.Substate = nil
+		group.first = &first
+	}
+	group.count++
+	return nil
+}
+
+// printSummary prints the number of failures of each signature, most
+// frequent first, with the first failed transaction of the signature.
+func (log *txFailureLog) printSummary(name string) {
+	log.lock.Lock()
+	defer log.lock.Unlock()
+
+	if log.count == 0 {
+		return
+	}
+	groups := make([]*txFailureGroup, 0, len(log.groups))
+	for _, group := range log.groups {
+		groups = append(groups, group)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].count != groups[j].count {
+			return groups[i].count > groups[j].count
+		}
+		return groups[i].signature < groups[j].signature
+	})
+
+	fmt.Printf("%s: %v failed transactions written to %s\n", name, log.count, log.path)
+	for _, group := range groups {
+		fmt.Printf("%s: %12v %s (first %v_%v)\n", name, group.count, group.signature, group.first.Block, group.first.Tx)
+	}
+}
+
+func (log *txFailureLog) close() error {
+	return log.file.Close()
+}
@@ -0,0 +1,112 @@
+package research
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// readTestFailures returns the sorted "block_tx" keys of all failures in a
+// failure file.
+func readTestFailures(t *testing.T, path string) []string {
+	t.Helper()
+	failures, err := readTxFailures(path, ^uint64(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, f := range failures {
+		keys = append(keys, fmt.Sprintf("%v_%v", f.Block, f.Tx))
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestSubstateTaskPoolKeepGoing(t *testing.T) {
+	txs := []int{1, 2, 0, 3, 1, 1, 2, 0, 4, 1, 2, 1, 3, 0, 1, 2}
+	db := newTestTaskDB(t, txs)
+	dir := t.TempDir()
+	failureFile := filepath.Join(dir, "failures.jsonl")
+
+	// substate 5_0 cannot be decoded
+	if err := db.backend.Put(Stage1SubstateKey(5, 0), []byte{0xff, 0xff}); err != nil {
+		t.Fatal(err)
+	}
+
+	errTx := errors.New("tx failed")
+	newPool := func() *SubstateTaskPool {
+		return &SubstateTaskPool{
+			Name: "test",
+			WorkerAction: func(block uint64, tx int, substate *Substate) (WorkerResult, error) {
+				if (block == 3 && tx == 1) || (block == 12 && tx == 2) {
+					return nil, errTx
+				}
+				return &VanillaWorkerResult{BlockId: block, TxId: tx}, nil
+			},
+			CollectorAction: collectCheckpointedBlocks,
+			CollectorInit:   func() CollectorResult { return &checkpointedBlocks{} },
+			First:           1,
+			Last:            uint64(len(txs) - 1),
+			Workers:         2,
+			DB:              db,
+			KeepGoing:       true,
+			FailureFile:     failureFile,
+		}
+	}
+	want := []string{"12_2", "3_1", "5_0"}
+
+	// failed transactions and undecodable substates do not stop the execution
+	got, err := newPool().Execute()
+	if err == nil {
+		t.Fatal("no error for failed transactions")
+	}
+	c := got.(*checkpointedBlocks)
+	if len(c.Blocks) != len(txs)-1 {
+		t.Fatalf("collected %v blocks, want %v", len(c.Blocks), len(txs)-1)
+	}
+	if keys := readTestFailures(t, failureFile); !reflect.DeepEqual(keys, want) {
+		t.Fatalf("failures %v, want %v", keys, want)
+	}
+
+	// failures without substates are skipped by ImportSubstates
+	data, err := ioutil.ReadFile(failureFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	imported, err := newTestTaskDB(t, nil).ImportSubstates(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported != 2 {
+		t.Fatalf("imported %v substates, want 2", imported)
+	}
+
+	// resume after block 8 of the run, failures of earlier blocks are kept
+	// and failures of later blocks are not duplicated
+	state, err := (&checkpointedBlocks{Blocks: c.Blocks[:8], Txs: c.Txs[:8]}).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := newPool()
+	pool.CheckpointDir = filepath.Join(dir, "checkpoint")
+	pool.Resume = true
+	cp := &TaskCheckpoint{Name: pool.Name, First: pool.First, Last: pool.Last, Block: 8, State: state}
+	if err := WriteTaskCheckpoint(pool.CheckpointDir, cp); err != nil {
+		t.Fatal(err)
+	}
+	resumed, err := pool.Execute()
+	if err == nil {
+		t.Fatal("no error for failed transactions after resuming")
+	}
+	if !reflect.DeepEqual(resumed, got) {
+		t.Fatalf("resumed result %+v, want %+v", resumed, got)
+	}
+	if keys := readTestFailures(t, failureFile); !reflect.DeepEqual(keys, want) {
+		t.Fatalf("failures after resuming %v, want %v", keys, want)
+	}
+}
@@ -0,0 +1,488 @@
+package research
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	cli "gopkg.in/urfave/cli.v1"
+)
+
+var FilterFlag = cli.StringFlag{
+	Name:  "filter",
+	Usage: "Execute only transactions matching the given filter expression, e.g. \"to == 0x... && status == 0\"; the field type is only guessed from the fee caps and the access list",
+}
+
+// SubstateFilter is a compiled filter expression that selects transactions
+// by the fields of their substates. Expressions compare fields with
+// literals, e.g. "to in (0x..., 0x...) && status == 0", and are combined with
+// "&&", "||", "!" and parentheses.
+//
+// Fields of 20-byte addresses, 4-byte selectors and 32-byte hashes support
+// "==", "!=" and "in":
+//
+//	to        recipient of the message, none for CREATE transactions
+//	from      sender of the message
+//	selector  first 4 bytes of the call data, none if shorter
+//	codehash  code hash of the recipient in InputAlloc, none for CREATE transactions
+//	topic     topics of all logs; "==" and "in" match if any topic matches
+//
+// Number fields support "==", "!=", "<", "<=", ">", ">=" and "in" with decimal
+// or hexadecimal literals:
+//
+//	value     value transferred by the message in wei
+//	gas       gas limit of the message
+//	gasused   gas used by the transaction
+//	status    receipt status, 1 for success and 0 for failure
+//
+// The field type supports "==", "!=" and "in" with the literals legacy, 2930
+// and 1559. Substates do not record the transaction type, so it is only a
+// guess from the message: a fee cap or tip cap different from the gas price
+// is an EIP-1559 transaction, and a non-empty access list is an EIP-2930
+// transaction. EIP-1559 transactions whose fee cap equals their tip cap pay
+// exactly the fee cap and are guessed as legacy or EIP-2930 transactions.
+// The field accesslist is true if the message has a non-empty access list.
+type SubstateFilter struct {
+	expr  string
+	match filterFunc
+}
+
+type filterFunc func(substate *Substate) bool
+
+// CompileSubstateFilter compiles a filter expression.
+func CompileSubstateFilter(expr string) (*SubstateFilter, error) {
+	tokens, err := lexFilter(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid filter %q: %v", expr, err)
+	}
+	p := &filterParser{tokens: tokens}
+	match, err := p.parseOr()
+	if err == nil && p.peek().kind != filterEOF {
+		err = p.errorf(p.peek(), "unexpected %q", p.peek().text)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid filter %q: %v", expr, err)
+	}
+	return &SubstateFilter{expr: expr, match: match}, nil
+}
+
+// ParseSubstateFilter returns the filter given by --filter, or nil if it is
+// not set.
+func ParseSubstateFilter(ctx *cli.Context) (*SubstateFilter, error) {
+	expr := strings.TrimSpace(ctx.String(FilterFlag.Name))
+	if expr == "" {
+		return nil, nil
+	}
+	return CompileSubstateFilter(expr)
+}
+
+// Match reports whether the transaction of the substate matches the filter.
+func (f *SubstateFilter) Match(substate *Substate) bool {
+	return f.match(substate)
+}
+
+func (f *SubstateFilter) String() string {
+	return f.expr
+}
+
+//
+// Fields
+//
+
+// filterBytesField returns all values of a field, e.g. no value for the
+// recipient of a CREATE transaction or all log topics.
+type filterBytesField struct {
+	size int
+	get  func(substate *Substate) [][]byte
+}
+
+var filterBytesFields = map[string]filterBytesField{
+	"to": {common.AddressLength, func(substate *Substate) [][]byte {
+		if to := substate.Message.To; to != nil {
+			return [][]byte{to.Bytes()}
+		}
+		return nil
+	}},
+	"from": {common.AddressLength, func(substate *Substate) [][]byte {
+		return [][]byte{substate.Message.From.Bytes()}
+	}},
+	"selector": {4, func(substate *Substate) [][]byte {
+		if data := substate.Message.Data; len(data) >= 4 {
+			return [][]byte{data[:4]}
+		}
+		return nil
+	}},
+	"codehash": {common.HashLength, func(substate *Substate) [][]byte {
+		to := substate.Message.To
+		if to == nil {
+			return nil
+		}
+		if account := substate.InputAlloc[*to]; account != nil {
+			return [][]byte{account.CodeHash().Bytes()}
+		}
+		return [][]byte{EmptyCodeHash.Bytes()}
+	}},
+	"topic": {common.HashLength, func(substate *Substate) [][]byte {
+		var topics [][]byte
+		for _, log := range substate.Result.Logs {
+			for _, topic := range log.Topics {
+				topics = append(topics, topic.Bytes())
+			}
+		}
+		return topics
+	}},
+}
+
+var filterNumberFields = map[string]func(substate *Substate) *big.Int{
+	"value": func(substate *Substate) *big.Int {
+		if value := substate.Message.Value; value != nil {
+			return value
+		}
+		return new(big.Int)
+	},
+	"gas": func(substate *Substate) *big.Int {
+		return new(big.Int).SetUint64(substate.Message.Gas)
+	},
+	"gasused": func(substate *Substate) *big.Int {
+		return new(big.Int).SetUint64(substate.Result.GasUsed)
+	},
+	"status": func(substate *Substate) *big.Int {
+		return new(big.Int).SetUint64(substate.Result.Status)
+	},
+}
+
+var filterBoolFields = map[string]filterFunc{
+	"accesslist": func(substate *Substate) bool {
+		return len(substate.Message.AccessList) > 0
+	},
+}
+
+// substateTxType guesses the transaction type of a substate, see
+// SubstateFilter.
+func substateTxType(substate *Substate) string {
+	msg := substate.Message
+	if msg.GasPrice != nil &&
+		(msg.GasFeeCap != nil && msg.GasFeeCap.Cmp(msg.GasPrice) != 0 ||
+			msg.GasTipCap != nil && msg.GasTipCap.Cmp(msg.GasPrice) != 0) {
+		return "1559"
+	}
+	if len(msg.AccessList) > 0 {
+		return "2930"
+	}
+	return "legacy"
+}
+
+//
+// Lexer
+//
+
+type filterTokenKind int
+
+const (
+	filterEOF    filterTokenKind = iota
+	filterWord                   // field name or literal
+	filterOp                     // comparison or logical operator
+	filterLParen                 // (
+	filterRParen                 // )
+	filterComma                  // ,
+)
+
+type filterToken struct {
+	kind filterTokenKind
+	text string
+	pos  int
+}
+
+var filterOps = []string{"==", "!=", "<=", ">=", "&&", "||", "<", ">", "!"}
+
+func isFilterWordChar(c byte) bool {
+	return c == '_' || '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+func lexFilter(expr string) ([]filterToken, error) {
+	var tokens []filterToken
+	for pos := 0; pos < len(expr); {
+		c := expr[pos]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			pos++
+		case c == '(':
+			tokens = append(tokens, filterToken{filterLParen, "(", pos})
+			pos++
+		case c == ')':
+			tokens = append(tokens, filterToken{filterRParen, ")", pos})
+			pos++
+		case c == ',':
+			tokens = append(tokens, filterToken{filterComma, ",", pos})
+			pos++
+		case isFilterWordChar(c):
+			end := pos
+			for end < len(expr) && isFilterWordChar(expr[end]) {
+				end++
+			}
+			tokens = append(tokens, filterToken{filterWord, expr[pos:end], pos})
+			pos = end
+		default:
+			op := ""
+			for _, o := range filterOps {
+				if strings.HasPrefix(expr[pos:], o) {
+					op = o
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("unexpected %q at position %v", c, pos)
+			}
+			tokens = append(tokens, filterToken{filterOp, op, pos})
+			pos += len(op)
+		}
+	}
+	return append(tokens, filterToken{filterEOF, "end of filter", len(expr)}), nil
+}
+
+//
+// Parser
+//
+
+// filterParser compiles tokens to a filterFunc by recursive descent:
+//
+//	or      = and { "||" and }
+//	and     = unary { "&&" unary }
+//	unary   = "!" unary | primary
+//	primary = "(" or ")" | field | field op literal | field "in" "(" literal { "," literal } ")"
+type filterParser struct {
+	tokens []filterToken
+	pos    int
+}
+
+func (p *filterParser) peek() filterToken {
+	return p.tokens[p.pos]
+}
+
+func (p *filterParser) next() filterToken {
+	t := p.tokens[p.pos]
+	if t.kind != filterEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *filterParser) errorf(t filterToken, format string, args ...interface{}) error {
+	return fmt.Errorf("%s at position %v", fmt.Sprintf(format, args...), t.pos)
+}
+
+func (p *filterParser) parseOr() (filterFunc, error) {
+	x, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for t := p.peek(); t.kind == filterOp && t.text == "||"; t = p.peek() {
+		p.next()
+		y, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left := x
+		x = func(substate *Substate) bool { return left(substate) || y(substate) }
+	}
+	return x, nil
+}
+
+func (p *filterParser) parseAnd() (filterFunc, error) {
+	x, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for t := p.peek(); t.kind == filterOp && t.text == "&&"; t = p.peek() {
+		p.next()
+		y, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left := x
+		x = func(substate *Substate) bool { return left(substate) && y(substate) }
+	}
+	return x, nil
+}
+
+func (p *filterParser) parseUnary() (filterFunc, error) {
+	if t := p.peek(); t.kind == filterOp && t.text == "!" {
+		p.next()
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return func(substate *Substate) bool { return !x(substate) }, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *filterParser) parsePrimary() (filterFunc, error) {
+	t := p.next()
+	switch t.kind {
+	case filterLParen:
+		x, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if r := p.next(); r.kind != filterRParen {
+			return nil, p.errorf(r, "expected \")\" but found %q", r.text)
+		}
+		return x, nil
+
+	case filterWord:
+		field := strings.ToLower(t.text)
+		if match, ok := filterBoolFields[field]; ok {
+			return match, nil
+		}
+		op, literals, err := p.parseComparison(t)
+		if err != nil {
+			return nil, err
+		}
+		if f, ok := filterBytesFields[field]; ok {
+			return compileBytesComparison(f, op, literals)
+		}
+		if get, ok := filterNumberFields[field]; ok {
+			return compileNumberComparison(get, op, literals)
+		}
+		if field == "type" {
+			return compileTypeComparison(op, literals)
+		}
+		return nil, p.errorf(t, "unknown field %q", t.text)
+
+	default:
+		return nil, p.errorf(t, "expected field but found %q", t.text)
+	}
+}
+
+// parseComparison parses the operator and literals after a field.
+func (p *filterParser) parseComparison(field filterToken) (string, []filterToken, error) {
+	t := p.next()
+	switch {
+	case t.kind == filterWord && strings.ToLower(t.text) == "in":
+		if l := p.next(); l.kind != filterLParen {
+			return "", nil, p.errorf(l, "expected \"(\" after in but found %q", l.text)
+		}
+		var literals []filterToken
+		for {
+			lit := p.next()
+			if lit.kind != filterWord {
+				return "", nil, p.errorf(lit, "expected literal but found %q", lit.text)
+			}
+			literals = append(literals, lit)
+			sep := p.next()
+			if sep.kind == filterRParen {
+				return "in", literals, nil
+			}
+			if sep.kind != filterComma {
+				return "", nil, p.errorf(sep, "expected \",\" or \")\" but found %q", sep.text)
+			}
+		}
+
+	case t.kind == filterOp && t.text != "&&" && t.text != "||" && t.text != "!":
+		lit := p.next()
+		if lit.kind != filterWord {
+			return "", nil, p.errorf(lit, "expected literal but found %q", lit.text)
+		}
+		return t.text, []filterToken{lit}, nil
+
+	default:
+		return "", nil, p.errorf(t, "expected comparison after %q but found %q", field.text, t.text)
+	}
+}
+
+func compileBytesComparison(f filterBytesField, op string, literals []filterToken) (filterFunc, error) {
+	set := make(map[string]struct{}, len(literals))
+	for _, lit := range literals {
+		b, err := hexutil.Decode(lit.text)
+		if err != nil || len(b) != f.size {
+			return nil, fmt.Errorf("invalid %v-byte hex literal %q at position %v", f.size, lit.text, lit.pos)
+		}
+		set[string(b)] = struct{}{}
+	}
+	matchAny := func(substate *Substate) bool {
+		for _, v := range f.get(substate) {
+			if _, ok := set[string(v)]; ok {
+				return true
+			}
+		}
+		return false
+	}
+
+	switch op {
+	case "==", "in":
+		return matchAny, nil
+	case "!=":
+		return func(substate *Substate) bool { return !matchAny(substate) }, nil
+	default:
+		return nil, fmt.Errorf("operator %q not supported for hex values at position %v", op, literals[0].pos)
+	}
+}
+
+func compileNumberComparison(get func(substate *Substate) *big.Int, op string, literals []filterToken) (filterFunc, error) {
+	values := make([]*big.Int, 0, len(literals))
+	for _, lit := range literals {
+		v, ok := new(big.Int).SetString(lit.text, 0)
+		if !ok || v.Sign() < 0 {
+			return nil, fmt.Errorf("invalid number %q at position %v", lit.text, lit.pos)
+		}
+		values = append(values, v)
+	}
+
+	var cmp func(c int) bool
+	switch op {
+	case "in":
+		return func(substate *Substate) bool {
+			x := get(substate)
+			for _, v := range values {
+				if x.Cmp(v) == 0 {
+					return true
+				}
+			}
+			return false
+		}, nil
+	case "==":
+		cmp = func(c int) bool { return c == 0 }
+	case "!=":
+		cmp = func(c int) bool { return c != 0 }
+	case "<":
+		cmp = func(c int) bool { return c < 0 }
+	case "<=":
+		cmp = func(c int) bool { return c <= 0 }
+	case ">":
+		cmp = func(c int) bool { return c > 0 }
+	case ">=":
+		cmp = func(c int) bool { return c >= 0 }
+	default:
+		return nil, fmt.Errorf("operator %q not supported for numbers at position %v", op, literals[0].pos)
+	}
+	v := values[0]
+	return func(substate *Substate) bool { return cmp(get(substate).Cmp(v)) }, nil
+}
+
+func compileTypeComparison(op string, literals []filterToken) (filterFunc, error) {
+	set := make(map[string]struct{}, len(literals))
+	for _, lit := range literals {
+		switch t := strings.ToLower(lit.text); t {
+		case "legacy", "2930", "1559":
+			set[t] = struct{}{}
+		default:
+			return nil, fmt.Errorf("invalid transaction type %q at position %v, expected legacy, 2930 or 1559", lit.text, lit.pos)
+		}
+	}
+	in := func(substate *Substate) bool {
+		_, ok := set[substateTxType(substate)]
+		return ok
+	}
+
+	switch op {
+	case "==", "in":
+		return in, nil
+	case "!=":
+		return func(substate *Substate) bool { return !in(substate) }, nil
+	default:
+		return nil, fmt.Errorf("operator %q not supported for type at position %v", op, literals[0].pos)
+	}
+}
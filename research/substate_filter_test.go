@@ -0,0 +1,107 @@
+package research
+
+import (
+	"fmt"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestSubstateFilterMatch(t *testing.T) {
+	// call of 0xa9059cbb from 0x01... to 0x02... with value 100, see
+	// newTestSubstate
+	call := newTestSubstate(1, false)
+	accessList := newTestSubstate(1, true)
+	dynamicFee := newTestSubstate(1, true)
+	dynamicFee.Message.GasFeeCap = big.NewInt(2)
+	create := newTestSubstate(1, false)
+	create.Message.To = nil
+
+	codeHash := crypto.Keccak256Hash(call.InputAlloc[*call.Message.To].Code)
+	tests := []struct {
+		expr     string
+		substate *Substate
+		match    bool
+	}{
+		{"to == 0x0200000000000000000000000000000000000000", call, true},
+		{"to == 0x0200000000000000000000000000000000000000", create, false},
+		{"to != 0x0200000000000000000000000000000000000000", create, true},
+		{"from in (0x0300000000000000000000000000000000000000, 0x0100000000000000000000000000000000000000)", call, true},
+		{"selector == 0xa9059cbb", call, true},
+		{"selector != 0xa9059cbb", call, false},
+		{fmt.Sprintf("codehash == %v", codeHash.Hex()), call, true},
+		{fmt.Sprintf("codehash == %v", codeHash.Hex()), create, false},
+		{"topic == 0x0c00000000000000000000000000000000000000000000000000000000000000", call, true},
+		{"value == 100", call, true},
+		{"value == 0x64", call, true},
+		{"value < 100", call, false},
+		{"value <= 100", call, true},
+		{"gas > 50000", call, false},
+		{"gas >= 50000", call, true},
+		{"gasused in (1, 30000)", call, true},
+		{"status != 1", call, false},
+		{"type == legacy", call, true},
+		{"type == 2930", accessList, true},
+		{"type in (legacy, 2930)", dynamicFee, false},
+		{"TYPE == 1559", dynamicFee, true},
+		{"accesslist", call, false},
+		{"accesslist", accessList, true},
+
+		// && binds stronger than ||
+		{"value == 100 || status == 0 && gas == 1", call, true},
+		{"(value == 100 || status == 0) && gas == 1", call, false},
+		{"status == 0 && gas == 1 || value == 100", call, true},
+		// ! binds stronger than && and ||
+		{"!status == 0 && value == 100", call, true},
+		{"!accesslist || status == 0", accessList, false},
+		{"!(value == 100 || gas == 1)", call, false},
+		{"!!accesslist", accessList, true},
+	}
+	for _, test := range tests {
+		filter, err := CompileSubstateFilter(test.expr)
+		if err != nil {
+			t.Errorf("%q: %v", test.expr, err)
+			continue
+		}
+		if match := filter.Match(test.substate); match != test.match {
+			t.Errorf("%q: match %v, want %v", test.expr, match, test.match)
+		}
+	}
+}
+
+func TestSubstateFilterErrors(t *testing.T) {
+	tests := []struct {
+		expr string
+		err  string
+	}{
+		{"", `expected field but found "end of filter" at position 0`},
+		{"status = 0", `unexpected '=' at position 7`},
+		{"value == -1", `unexpected '-' at position 9`},
+		{"foo == 1", `unknown field "foo" at position 0`},
+		{"value", `expected comparison after "value" but found "end of filter" at position 5`},
+		{"value ==", `expected literal but found "end of filter" at position 8`},
+		{"value == 100 &&", `expected field but found "end of filter" at position 15`},
+		{"value == 100 || && gas == 1", `expected field but found "&&" at position 16`},
+		{"(value == 100", `expected ")" but found "end of filter" at position 13`},
+		{"value == 100)", `unexpected ")" at position 12`},
+		{"value == 100 gas == 1", `unexpected "gas" at position 13`},
+		{"value in 1", `expected "(" after in but found "1" at position 9`},
+		{"value in (1 2)", `expected "," or ")" but found "2" at position 12`},
+		{"value in (1,)", `expected literal but found ")" at position 12`},
+		{"value == 0xzz", `invalid number "0xzz" at position 9`},
+		{"to == 0x1234", `invalid 20-byte hex literal "0x1234" at position 6`},
+		{"to < 0x0200000000000000000000000000000000000000", `operator "<" not supported for hex values at position 5`},
+		{"type == 4844", `invalid transaction type "4844" at position 8, expected legacy, 2930 or 1559`},
+		{"type > legacy", `operator ">" not supported for type at position 7`},
+	}
+	for _, test := range tests {
+		_, err := CompileSubstateFilter(test.expr)
+		want := fmt.Sprintf("invalid filter %q: %s", test.expr, test.err)
+		if err == nil {
+			t.Errorf("%q: no error, want %s", test.expr, want)
+		} else if err.Error() != want {
+			t.Errorf("%q: error %s, want %s", test.expr, err, want)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package research
+
+import (
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// SubstateFormat identifies the RLP layout of a substate value.
+//
+// Substate values are prefixed with a single format byte. RLP lists always
+// start with a byte >= 0xc0, so values written before the format byte was
+// introduced are recognized as unversioned and their layout is detected by
+// trial decoding. Use substate-cli db migrate to rewrite them. Versioned
+// values may be compressed, see SubstateCompressor.
+type SubstateFormat byte
+
+const (
+	SubstateFormatUnversioned SubstateFormat = 0x00 // no format byte, layout detected by trial decoding
+	SubstateFormatLegacy      SubstateFormat = 0x01 // Geth v1.9.x, before Berlin hard fork
+	SubstateFormatBerlin      SubstateFormat = 0x02 // Geth <= v1.10.3, EIP-2930 access lists
+	SubstateFormatLondon      SubstateFormat = 0x03 // EIP-1559 base fee and fee caps
+
+	// London layout with accounts stored once under stage1AccountPrefix and
+	// referenced by hash, see DedupAccountLayout
+	SubstateFormatLondonDedup SubstateFormat = 0x04
+
+	SubstateFormatLatest = SubstateFormatLondon
+)
+
+func (f SubstateFormat) String() string {
+	switch f {
+	case SubstateFormatUnversioned:
+		return "unversioned"
+	case SubstateFormatLegacy:
+		return "legacy"
+	case SubstateFormatBerlin:
+		return "berlin"
+	case SubstateFormatLondon:
+		return "london"
+	case SubstateFormatLondonDedup:
+		return "london-dedup"
+	default:
+		return fmt.Sprintf("unknown(%#x)", byte(f))
+	}
+}
+
+// EncodeSubstateRLP encodes substateRLP in the latest format with a format byte.
+func EncodeSubstateRLP(substateRLP *SubstateRLP) ([]byte, error) {
+	value, err := rlp.EncodeToBytes(substateRLP)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{byte(SubstateFormatLatest)}, value...), nil
+}
+
+// IsVersionedSubstateValue reports whether an uncompressed value starts with
+// a format byte.
+func IsVersionedSubstateValue(value []byte) bool {
+	return len(value) > 0 && value[0] < compressedSubstateFlag
+}
+
+// DecodeSubstateRLP decodes a substate value written in any format. It returns
+// the layout the value was stored in; for unversioned values this is the
+// layout detected by trial decoding.
+//
+// Values in SubstateFormatLondonDedup reference account records in a
+// substate DB; use SubstateDB.DecodeSubstateRLP to decode them.
+func DecodeSubstateRLP(value []byte) (*SubstateRLP, SubstateFormat, error) {
+	return decodeSubstateValue(value, nil)
+}
+
+// decodeSubstateValue decodes a substate value. db resolves account records
+// of SubstateFormatLondonDedup and may be nil for other formats.
+func decodeSubstateValue(value []byte, db *SubstateDB) (*SubstateRLP, SubstateFormat, error) {
+	if len(value) == 0 {
+		return nil, SubstateFormatUnversioned, fmt.Errorf("empty substate value")
+	}
+	value, _, err := UnwrapSubstateValue(value)
+	if err != nil {
+		return nil, SubstateFormatUnversioned, err
+	}
+	if !IsVersionedSubstateValue(value) {
+		return decodeUnversionedSubstateRLP(value)
+	}
+
+	format := SubstateFormat(value[0])
+	substateRLP, err := decodeSubstateRLPFormat(format, value[1:], db)
+	return substateRLP, format, err
+}
+
+func decodeSubstateRLPFormat(format SubstateFormat, payload []byte, db *SubstateDB) (*SubstateRLP, error) {
+	substateRLP := SubstateRLP{}
+
+	switch format {
+	case SubstateFormatLondonDedup:
+		if db == nil {
+			return nil, fmt.Errorf("substate format %v requires a substate DB to resolve accounts", format)
+		}
+		refRLP := SubstateRefRLP{}
+		if err := rlp.DecodeBytes(payload, &refRLP); err != nil {
+			return nil, err
+		}
+		if err := db.setRefRLP(&substateRLP, &refRLP); err != nil {
+			return nil, err
+		}
+
+	case SubstateFormatLondon:
+		if err := rlp.DecodeBytes(payload, &substateRLP); err != nil {
+			return nil, err
+		}
+
+	case SubstateFormatBerlin:
+		berlinRLP := berlinSubstateRLP{}
+		if err := rlp.DecodeBytes(payload, &berlinRLP); err != nil {
+			return nil, err
+		}
+		substateRLP.setBerlinRLP(&berlinRLP)
+
+	case SubstateFormatLegacy:
+		legacyRLP := legacySubstateRLP{}
+		if err := rlp.DecodeBytes(payload, &legacyRLP); err != nil {
+			return nil, err
+		}
+		substateRLP.setLegacyRLP(&legacyRLP)
+
+	default:
+		return nil, fmt.Errorf("unknown substate format %v", format)
+	}
+
+	return &substateRLP, nil
+}
+
+// decodeUnversionedSubstateRLP tries layouts from the latest hard fork to
+// the oldest one.
+func decodeUnversionedSubstateRLP(value []byte) (*SubstateRLP, SubstateFormat, error) {
+	var err error
+
+	for _, format := range []SubstateFormat{
+		SubstateFormatLondon,
+		SubstateFormatBerlin,
+		SubstateFormatLegacy,
+	} {
+		var substateRLP *SubstateRLP
+		substateRLP, err = decodeSubstateRLPFormat(format, value, nil)
+		if err == nil {
+			return substateRLP, format, nil
+		}
+	}
+
+	return nil, SubstateFormatUnversioned, err
+}
@@ -0,0 +1,243 @@
+package research
+
+import (
+	"bytes"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// newTestSubstate returns a CALL transaction substate of the given block.
+// Fields that do not exist in older formats are set to the values these
+// formats decode to, so that the substate survives a round trip through
+// every format except for the access list, which is only set if accessList
+// is true.
+func newTestSubstate(block uint64, accessList bool) *Substate {
+	from, to := common.Address{0x01}, common.Address{0x02}
+
+	code := bytes.Repeat([]byte{0x60, 0x00}, 64)
+	input := SubstateAlloc{
+		from: NewSubstateAccount(1, big.NewInt(1000), nil),
+		to:   NewSubstateAccount(0, big.NewInt(0), code),
+	}
+	input[to].Storage[common.Hash{0x01}] = common.Hash{0x02}
+	output := SubstateAlloc{
+		from: NewSubstateAccount(2, big.NewInt(900), nil),
+		to:   NewSubstateAccount(0, big.NewInt(100), code),
+	}
+	output[to].Storage[common.Hash{0x01}] = common.Hash{0x03}
+
+	env := &SubstateEnv{
+		Coinbase:    common.Address{0x09},
+		Difficulty:  big.NewInt(5),
+		GasLimit:    10_000_000,
+		Number:      block,
+		Timestamp:   1_600_000_000,
+		BlockHashes: map[uint64]common.Hash{block - 1: {0x0b}},
+	}
+	msg := &SubstateMessage{
+		Nonce:      1,
+		CheckNonce: true,
+		GasPrice:   big.NewInt(1),
+		Gas:        50_000,
+		From:       from,
+		To:         &to,
+		Value:      big.NewInt(100),
+		Data:       append([]byte{0xa9, 0x05, 0x9c, 0xbb}, bytes.Repeat([]byte{0x00}, 64)...),
+		GasFeeCap:  big.NewInt(1),
+		GasTipCap:  big.NewInt(1),
+	}
+	if accessList {
+		msg.AccessList = types.AccessList{{Address: to, StorageKeys: []common.Hash{{0x01}}}}
+	}
+	result := &SubstateResult{
+		Status:  types.ReceiptStatusSuccessful,
+		Logs:    []*types.Log{{Address: to, Topics: []common.Hash{{0x0c}}, Data: []byte{0x01}}},
+		GasUsed: 30_000,
+	}
+	return NewSubstate(input, output, env, msg, result)
+}
+
+// encodeTestSubstateFormat encodes a substate in an inline format as it was
+// written by the recorder of that format.
+func encodeTestSubstateFormat(t *testing.T, format SubstateFormat, substate *Substate) []byte {
+	substateRLP := NewSubstateRLP(substate)
+	env := &legacySubstateEnvRLP{
+		Coinbase:    substateRLP.Env.Coinbase,
+		Difficulty:  substateRLP.Env.Difficulty,
+		GasLimit:    substateRLP.Env.GasLimit,
+		Number:      substateRLP.Env.Number,
+		Timestamp:   substateRLP.Env.Timestamp,
+		BlockHashes: substateRLP.Env.BlockHashes,
+	}
+	msg := substateRLP.Message
+
+	var v interface{}
+	switch format {
+	case SubstateFormatUnversioned, SubstateFormatLondon:
+		v = substateRLP
+	case SubstateFormatBerlin:
+		v = &berlinSubstateRLP{
+			InputAlloc:  substateRLP.InputAlloc,
+			OutputAlloc: substateRLP.OutputAlloc,
+			Env:         env,
+			Message: &berlinSubstateMessageRLP{
+				Nonce: msg.Nonce, CheckNonce: msg.CheckNonce, GasPrice: msg.GasPrice, Gas: msg.Gas,
+				From: msg.From, To: msg.To, Value: msg.Value, Data: msg.Data,
+				InitCodeHash: msg.InitCodeHash, AccessList: msg.AccessList,
+			},
+			Result: substateRLP.Result,
+		}
+	case SubstateFormatLegacy:
+		v = &legacySubstateRLP{
+			InputAlloc:  substateRLP.InputAlloc,
+			OutputAlloc: substateRLP.OutputAlloc,
+			Env:         env,
+			Message: &legacySubstateMessageRLP{
+				Nonce: msg.Nonce, CheckNonce: msg.CheckNonce, GasPrice: msg.GasPrice, Gas: msg.Gas,
+				From: msg.From, To: msg.To, Value: msg.Value, Data: msg.Data,
+				InitCodeHash: msg.InitCodeHash,
+			},
+			Result: substateRLP.Result,
+		}
+	default:
+		t.Fatalf("cannot encode format %v", format)
+	}
+
+	value, err := rlp.EncodeToBytes(v)
+	if err != nil {
+		t.Fatalf("error encoding format %v: %v", format, err)
+	}
+	if format == SubstateFormatUnversioned {
+		return value
+	}
+	return append([]byte{byte(format)}, value...)
+}
+
+// storedSubstateFormat returns the format byte of a stored substate value
+// and whether the value is compressed.
+func storedSubstateFormat(t *testing.T, db *SubstateDB, block uint64, tx int) (SubstateFormat, bool) {
+	value, err := db.backend.Get(Stage1SubstateKey(block, tx))
+	if err != nil {
+		t.Fatalf("substate %v_%v not found: %v", block, tx, err)
+	}
+	inner, c, err := UnwrapSubstateValue(value)
+	if err != nil {
+		t.Fatalf("substate %v_%v: %v", block, tx, err)
+	}
+	if !IsVersionedSubstateValue(inner) {
+		return SubstateFormatUnversioned, c != nil
+	}
+	return SubstateFormat(inner[0]), c != nil
+}
+
+func TestSubstateFormatMigrate(t *testing.T) {
+	snappy, err := SubstateCompressorByName("snappy")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		format     SubstateFormat
+		accessList bool // access lists are decoded from the London format on
+	}{
+		{SubstateFormatUnversioned, true},
+		{SubstateFormatLegacy, false},
+		{SubstateFormatBerlin, false},
+		{SubstateFormatLondon, true},
+		{SubstateFormatLondonDedup, true},
+	}
+	for _, test := range tests {
+		for _, compressor := range []SubstateCompressor{nil, snappy} {
+			name := test.format.String()
+			if compressor != nil {
+				name += "-" + compressor.Name()
+			}
+			t.Run(name, func(t *testing.T) {
+				db := NewSubstateDB(rawdb.NewMemoryDatabase())
+				db.SetCompressor(compressor)
+				substate := newTestSubstate(10, test.accessList)
+
+				if test.format == SubstateFormatLondonDedup {
+					db.SetLayout(DedupAccountLayout)
+					if err := db.PutSubstate(10, 0, substate); err != nil {
+						t.Fatal(err)
+					}
+				} else {
+					for _, account := range substate.InputAlloc {
+						if err := putCode(db.backend, account.Code); err != nil {
+							t.Fatal(err)
+						}
+					}
+					value, err := WrapSubstateValue(encodeTestSubstateFormat(t, test.format, substate), compressor)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if err := db.backend.Put(Stage1SubstateKey(10, 0), value); err != nil {
+						t.Fatal(err)
+					}
+				}
+				format, compressed := storedSubstateFormat(t, db, 10, 0)
+				if format != test.format || compressed != (compressor != nil) {
+					t.Fatalf("stored format %v compressed %v, want %v compressed %v", format, compressed, test.format, compressor != nil)
+				}
+
+				decoded, err := db.GetSubstate(10, 0)
+				if err != nil {
+					t.Fatalf("error decoding: %v", err)
+				}
+				if !decoded.Equal(substate) {
+					_, fields := DiffSubstates(substate, decoded)
+					t.Fatalf("decoded substate differs: %v", fields)
+				}
+
+				// values keep their compression when migrated by a
+				// substate DB without compressor, like db migrate
+				db.SetCompressor(nil)
+				formats, rewritten, err := db.MigrateSubstates()
+				if err != nil {
+					t.Fatalf("error migrating: %v", err)
+				}
+				detected := test.format
+				if detected == SubstateFormatUnversioned {
+					detected = SubstateFormatLondon
+				}
+				if formats[detected] != 1 {
+					t.Fatalf("formats %v, want 1 substate in %v", formats, detected)
+				}
+				wantRewritten := int64(1)
+				if test.format == SubstateFormatLondon || test.format == SubstateFormatLondonDedup {
+					wantRewritten = 0
+				}
+				if rewritten != wantRewritten {
+					t.Fatalf("rewritten %v, want %v", rewritten, wantRewritten)
+				}
+
+				wantFormat := SubstateFormatLatest
+				if test.format == SubstateFormatLondonDedup {
+					wantFormat = SubstateFormatLondonDedup
+				}
+				format, compressed = storedSubstateFormat(t, db, 10, 0)
+				if format != wantFormat || compressed != (compressor != nil) {
+					t.Fatalf("migrated format %v compressed %v, want %v compressed %v", format, compressed, wantFormat, compressor != nil)
+				}
+				migrated, err := db.GetSubstate(10, 0)
+				if err != nil {
+					t.Fatalf("error decoding migrated substate: %v", err)
+				}
+				if !migrated.Equal(substate) {
+					_, fields := DiffSubstates(substate, migrated)
+					t.Fatalf("migrated substate differs: %v", fields)
+				}
+
+				if _, rewritten, err = db.MigrateSubstates(); err != nil || rewritten != 0 {
+					t.Fatalf("second migration rewrote %v substates, error %v", rewritten, err)
+				}
+			})
+		}
+	}
+}
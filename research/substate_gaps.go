@@ -0,0 +1,251 @@
+package research
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Kinds of gaps reported by FindGaps
+const (
+	NoSubstatesGap = "no-substates" // blocks without substates that are not known to be empty
+	MissingTxGap   = "tx-gap"       // missing transaction indices within a block
+	TxCountGap     = "tx-count"     // number of substates differs from the number of transactions of the block
+)
+
+// GapFinding is a gap found by FindGaps in the blocks from First to Last
+// (inclusive).
+type GapFinding struct {
+	Kind   string `json:"kind"`
+	First  uint64 `json:"first"`
+	Last   uint64 `json:"last"`
+	Detail string `json:"detail"`
+}
+
+func (f *GapFinding) String() string {
+	if f.First == f.Last {
+		return fmt.Sprintf("%v: %s: %s", f.First, f.Kind, f.Detail)
+	}
+	return fmt.Sprintf("%v-%v: %s: %s", f.First, f.Last, f.Kind, f.Detail)
+}
+
+// GapStats counts what FindGaps checked.
+type GapStats struct {
+	NumBlocks    int64           // blocks with substates
+	NumSubstates int64           // substates checked
+	NumFindings  int64           // gaps reported
+	Missing      []BlockInterval // blocks of all gaps, to be recorded again
+}
+
+// FindGaps checks that the substate DB covers the blocks from first to last
+// (inclusive) completely and calls report for every gap found. If txCount is
+// nil, blocks without substates are gaps unless they are recorded blocks of
+// the substate DB, see AddRecordedBlocks. Otherwise txCount returns the
+// number of transactions of a block, and blocks whose number of substates
+// differs from it are gaps. Missing transaction indices are always gaps,
+// including indices after the last substate of a block if its BlockSummary
+// counts more transactions. Transactions that the BlockSummary marks as
+// pruned are not gaps.
+func (db *SubstateDB) FindGaps(first, last uint64, txCount func(block uint64) (int, error), report func(*GapFinding)) (*GapStats, error) {
+	stats := &GapStats{Missing: []BlockInterval{}}
+	emit := func(f *GapFinding) {
+		stats.NumFindings++
+		stats.Missing = AddBlockInterval(stats.Missing, f.First, f.Last)
+		report(f)
+	}
+
+	recorded, err := db.getRecordedBlocks()
+	if err != nil {
+		return stats, err
+	}
+	recorded = IntersectBlockIntervals(recorded, first, last)
+	isRecorded := func(block uint64) bool {
+		// blocks are checked in ascending order
+		for len(recorded) > 0 && recorded[0].Last < block {
+			recorded = recorded[1:]
+		}
+		return len(recorded) > 0 && recorded[0].First <= block
+	}
+
+	// run is the current run of consecutive blocks without substates
+	var run *GapFinding
+	var runTxs int
+	flushRun := func() {
+		if run == nil {
+			return
+		}
+		if txCount != nil {
+			run.Detail = fmt.Sprintf("no substates for %v transactions", runTxs)
+		} else {
+			run.Detail = "no substates in blocks not recorded"
+		}
+		emit(run)
+		run, runTxs = nil, 0
+	}
+
+	// checkBlock checks the number of substates of a block. numPruned is the
+	// number of pruned transactions of the block, or -1 to read it from the
+	// block summary if needed.
+	checkBlock := func(block uint64, numSubstates, numPruned int) error {
+		numTxs := -1
+		if txCount != nil {
+			var err error
+			numTxs, err = txCount(block)
+			if err != nil {
+				return fmt.Errorf("record-replay: error counting transactions of block %v: %v", block, err)
+			}
+		}
+		if numPruned < 0 {
+			numPruned = 0
+			if numTxs > 0 {
+				summary, err := db.GetBlockSummary(block)
+				if err != nil {
+					return err
+				}
+				if summary != nil {
+					numPruned = len(summary.PrunedTxs)
+				}
+			}
+		}
+
+		if numSubstates == 0 && numPruned == 0 && (numTxs > 0 || (numTxs < 0 && !isRecorded(block))) {
+			if run == nil || run.Last+1 != block {
+				flushRun()
+				run = &GapFinding{Kind: NoSubstatesGap, First: block, Last: block}
+			}
+			run.Last = block
+			if numTxs > 0 {
+				runTxs += numTxs
+			}
+			return nil
+		}
+		flushRun()
+
+		if numSubstates+numPruned > 0 && numTxs >= 0 && numSubstates+numPruned != numTxs {
+			detail := fmt.Sprintf("%v substates for %v transactions", numSubstates, numTxs)
+			if numPruned > 0 {
+				detail = fmt.Sprintf("%v substates and %v pruned for %v transactions", numSubstates, numPruned, numTxs)
+			}
+			emit(&GapFinding{Kind: TxCountGap, First: block, Last: block, Detail: detail})
+		}
+		return nil
+	}
+
+	var (
+		curBlock     uint64
+		nextTx       int
+		numSubstates int
+		started      bool
+		summary      *BlockSummary // summary of curBlock, nil if it has none
+	)
+
+	// missingTxs reports transactions from tx to last (inclusive) of
+	// curBlock except pruned ones.
+	missingTxs := func(tx, last int) {
+		summary.missingTxs(tx, last, func(tx, end int) {
+			detail := fmt.Sprintf("missing tx %v", tx)
+			if end > tx {
+				detail = fmt.Sprintf("missing tx %v to %v", tx, end)
+			}
+			emit(&GapFinding{Kind: MissingTxGap, First: curBlock, Last: curBlock, Detail: detail})
+		})
+	}
+
+	// endBlock reports transactions after the last substate of curBlock
+	// counted by its summary and checks the number of substates.
+	endBlock := func() error {
+		if summary == nil {
+			return checkBlock(curBlock, numSubstates, 0)
+		}
+		missingTxs(nextTx, int(summary.NumTxs)+len(summary.PrunedTxs)-1)
+		return checkBlock(curBlock, numSubstates, len(summary.PrunedTxs))
+	}
+
+	block := first // next block to check
+
+	start := make([]byte, 8)
+	binary.BigEndian.PutUint64(start, first)
+	iter := db.backend.NewIterator([]byte(stage1SubstatePrefix), start)
+	defer iter.Release()
+
+	for iter.Next() {
+		key := iter.Key()
+		b, tx, err := DecodeStage1SubstateKey(key)
+		if err != nil {
+			return stats, fmt.Errorf("record-replay: invalid substate key %#x: %v", key, err)
+		}
+		if b > last {
+			break
+		}
+
+		if !started || b != curBlock {
+			if started {
+				if err := endBlock(); err != nil {
+					return stats, err
+				}
+			}
+			for ; block < b; block++ {
+				if err := checkBlock(block, 0, -1); err != nil {
+					return stats, err
+				}
+			}
+			flushRun()
+			started = true
+			curBlock, nextTx, numSubstates = b, 0, 0
+			block = b + 1
+			stats.NumBlocks++
+
+			summary, err = db.GetBlockSummary(b)
+			if err != nil {
+				return stats, err
+			}
+		}
+
+		// check contiguous tx indices
+		missingTxs(nextTx, tx-1)
+		nextTx = tx + 1
+		numSubstates++
+		stats.NumSubstates++
+	}
+	if err := iter.Error(); err != nil {
+		return stats, err
+	}
+
+	if started {
+		if err := endBlock(); err != nil {
+			return stats, err
+		}
+	}
+	for ; block <= last; block++ {
+		if err := checkBlock(block, 0, -1); err != nil {
+			return stats, err
+		}
+		if block == last {
+			break // block++ would overflow if last is math.MaxUint64
+		}
+	}
+	flushRun()
+
+	return stats, nil
+}
+
+// FindSelectedGaps checks the blocks of keys like FindGaps, e.g. the blocks
+// of substates selected by SelectSubstates. Keys must be in ascending order.
+func (db *SubstateDB) FindSelectedGaps(keys []SubstateKey, txCount func(block uint64) (int, error), report func(*GapFinding)) (*GapStats, error) {
+	stats := &GapStats{Missing: []BlockInterval{}}
+	for i, key := range keys {
+		if i > 0 && key.Block == keys[i-1].Block {
+			continue
+		}
+		blockStats, err := db.FindGaps(key.Block, key.Block, txCount, report)
+		stats.NumBlocks += blockStats.NumBlocks
+		stats.NumSubstates += blockStats.NumSubstates
+		stats.NumFindings += blockStats.NumFindings
+		for _, interval := range blockStats.Missing {
+			stats.Missing = AddBlockInterval(stats.Missing, interval.First, interval.Last)
+		}
+		if err != nil {
+			return stats, err
+		}
+	}
+	return stats, nil
+}
@@ -0,0 +1,129 @@
+package research
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/core/rawdb"
+)
+
+// newTestTransferSubstate returns newTestSubstate sent to an account
+// without code.
+func newTestTransferSubstate(block uint64) *Substate {
+	substate := newTestSubstate(block, false)
+	to := *substate.Message.To
+	substate.InputAlloc[to].Code = nil
+	substate.OutputAlloc[to].Code = nil
+	return substate
+}
+
+func TestFindGaps(t *testing.T) {
+	db := NewSubstateDB(rawdb.NewMemoryDatabase())
+	put := func(block uint64, tx int, substate *Substate) {
+		if err := db.PutSubstate(block, tx, substate); err != nil {
+			t.Fatal(err)
+		}
+	}
+	put(10, 0, newTestSubstate(10, false))
+	put(10, 1, newTestSubstate(10, false))
+	put(10, 2, newTestSubstate(10, false))
+	put(11, 0, newTestSubstate(11, false)) // tx 1 missing
+	put(11, 2, newTestSubstate(11, false))
+	put(12, 0, newTestSubstate(12, false)) // txs 1 and 2 missing at the end
+	put(13, 0, newTestSubstate(13, false)) // txs 1 and 2 pruned
+	put(13, 1, newTestTransferSubstate(13))
+	put(13, 2, newTestTransferSubstate(13))
+	put(14, 0, newTestTransferSubstate(14)) // all txs pruned
+	put(14, 1, newTestTransferSubstate(14))
+	if _, err := db.Reindex(10, 14, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutBlockSummary(12, &BlockSummary{NumTxs: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddRecordedBlocks(10, 15); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.PruneSubstates(10, 14, []SubstateTxKind{TransferTx}, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	summary, err := db.GetBlockSummary(13)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []uint64{1, 2}; summary == nil || summary.NumTxs != 1 || !reflect.DeepEqual(summary.PrunedTxs, want) {
+		t.Fatalf("summary of block 13 %+v, want 1 tx and pruned txs %v", summary, want)
+	}
+
+	numTxs := map[uint64]int{10: 3, 11: 3, 12: 3, 13: 3, 14: 2, 15: 0}
+	tests := []struct {
+		name    string
+		txCount func(block uint64) (int, error)
+		want    []GapFinding
+	}{
+		{
+			name: "summary",
+			want: []GapFinding{
+				{Kind: MissingTxGap, First: 11, Last: 11, Detail: "missing tx 1"},
+				{Kind: MissingTxGap, First: 12, Last: 12, Detail: "missing tx 1 to 2"},
+			},
+		},
+		{
+			name:    "datadir",
+			txCount: func(block uint64) (int, error) { return numTxs[block], nil },
+			want: []GapFinding{
+				{Kind: MissingTxGap, First: 11, Last: 11, Detail: "missing tx 1"},
+				{Kind: TxCountGap, First: 11, Last: 11, Detail: "2 substates for 3 transactions"},
+				{Kind: MissingTxGap, First: 12, Last: 12, Detail: "missing tx 1 to 2"},
+				{Kind: TxCountGap, First: 12, Last: 12, Detail: "1 substates for 3 transactions"},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var findings []GapFinding
+			stats, err := db.FindGaps(10, 15, test.txCount, func(f *GapFinding) {
+				findings = append(findings, *f)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(findings, test.want) {
+				t.Fatalf("findings %v, want %v", findings, test.want)
+			}
+			if want := []BlockInterval{{11, 12}}; !reflect.DeepEqual(stats.Missing, want) {
+				t.Fatalf("missing blocks %v, want %v", stats.Missing, want)
+			}
+		})
+	}
+}
+
+func TestFindSelectedGaps(t *testing.T) {
+	db := NewSubstateDB(rawdb.NewMemoryDatabase())
+	for _, key := range []SubstateKey{{10, 0}, {10, 1}, {11, 0}, {11, 2}, {12, 0}, {12, 2}} {
+		if err := db.PutSubstate(key.Block, key.Tx, newTestSubstate(key.Block, false)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// block 11 is not checked, block 12 is checked once
+	var findings []GapFinding
+	keys := []SubstateKey{{10, 1}, {12, 0}, {12, 2}}
+	stats, err := db.FindSelectedGaps(keys, nil, func(f *GapFinding) {
+		findings = append(findings, *f)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []GapFinding{{Kind: MissingTxGap, First: 12, Last: 12, Detail: "missing tx 1"}}
+	if !reflect.DeepEqual(findings, want) {
+		t.Fatalf("findings %v, want %v", findings, want)
+	}
+	if stats.NumBlocks != 2 || stats.NumSubstates != 4 || stats.NumFindings != 1 {
+		t.Fatalf("stats %+v, want 4 substates of 2 blocks and 1 finding", stats)
+	}
+	if want := []BlockInterval{{12, 12}}; !reflect.DeepEqual(stats.Missing, want) {
+		t.Fatalf("missing blocks %v, want %v", stats.Missing, want)
+	}
+}
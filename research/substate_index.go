@@ -0,0 +1,466 @@
+package research
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/ethdb"
+	cli "gopkg.in/urfave/cli.v1"
+)
+
+var (
+	TxHashFlag = cli.StringFlag{
+		Name:  "tx-hash",
+		Usage: "Select only transactions with the given comma-separated hashes",
+	}
+	AddressFlag = cli.StringFlag{
+		Name:  "address",
+		Usage: "Select only transactions that touched any of the given comma-separated addresses",
+	}
+)
+
+// SubstateKey identifies the substate of a transaction.
+type SubstateKey struct {
+	Block uint64
+	Tx    int
+}
+
+func (k SubstateKey) String() string {
+	return fmt.Sprintf("%v_%v", k.Block, k.Tx)
+}
+
+func Stage1TxHashKey(block uint64, tx int) []byte {
+	key := Stage1SubstateKey(block, tx)
+	copy(key, stage1TxHashPrefix)
+	return key
+}
+
+func Stage1TxIndexKey(txHash common.Hash) []byte {
+	prefix := []byte(stage1TxIndexPrefix)
+	return append(prefix, txHash.Bytes()...)
+}
+
+func Stage1AddressIndexKey(addr common.Address, block uint64, tx int) []byte {
+	prefix := []byte(stage1AddressIndexPrefix)
+
+	blockTx := make([]byte, 16)
+	binary.BigEndian.PutUint64(blockTx[0:8], block)
+	binary.BigEndian.PutUint64(blockTx[8:16], uint64(tx))
+
+	return append(append(prefix, addr.Bytes()...), blockTx...)
+}
+
+func DecodeStage1AddressIndexKey(key []byte) (addr common.Address, block uint64, tx int, err error) {
+	prefix := stage1AddressIndexPrefix
+	if len(key) != len(prefix)+20+8+8 {
+		err = fmt.Errorf("invalid length of stage1 address index key: %v", len(key))
+		return
+	}
+	if p := string(key[:len(prefix)]); p != prefix {
+		err = fmt.Errorf("invalid prefix of stage1 address index key: %#x", p)
+		return
+	}
+	addr = common.BytesToAddress(key[len(prefix) : len(prefix)+20])
+	blockTx := key[len(prefix)+20:]
+	block = binary.BigEndian.Uint64(blockTx[0:8])
+	tx = int(binary.BigEndian.Uint64(blockTx[8:16]))
+	return
+}
+
+// PutTxHash stores the hash of a transaction with its substate and indexes
+// the transaction by hash.
+func (db *SubstateDB) PutTxHash(block uint64, tx int, txHash common.Hash) error {
+	batch := db.backend.NewBatch()
+	if err := putTxHash(batch, block, tx, txHash); err != nil {
+		return &SubstateError{Block: block, Tx: tx, Err: err}
+	}
+	if err := batch.Write(); err != nil {
+		return &SubstateError{Block: block, Tx: tx, Err: fmt.Errorf("error putting tx hash: %v", err)}
+	}
+	return nil
+}
+
+func putTxHash(w ethdb.KeyValueWriter, block uint64, tx int, txHash common.Hash) error {
+	if err := w.Put(Stage1TxHashKey(block, tx), txHash.Bytes()); err != nil {
+		return err
+	}
+	return w.Put(Stage1TxIndexKey(txHash), Stage1SubstateKey(block, tx)[len(stage1SubstatePrefix):])
+}
+
+// GetTxHash returns the hash of a transaction, or the zero hash if it was
+// not stored.
+func (db *SubstateDB) GetTxHash(block uint64, tx int) (common.Hash, error) {
+	key := Stage1TxHashKey(block, tx)
+	has, err := db.backend.Has(key)
+	if err != nil || !has {
+		return common.Hash{}, err
+	}
+	value, err := db.backend.Get(key)
+	if err != nil {
+		return common.Hash{}, &SubstateError{Block: block, Tx: tx, Err: fmt.Errorf("error getting tx hash: %v", err)}
+	}
+	return common.BytesToHash(value), nil
+}
+
+// FindTx returns the block and transaction number of a transaction hash.
+// found is false if the hash is not indexed.
+func (db *SubstateDB) FindTx(txHash common.Hash) (block uint64, tx int, found bool, err error) {
+	key := Stage1TxIndexKey(txHash)
+	has, err := db.backend.Has(key)
+	if err != nil || !has {
+		return 0, 0, false, err
+	}
+	value, err := db.backend.Get(key)
+	if err != nil {
+		return 0, 0, false, fmt.Errorf("record-replay: error getting tx %s: %v", txHash.Hex(), err)
+	}
+	block, tx, err = DecodeStage1SubstateKey(append([]byte(stage1SubstatePrefix), value...))
+	if err != nil {
+		return 0, 0, false, fmt.Errorf("record-replay: invalid index of tx %s: %v", txHash.Hex(), err)
+	}
+	return block, tx, true, nil
+}
+
+// substateAddresses returns distinct addresses of InputAlloc, OutputAlloc
+// and Message.To of a substate.
+func substateAddresses(substateRLP *SubstateRLP) []common.Address {
+	var addrs []common.Address
+	seen := make(map[common.Address]struct{})
+	add := func(addr common.Address) {
+		if _, exist := seen[addr]; !exist {
+			seen[addr] = struct{}{}
+			addrs = append(addrs, addr)
+		}
+	}
+	for _, addr := range substateRLP.InputAlloc.Addresses {
+		add(addr)
+	}
+	for _, addr := range substateRLP.OutputAlloc.Addresses {
+		add(addr)
+	}
+	if msgRLP := substateRLP.Message; msgRLP != nil && msgRLP.To != nil {
+		add(*msgRLP.To)
+	}
+	return addrs
+}
+
+func putAddressIndex(w ethdb.KeyValueWriter, block uint64, tx int, substateRLP *SubstateRLP) error {
+	for _, addr := range substateAddresses(substateRLP) {
+		if err := w.Put(Stage1AddressIndexKey(addr, block, tx), nil); err != nil {
+			return fmt.Errorf("error putting address index: %v", err)
+		}
+	}
+	return nil
+}
+
+// deleteSubstateIndex deletes the tx hash and index entries of a
+// transaction. value is the substate value of the transaction; address
+// index entries are kept if it cannot be decoded.
+func (db *SubstateDB) deleteSubstateIndex(w ethdb.KeyValueWriter, block uint64, tx int, value []byte) error {
+	txHash, err := db.GetTxHash(block, tx)
+	if err != nil {
+		return err
+	}
+	if txHash != (common.Hash{}) {
+		if err := w.Delete(Stage1TxHashKey(block, tx)); err != nil {
+			return err
+		}
+		if err := w.Delete(Stage1TxIndexKey(txHash)); err != nil {
+			return err
+		}
+	}
+
+	substateRLP, _, err := db.DecodeSubstateRLP(value)
+	if err != nil {
+		return nil
+	}
+	for _, addr := range substateAddresses(substateRLP) {
+		if err := w.Delete(Stage1AddressIndexKey(addr, block, tx)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetAddressSubstates returns keys of substates from block first to block
+// last (inclusive) that touched addr in ascending order.
+func (db *SubstateDB) GetAddressSubstates(addr common.Address, first, last uint64) ([]SubstateKey, error) {
+	var keys []SubstateKey
+
+	prefix := append([]byte(stage1AddressIndexPrefix), addr.Bytes()...)
+	start := make([]byte, 8)
+	binary.BigEndian.PutUint64(start, first)
+	iter := db.backend.NewIterator(prefix, start)
+	defer iter.Release()
+
+	for iter.Next() {
+		key := iter.Key()
+		_, block, tx, err := DecodeStage1AddressIndexKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("record-replay: invalid address index key %#x: %v", key, err)
+		}
+		if block > last {
+			break
+		}
+		keys = append(keys, SubstateKey{Block: block, Tx: tx})
+	}
+	if err := iter.Error(); err != nil {
+		return nil, fmt.Errorf("record-replay: error iterating address index of %s: %v", addr.Hex(), err)
+	}
+
+	return keys, nil
+}
+
+// IndexAddresses rewrites address index entries of substates from block
+// first to block last (inclusive).
+func (db *SubstateDB) IndexAddresses(first, last uint64) (indexed int64, err error) {
+	batch := db.backend.NewBatch()
+
+	start := make([]byte, 8)
+	binary.BigEndian.PutUint64(start, first)
+	iter := db.backend.NewIterator([]byte(stage1SubstatePrefix), start)
+	defer iter.Release()
+
+	for iter.Next() {
+		key := iter.Key()
+		block, tx, err := DecodeStage1SubstateKey(key)
+		if err != nil {
+			return indexed, fmt.Errorf("record-replay: invalid substate key %#x: %v", key, err)
+		}
+		if block > last {
+			break
+		}
+		substateRLP, _, err := db.DecodeSubstateRLP(iter.Value())
+		if err != nil {
+			return indexed, &SubstateError{Block: block, Tx: tx, Err: err}
+		}
+		if err := putAddressIndex(batch, block, tx, substateRLP); err != nil {
+			return indexed, &SubstateError{Block: block, Tx: tx, Err: err}
+		}
+		indexed++
+		if indexed%1_000_000 == 0 {
+			fmt.Printf("record-replay: index addresses: %dM substates, at block %v\n", indexed/1_000_000, block)
+		}
+		if batch.ValueSize() >= ethdb.IdealBatchSize {
+			if err := batch.Write(); err != nil {
+				return indexed, err
+			}
+			batch.Reset()
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return indexed, err
+	}
+
+	return indexed, batch.Write()
+}
+
+// IndexTxHashes stores hashes of transactions with substates from block
+// first to block last (inclusive). txHashes returns the hashes of all
+// transactions of a block in order, e.g. read from the recorded chain.
+func (db *SubstateDB) IndexTxHashes(first, last uint64, txHashes func(block uint64) ([]common.Hash, error)) (indexed int64, err error) {
+	batch := db.backend.NewBatch()
+
+	start := make([]byte, 8)
+	binary.BigEndian.PutUint64(start, first)
+	iter := db.backend.NewIterator([]byte(stage1SubstatePrefix), start)
+	defer iter.Release()
+
+	var (
+		curBlock uint64
+		hashes   []common.Hash
+		started  bool
+	)
+	for iter.Next() {
+		key := iter.Key()
+		block, tx, err := DecodeStage1SubstateKey(key)
+		if err != nil {
+			return indexed, fmt.Errorf("record-replay: invalid substate key %#x: %v", key, err)
+		}
+		if block > last {
+			break
+		}
+		if !started || block != curBlock {
+			started, curBlock = true, block
+			hashes, err = txHashes(block)
+			if err != nil {
+				return indexed, fmt.Errorf("record-replay: error getting tx hashes of block %v: %v", block, err)
+			}
+		}
+		if tx >= len(hashes) {
+			return indexed, &SubstateError{Block: block, Tx: tx, Err: fmt.Errorf("block has only %v transactions", len(hashes))}
+		}
+		if err := putTxHash(batch, block, tx, hashes[tx]); err != nil {
+			return indexed, &SubstateError{Block: block, Tx: tx, Err: err}
+		}
+		indexed++
+		if indexed%1_000_000 == 0 {
+			fmt.Printf("record-replay: index tx hashes: %dM substates, at block %v\n", indexed/1_000_000, block)
+		}
+		if batch.ValueSize() >= ethdb.IdealBatchSize {
+			if err := batch.Write(); err != nil {
+				return indexed, err
+			}
+			batch.Reset()
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return indexed, err
+	}
+
+	return indexed, batch.Write()
+}
+
+// ForEachTxHash calls fn for stored hashes of transactions from block first
+// to block last (inclusive) in key order.
+func (db *SubstateDB) ForEachTxHash(first, last uint64, fn func(block uint64, tx int, txHash common.Hash) error) error {
+	start := make([]byte, 8)
+	binary.BigEndian.PutUint64(start, first)
+	iter := db.backend.NewIterator([]byte(stage1TxHashPrefix), start)
+	defer iter.Release()
+
+	for iter.Next() {
+		key := iter.Key()
+		block, tx, err := DecodeStage1SubstateKey(append([]byte(stage1SubstatePrefix), key[len(stage1TxHashPrefix):]...))
+		if err != nil {
+			return fmt.Errorf("record-replay: invalid tx hash key %#x: %v", key, err)
+		}
+		if block > last {
+			break
+		}
+		if err := fn(block, tx, common.BytesToHash(iter.Value())); err != nil {
+			return err
+		}
+	}
+	return iter.Error()
+}
+
+// CopyTxHashes copies stored hashes of transactions from block first to
+// block last (inclusive) of src that are missing in the substate DB.
+func (db *SubstateDB) CopyTxHashes(src *SubstateDB, first, last uint64) (copied int64, err error) {
+	batch := db.backend.NewBatch()
+	err = src.ForEachTxHash(first, last, func(block uint64, tx int, txHash common.Hash) error {
+		has, err := db.backend.Has(Stage1TxHashKey(block, tx))
+		if err != nil || has {
+			return err
+		}
+		if err := putTxHash(batch, block, tx, txHash); err != nil {
+			return &SubstateError{Block: block, Tx: tx, Err: err}
+		}
+		copied++
+		if batch.ValueSize() >= ethdb.IdealBatchSize {
+			if err := batch.Write(); err != nil {
+				return err
+			}
+			batch.Reset()
+		}
+		return nil
+	})
+	if err != nil {
+		return copied, err
+	}
+	return copied, batch.Write()
+}
+
+// SubstateSelector selects transactions by hash or by touched address
+// instead of all transactions of a block range.
+type SubstateSelector struct {
+	TxHashes  []common.Hash
+	Addresses []common.Address
+}
+
+// ParseSubstateSelector returns the selector given by --tx-hash and
+// --address flags, or nil if neither is set.
+func ParseSubstateSelector(ctx *cli.Context) (*SubstateSelector, error) {
+	sel := &SubstateSelector{}
+	for _, s := range splitFlagList(ctx.String(TxHashFlag.Name)) {
+		b, err := hexutil.Decode(s)
+		if err != nil || len(b) != common.HashLength {
+			return nil, fmt.Errorf("invalid transaction hash %q", s)
+		}
+		sel.TxHashes = append(sel.TxHashes, common.BytesToHash(b))
+	}
+	for _, s := range splitFlagList(ctx.String(AddressFlag.Name)) {
+		if !common.IsHexAddress(s) {
+			return nil, fmt.Errorf("invalid address %q", s)
+		}
+		sel.Addresses = append(sel.Addresses, common.HexToAddress(s))
+	}
+	if len(sel.TxHashes) == 0 && len(sel.Addresses) == 0 {
+		return nil, nil
+	}
+	return sel, nil
+}
+
+func splitFlagList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// SelectedBlockRange returns the first and last block with substates
+// selected by sel.
+func (db *SubstateDB) SelectedBlockRange(sel *SubstateSelector) (first, last uint64, err error) {
+	keys, err := db.SelectSubstates(sel, 0, math.MaxUint64)
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(keys) == 0 {
+		return 0, 0, fmt.Errorf("record-replay: no substates selected")
+	}
+	return keys[0].Block, keys[len(keys)-1].Block, nil
+}
+
+// SelectSubstates returns keys of substates from block first to block last
+// (inclusive) selected by sel in ascending order. Transaction hashes that
+// are not indexed are reported as an error.
+func (db *SubstateDB) SelectSubstates(sel *SubstateSelector, first, last uint64) ([]SubstateKey, error) {
+	selected := make(map[SubstateKey]struct{})
+	for _, txHash := range sel.TxHashes {
+		block, tx, found, err := db.FindTx(txHash)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			return nil, fmt.Errorf("record-replay: tx %s not found in tx hash index", txHash.Hex())
+		}
+		if block >= first && block <= last {
+			selected[SubstateKey{Block: block, Tx: tx}] = struct{}{}
+		}
+	}
+	for _, addr := range sel.Addresses {
+		keys, err := db.GetAddressSubstates(addr, first, last)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			selected[key] = struct{}{}
+		}
+	}
+
+	return sortedSubstateKeys(selected), nil
+}
+
+// sortedSubstateKeys returns the keys of a set in ascending order.
+func sortedSubstateKeys(set map[SubstateKey]struct{}) []SubstateKey {
+	keys := make([]SubstateKey, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Block != keys[j].Block {
+			return keys[i].Block < keys[j].Block
+		}
+		return keys[i].Tx < keys[j].Tx
+	})
+	return keys
+}
@@ -0,0 +1,54 @@
+package research
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+)
+
+func TestPutSubstateOverwriteIndex(t *testing.T) {
+	db := NewSubstateDB(rawdb.NewMemoryDatabase())
+
+	oldTo, newTo := common.Address{0x02}, common.Address{0x03}
+	if err := db.PutSubstate(10, 0, newTestSubstate(10, false)); err != nil {
+		t.Fatal(err)
+	}
+	oldHash := common.Hash{0x0a}
+	if err := db.PutTxHash(10, 0, oldHash); err != nil {
+		t.Fatal(err)
+	}
+
+	// overwrite with a substate that does not touch oldTo
+	substate := newTestSubstate(10, false)
+	substate.Message.To = &newTo
+	substate.InputAlloc[newTo] = substate.InputAlloc[oldTo]
+	substate.OutputAlloc[newTo] = substate.OutputAlloc[oldTo]
+	delete(substate.InputAlloc, oldTo)
+	delete(substate.OutputAlloc, oldTo)
+	if err := db.PutSubstate(10, 0, substate); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := db.GetAddressSubstates(oldTo, 0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 0 {
+		t.Fatalf("stale address index entries %v of %v", keys, oldTo.Hex())
+	}
+	keys, err = db.GetAddressSubstates(newTo, 0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0] != (SubstateKey{Block: 10, Tx: 0}) {
+		t.Fatalf("address index entries %v of %v, want 10_0", keys, newTo.Hex())
+	}
+
+	if txHash, err := db.GetTxHash(10, 0); err != nil || txHash != (common.Hash{}) {
+		t.Fatalf("stale tx hash %v, error %v", txHash.Hex(), err)
+	}
+	if _, _, found, err := db.FindTx(oldHash); err != nil || found {
+		t.Fatalf("stale tx index entry of %v, error %v", oldHash.Hex(), err)
+	}
+}
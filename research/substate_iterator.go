@@ -0,0 +1,294 @@
+package research
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// SubstateEntry is a transaction substate yielded by SubstateIterator. It is
+// also a line of substate JSON Lines files, see ExportSubstates.
+type SubstateEntry struct {
+	Block    uint64    `json:"block"`
+	Tx       int       `json:"tx"`
+	Substate *Substate `json:"substate"`
+
+	// TxHash is the hash of the transaction. It is only set by
+	// ExportSubstates and nil if the substate DB has no tx hash.
+	TxHash *common.Hash `json:"txHash,omitempty"`
+}
+
+type substateIteratorResult struct {
+	entry     *SubstateEntry
+	err       error
+	decodeErr bool // err is a SubstateError of a value that cannot be decoded
+}
+
+type substateIteratorTask struct {
+	block uint64
+	tx    int
+	value []byte
+	out   chan substateIteratorResult
+}
+
+// SubstateIterator iterates substates in a range of blocks in key order,
+// i.e. ascending block and transaction numbers. Values are prefetched and
+// decoded in the background on multiple goroutines.
+type SubstateIterator struct {
+	db          *SubstateDB
+	first, last uint64
+	workers     int
+	skipBlock   func(block uint64) bool
+	keys        []SubstateKey // selected substates, nil to iterate the block range
+
+	ordered chan chan substateIteratorResult // results in key order
+	tasks   chan *substateIteratorTask
+	stop    chan struct{}
+	wg      sync.WaitGroup
+
+	cur *SubstateEntry
+	err error
+
+	decodeErrors func(err *SubstateError) error // handler of decode errors, nil to stop at them
+
+	released    bool
+	releaseOnce sync.Once
+}
+
+// NewSubstateIterator returns an iterator over substates from block first to
+// block last (inclusive). Values are decoded on the given number of
+// goroutines. The iterator must be released after use.
+func (db *SubstateDB) NewSubstateIterator(first, last uint64, workers int) *SubstateIterator {
+	return db.NewFilteredSubstateIterator(first, last, workers, nil)
+}
+
+// NewFilteredSubstateIterator is NewSubstateIterator that omits all substates
+// of blocks for which skipBlock returns true. Omitted values are not decoded.
+func (db *SubstateDB) NewFilteredSubstateIterator(first, last uint64, workers int, skipBlock func(block uint64) bool) *SubstateIterator {
+	it := db.newSubstateIterator(first, last, workers, skipBlock)
+	it.start()
+	return it
+}
+
+func (db *SubstateDB) newSubstateIterator(first, last uint64, workers int, skipBlock func(block uint64) bool) *SubstateIterator {
+	if workers < 1 {
+		workers = 1
+	}
+	return &SubstateIterator{
+		db:        db,
+		first:     first,
+		last:      last,
+		workers:   workers,
+		skipBlock: skipBlock,
+
+		ordered: make(chan chan substateIteratorResult, workers*16),
+		tasks:   make(chan *substateIteratorTask, workers*16),
+		stop:    make(chan struct{}),
+	}
+}
+
+// start starts the producer and decoding goroutines.
+func (it *SubstateIterator) start() {
+	it.wg.Add(1)
+	go it.produce()
+	for i := 0; i < it.workers; i++ {
+		it.wg.Add(1)
+		go it.decode()
+	}
+}
+
+// NewSelectedSubstateIterator returns an iterator over the substates of keys,
+// which must be in ascending order. Missing substates are reported as an
+// error. The iterator must be released after use.
+func (db *SubstateDB) NewSelectedSubstateIterator(keys []SubstateKey, workers int) *SubstateIterator {
+	if keys == nil {
+		keys = []SubstateKey{}
+	}
+	it := db.newSubstateIterator(0, 0, workers, nil)
+	it.keys = keys
+	it.start()
+	return it
+}
+
+// fail stops iteration after delivering err in key order.
+func (it *SubstateIterator) fail(err error) {
+	out := make(chan substateIteratorResult, 1)
+	out <- substateIteratorResult{err: err}
+	select {
+	case it.ordered <- out:
+	case <-it.stop:
+	}
+}
+
+// schedule schedules a raw value for decoding. It returns false if the
+// iterator is released.
+func (it *SubstateIterator) schedule(block uint64, tx int, value []byte) bool {
+	task := &substateIteratorTask{
+		block: block,
+		tx:    tx,
+		value: value,
+		out:   make(chan substateIteratorResult, 1),
+	}
+	select {
+	case it.ordered <- task.out:
+	case <-it.stop:
+		return false
+	}
+	select {
+	case it.tasks <- task:
+	case <-it.stop:
+		return false
+	}
+	return true
+}
+
+// produceKeys reads raw values of selected substates and schedules them for
+// decoding.
+func (it *SubstateIterator) produceKeys() {
+	for _, key := range it.keys {
+		value, err := it.db.backend.Get(Stage1SubstateKey(key.Block, key.Tx))
+		if err != nil {
+			it.fail(&SubstateError{Block: key.Block, Tx: key.Tx, Err: fmt.Errorf("error getting substate from substate DB: %v", err)})
+			return
+		}
+		if !it.schedule(key.Block, key.Tx, value) {
+			return
+		}
+	}
+}
+
+// produce reads raw values from the backend and schedules them for decoding.
+func (it *SubstateIterator) produce() {
+	defer it.wg.Done()
+	defer close(it.ordered)
+	defer close(it.tasks)
+
+	if it.keys != nil {
+		it.produceKeys()
+		return
+	}
+
+	start := make([]byte, 8)
+	binary.BigEndian.PutUint64(start, it.first)
+	iter := it.db.backend.NewIterator([]byte(stage1SubstatePrefix), start)
+	defer iter.Release()
+
+	var (
+		checked  bool
+		curBlock uint64
+		skip     bool
+	)
+	for iter.Next() {
+		key := iter.Key()
+		block, tx, err := DecodeStage1SubstateKey(key)
+		if err != nil {
+			it.fail(fmt.Errorf("record-replay: invalid substate key %#x: %v", key, err))
+			return
+		}
+		if block > it.last {
+			return
+		}
+		if it.skipBlock != nil {
+			if !checked || block != curBlock {
+				checked, curBlock = true, block
+				skip = it.skipBlock(block)
+			}
+			if skip {
+				continue
+			}
+		}
+
+		if !it.schedule(block, tx, common.CopyBytes(iter.Value())) {
+			return
+		}
+	}
+	if err := iter.Error(); err != nil {
+		it.fail(fmt.Errorf("record-replay: error iterating substates: %v", err))
+	}
+}
+
+// decode decodes scheduled values and delivers them to their result slots.
+func (it *SubstateIterator) decode() {
+	defer it.wg.Done()
+
+	for {
+		select {
+		case task, ok := <-it.tasks:
+			if !ok {
+				return
+			}
+			substate, err := it.db.decodeSubstate(task.value)
+			if err != nil {
+				task.out <- substateIteratorResult{err: &SubstateError{Block: task.block, Tx: task.tx, Err: err}, decodeErr: true}
+				continue
+			}
+			task.out <- substateIteratorResult{entry: &SubstateEntry{
+				Block:    task.block,
+				Tx:       task.tx,
+				Substate: substate,
+			}}
+
+		case <-it.stop:
+			return
+		}
+	}
+}
+
+// Next moves the iterator to the next substate. It returns false when the
+// iteration is finished, an error occurred or the iterator is released.
+func (it *SubstateIterator) Next() bool {
+	if it.err != nil || it.released {
+		it.cur = nil
+		return false
+	}
+	for {
+		out, ok := <-it.ordered
+		if !ok {
+			it.cur = nil
+			return false
+		}
+		result := <-out
+		if result.decodeErr && it.decodeErrors != nil {
+			result.err = it.decodeErrors(result.err.(*SubstateError))
+			if result.err == nil {
+				continue
+			}
+		}
+		if result.err != nil {
+			it.cur = nil
+			it.err = result.err
+			return false
+		}
+		it.cur = result.entry
+		return true
+	}
+}
+
+// SkipDecodeErrors makes Next skip substates whose values cannot be decoded
+// after passing their errors to fn, instead of stopping the iteration. The
+// iteration stops with the error returned by fn unless it is nil. It must be
+// called before the first call of Next.
+func (it *SubstateIterator) SkipDecodeErrors(fn func(err *SubstateError) error) {
+	it.decodeErrors = fn
+}
+
+// Value returns the current substate entry.
+func (it *SubstateIterator) Value() *SubstateEntry {
+	return it.cur
+}
+
+// Error returns any error that occurred during iteration.
+func (it *SubstateIterator) Error() error {
+	return it.err
+}
+
+// Release stops background goroutines and releases the underlying iterator.
+func (it *SubstateIterator) Release() {
+	it.releaseOnce.Do(func() {
+		it.released = true
+		close(it.stop)
+		it.wg.Wait()
+	})
+}
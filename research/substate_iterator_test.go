@@ -0,0 +1,75 @@
+package research
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/core/rawdb"
+)
+
+func TestSubstateIteratorOrder(t *testing.T) {
+	db := NewSubstateDB(rawdb.NewMemoryDatabase())
+	for block := uint64(10); block < 20; block++ {
+		for tx := 0; tx < int(block%3)+1; tx++ {
+			if err := db.PutSubstate(block, tx, newTestSubstate(block, true)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	it := db.NewSubstateIterator(12, 17, 4)
+	defer it.Release()
+
+	var keys []SubstateKey
+	for it.Next() {
+		entry := it.Value()
+		if entry.Substate.Env.Number != entry.Block {
+			t.Fatalf("substate %v_%v has block number %v", entry.Block, entry.Tx, entry.Substate.Env.Number)
+		}
+		keys = append(keys, SubstateKey{Block: entry.Block, Tx: entry.Tx})
+	}
+	if err := it.Error(); err != nil {
+		t.Fatal(err)
+	}
+
+	var want []SubstateKey
+	for block := uint64(12); block <= 17; block++ {
+		for tx := 0; tx < int(block%3)+1; tx++ {
+			want = append(want, SubstateKey{Block: block, Tx: tx})
+		}
+	}
+	if len(keys) != len(want) {
+		t.Fatalf("iterated %v substates, want %v", len(keys), len(want))
+	}
+	for i := range keys {
+		if keys[i] != want[i] {
+			t.Fatalf("substate %v is %v, want %v", i, keys[i], want[i])
+		}
+	}
+}
+
+func TestSubstateIteratorNextAfterRelease(t *testing.T) {
+	db := NewSubstateDB(rawdb.NewMemoryDatabase())
+	for block := uint64(1); block <= 100; block++ {
+		if err := db.PutSubstate(block, 0, newTestSubstate(block, false)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	it := db.NewSubstateIterator(1, 100, 2)
+	if !it.Next() {
+		t.Fatalf("no substate: %v", it.Error())
+	}
+	it.Release()
+
+	done := make(chan bool)
+	go func() { done <- it.Next() }()
+	select {
+	case next := <-done:
+		if next || it.Value() != nil {
+			t.Fatal("Next returned a substate after Release")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Next blocked after Release")
+	}
+}
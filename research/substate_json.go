@@ -148,9 +148,6 @@ func (env *SubstateEnv) SetJSON(envJSON *SubstateEnvJSON) {
 	}
 
 	env.BaseFee = (*big.Int)(envJSON.BaseFee)
-	if env.BaseFee.Cmp(big.NewInt(0)) == 0 {
-		env.BaseFee = nil
-	}
 }
 
 func (env SubstateEnv) MarshalJSON() ([]byte, error) {
@@ -223,12 +220,13 @@ func (msg *SubstateMessage) SetJSON(msgJSON *SubstateMessageJSON) {
 
 	msg.AccessList = msgJSON.AccessList
 
+	// fee caps are missing before London hard fork
 	msg.GasFeeCap = (*big.Int)(msgJSON.GasFeeCap)
-	if msg.GasFeeCap.Cmp(big.NewInt(0)) == 0 {
+	if msg.GasFeeCap == nil {
 		msg.GasFeeCap = msg.GasPrice
 	}
 	msg.GasTipCap = (*big.Int)(msgJSON.GasTipCap)
-	if msg.GasTipCap.Cmp(big.NewInt(0)) == 0 {
+	if msg.GasTipCap == nil {
 		msg.GasTipCap = msg.GasPrice
 	}
 }
@@ -321,6 +319,15 @@ func NewSubstateJSON(substate *Substate) *SubstateJSON {
 }
 
 func (substate *Substate) SetJSON(substateJSON *SubstateJSON) {
+	if substate.Env == nil {
+		substate.Env = &SubstateEnv{}
+	}
+	if substate.Message == nil {
+		substate.Message = &SubstateMessage{}
+	}
+	if substate.Result == nil {
+		substate.Result = &SubstateResult{}
+	}
 	substate.InputAlloc.SetJSON(substateJSON.InputAlloc)
 	substate.OutputAlloc.SetJSON(substateJSON.OutputAlloc)
 	substate.Env.SetJSON(substateJSON.Env)
@@ -0,0 +1,269 @@
+package research
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb"
+)
+
+// MergeResolution selects which substate wins when a source of MergeFrom
+// has a different substate for a transaction already in the substate DB.
+type MergeResolution int
+
+const (
+	MergeKeepExisting MergeResolution = iota // keep the substate already in the substate DB
+	MergeOverwrite                           // overwrite with the substate of the source
+	MergeFail                                // stop merging at the first conflict
+)
+
+func (r MergeResolution) String() string {
+	switch r {
+	case MergeKeepExisting:
+		return "keep"
+	case MergeOverwrite:
+		return "overwrite"
+	case MergeFail:
+		return "fail"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(r))
+	}
+}
+
+// ParseMergeResolution parses the name of a resolution as printed by String.
+func ParseMergeResolution(name string) (MergeResolution, error) {
+	switch name {
+	case "", "keep":
+		return MergeKeepExisting, nil
+	case "overwrite":
+		return MergeOverwrite, nil
+	case "fail":
+		return MergeFail, nil
+	default:
+		return MergeKeepExisting, fmt.Errorf("unknown merge resolution %q", name)
+	}
+}
+
+// MergeStats counts what MergeFrom copied.
+type MergeStats struct {
+	NumSubstates int64 // substates written to the substate DB
+	NumCodes     int64 // code blobs copied
+	NumConflicts int64 // substates that differ between the substate DB and the source
+	NumSummaries int64 // block summaries written to the substate DB
+	NumTxHashes  int64 // tx hashes copied
+}
+
+// MergeFrom copies substates, code blobs, block summaries, tx hashes and
+// metadata of src into the substate DB. Substates are compared by content,
+// so substate DBs in different formats, layouts and compressions can be
+// merged. Substate DBs with different genesis hashes or chain configs are
+// not merged. Tx hashes are only copied with the substates of src that are
+// written, and recorded blocks of src are only added after all substates
+// are copied.
+// conflict is called for every transaction whose substates differ, and
+// resolution decides which of them is kept.
+func (db *SubstateDB) MergeFrom(src *SubstateDB, resolution MergeResolution, workers int, conflict func(block uint64, tx int)) (*MergeStats, error) {
+	stats := &MergeStats{}
+
+	// check metadata before copying anything
+	m, srcM, err := db.checkMergeMetadata(src)
+	if err != nil {
+		return stats, err
+	}
+
+	// overlaps are blocks with substates in both substate DBs, their
+	// summaries are rewritten from merged substates
+	overlaps := make(map[uint64]struct{})
+
+	iter := src.NewSubstateIterator(0, math.MaxUint64, workers)
+	defer iter.Release()
+	for iter.Next() {
+		entry := iter.Value()
+		block, tx := entry.Block, entry.Tx
+
+		has, err := db.HasSubstate(block, tx)
+		if err != nil {
+			return stats, err
+		}
+		if has {
+			overlaps[block] = struct{}{}
+			existing, err := db.GetSubstate(block, tx)
+			if err != nil {
+				return stats, err
+			}
+			if existing.Equal(entry.Substate) {
+				continue
+			}
+			stats.NumConflicts++
+			conflict(block, tx)
+			switch resolution {
+			case MergeKeepExisting:
+				continue
+			case MergeFail:
+				return stats, &SubstateError{Block: block, Tx: tx, Err: fmt.Errorf("conflicting substates")}
+			}
+		}
+
+		if err := db.PutSubstate(block, tx, entry.Substate); err != nil {
+			return stats, err
+		}
+		// the tx hash of an overwritten substate was deleted by PutSubstate
+		txHash, err := src.GetTxHash(block, tx)
+		if err != nil {
+			return stats, err
+		}
+		if txHash != (common.Hash{}) {
+			if err := db.PutTxHash(block, tx, txHash); err != nil {
+				return stats, err
+			}
+			stats.NumTxHashes++
+		}
+		stats.NumSubstates++
+		if stats.NumSubstates%1_000_000 == 0 {
+			fmt.Printf("record-replay: merge: %dM substates, at block %v\n", stats.NumSubstates/1_000_000, block)
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return stats, err
+	}
+
+	stats.NumCodes, err = db.copyCodes(src)
+	if err != nil {
+		return stats, err
+	}
+	stats.NumSummaries, err = db.mergeBlockSummaries(src, overlaps)
+	if err != nil {
+		return stats, err
+	}
+
+	// recorded blocks of src are only added after all substates are copied
+	if err := db.mergeMetadata(m, srcM); err != nil {
+		return stats, err
+	}
+	return stats, nil
+}
+
+// checkMergeMetadata reads metadata of the substate DB and src and checks
+// that both were recorded from the same chain.
+func (db *SubstateDB) checkMergeMetadata(src *SubstateDB) (m, srcM *SubstateDBMetadata, err error) {
+	m, err = db.GetMetadata()
+	if err != nil {
+		return nil, nil, err
+	}
+	srcM, err = src.GetMetadata()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if m.GenesisHash != (common.Hash{}) && srcM.GenesisHash != (common.Hash{}) && m.GenesisHash != srcM.GenesisHash {
+		return nil, nil, fmt.Errorf("record-replay: cannot merge substates recorded from genesis %s into %s",
+			srcM.GenesisHash.Hex(), m.GenesisHash.Hex())
+	}
+	if m.ChainConfig != nil && srcM.ChainConfig != nil {
+		config, err := json.Marshal(m.ChainConfig)
+		if err != nil {
+			return nil, nil, err
+		}
+		srcConfig, err := json.Marshal(srcM.ChainConfig)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !bytes.Equal(config, srcConfig) {
+			return nil, nil, fmt.Errorf("record-replay: cannot merge substates recorded with a different chain config")
+		}
+	}
+	return m, srcM, nil
+}
+
+// mergeMetadata adds recorded blocks of src and fills metadata records that
+// are missing in the substate DB from src, see checkMergeMetadata.
+func (db *SubstateDB) mergeMetadata(m, srcM *SubstateDBMetadata) error {
+	if m.ChainConfig == nil {
+		m.ChainConfig = srcM.ChainConfig
+	}
+	if m.GenesisHash == (common.Hash{}) {
+		m.GenesisHash = srcM.GenesisHash
+	}
+	if m.Recorder == "" {
+		m.Recorder = srcM.Recorder
+	}
+	m.Blocks = nil
+	if err := db.PutMetadata(m); err != nil {
+		return err
+	}
+
+	for _, interval := range srcM.Blocks {
+		if err := db.AddRecordedBlocks(interval.First, interval.Last); err != nil {
+			return err
+		}
+	}
+	return db.FlushRecordedBlocks()
+}
+
+// copyCodes copies all code blobs of src that are missing in the substate DB.
+func (db *SubstateDB) copyCodes(src *SubstateDB) (copied int64, err error) {
+	batch := db.backend.NewBatch()
+	iter := src.backend.NewIterator([]byte(stage1CodePrefix), nil)
+	defer iter.Release()
+
+	for iter.Next() {
+		key := iter.Key()
+		has, err := db.backend.Has(key)
+		if err != nil {
+			return copied, err
+		}
+		if has {
+			continue
+		}
+		if err := batch.Put(common.CopyBytes(key), common.CopyBytes(iter.Value())); err != nil {
+			return copied, err
+		}
+		copied++
+		if batch.ValueSize() >= ethdb.IdealBatchSize {
+			if err := batch.Write(); err != nil {
+				return copied, err
+			}
+			batch.Reset()
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return copied, err
+	}
+
+	return copied, batch.Write()
+}
+
+// mergeBlockSummaries copies block summaries of src. Summaries of blocks in
+// overlaps or with a summary in both substate DBs are rewritten from the
+// merged substates instead.
+func (db *SubstateDB) mergeBlockSummaries(src *SubstateDB, overlaps map[uint64]struct{}) (written int64, err error) {
+	err = src.ForEachBlockSummary(0, math.MaxUint64, func(block uint64, summary *BlockSummary) error {
+		existing, err := db.GetBlockSummary(block)
+		if err != nil {
+			return err
+		}
+		if existing != nil {
+			overlaps[block] = struct{}{}
+		}
+		if _, overlap := overlaps[block]; overlap {
+			return nil
+		}
+		written++
+		return db.PutBlockSummary(block, summary)
+	})
+	if err != nil {
+		return written, err
+	}
+
+	for block := range overlaps {
+		if err := db.rebuildBlockSummary(block, nil); err != nil {
+			return written, err
+		}
+		written++
+	}
+
+	return written, nil
+}
@@ -0,0 +1,106 @@
+package research
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+func TestMergeFrom(t *testing.T) {
+	// dst and src have different substates of 10_0, src also has 11_0
+	newDBs := func() (dst, src *SubstateDB) {
+		dst = NewSubstateDB(rawdb.NewMemoryDatabase())
+		src = NewSubstateDB(rawdb.NewMemoryDatabase())
+		if err := dst.PutSubstate(10, 0, newTestSubstate(10, false)); err != nil {
+			t.Fatal(err)
+		}
+		if err := dst.PutTxHash(10, 0, common.Hash{0x0a}); err != nil {
+			t.Fatal(err)
+		}
+		for block := uint64(10); block <= 11; block++ {
+			if err := src.PutSubstate(block, 0, newTestSubstate(block, true)); err != nil {
+				t.Fatal(err)
+			}
+			if err := src.PutTxHash(block, 0, common.Hash{byte(block), 0x01}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := src.AddRecordedBlocks(10, 11); err != nil {
+			t.Fatal(err)
+		}
+		if err := src.FlushRecordedBlocks(); err != nil {
+			t.Fatal(err)
+		}
+		return dst, src
+	}
+	checkTxHash := func(db *SubstateDB, block uint64, want common.Hash) {
+		t.Helper()
+		txHash, err := db.GetTxHash(block, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if txHash != want {
+			t.Fatalf("tx hash of %v_0 is %v, want %v", block, txHash.Hex(), want.Hex())
+		}
+	}
+	checkRecorded := func(db *SubstateDB, want int) {
+		t.Helper()
+		m, err := db.GetMetadata()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(m.Blocks) != want {
+			t.Fatalf("recorded blocks %v, want %v intervals", m.Blocks, want)
+		}
+	}
+
+	// the kept substate keeps its tx hash
+	dst, src := newDBs()
+	stats, err := dst.MergeFrom(src, MergeKeepExisting, 1, func(block uint64, tx int) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.NumConflicts != 1 || stats.NumSubstates != 1 || stats.NumTxHashes != 1 {
+		t.Fatalf("merge stats %+v, want 1 conflict, 1 substate and 1 tx hash", stats)
+	}
+	checkTxHash(dst, 10, common.Hash{0x0a})
+	checkTxHash(dst, 11, common.Hash{11, 0x01})
+	checkRecorded(dst, 1)
+
+	// the overwritten substate has the tx hash of src
+	dst, src = newDBs()
+	if _, err := dst.MergeFrom(src, MergeOverwrite, 1, func(block uint64, tx int) {}); err != nil {
+		t.Fatal(err)
+	}
+	checkTxHash(dst, 10, common.Hash{10, 0x01})
+	if _, _, found, err := dst.FindTx(common.Hash{0x0a}); err != nil || found {
+		t.Fatalf("tx hash of the overwritten substate found: %v", err)
+	}
+
+	// a failed merge does not add recorded blocks
+	dst, src = newDBs()
+	if _, err := dst.MergeFrom(src, MergeFail, 1, func(block uint64, tx int) {}); err == nil {
+		t.Fatal("no error for conflicting substates")
+	}
+	checkRecorded(dst, 0)
+
+	// substate DBs of different chains are not merged
+	dst, src = newDBs()
+	if err := dst.PutMetadata(&SubstateDBMetadata{ChainConfig: params.MainnetChainConfig}); err != nil {
+		t.Fatal(err)
+	}
+	config := *params.MainnetChainConfig
+	config.ChainID = big.NewInt(5)
+	if err := src.PutMetadata(&SubstateDBMetadata{ChainConfig: &config}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dst.MergeFrom(src, MergeOverwrite, 1, func(block uint64, tx int) {}); err == nil {
+		t.Fatal("no error for different chain configs")
+	}
+	if has, err := dst.HasSubstate(11, 0); err != nil || has {
+		t.Fatalf("substate of another chain merged: %v", err)
+	}
+}
@@ -0,0 +1,309 @@
+package research
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// SubstateDBVersion is the version of key spaces and value formats written
+// by this package. It is increased whenever older readers cannot read
+// substate DBs written by newer ones.
+const SubstateDBVersion uint64 = 1
+
+// Names of metadata records, stored under stage1MetadataPrefix + name
+const (
+	metadataVersion     = "version"     // RLP-encoded uint64
+	metadataChainConfig = "chainconfig" // JSON-encoded params.ChainConfig
+	metadataGenesisHash = "genesis"     // 32-byte genesis block hash
+	metadataRecorder    = "recorder"    // git commit of the recorder
+	metadataBlocks      = "blocks"      // RLP-encoded []BlockInterval
+)
+
+func Stage1MetadataKey(name string) []byte {
+	return []byte(stage1MetadataPrefix + name)
+}
+
+// BlockInterval is an inclusive range of blocks.
+type BlockInterval struct {
+	First uint64
+	Last  uint64
+}
+
+func (i BlockInterval) String() string {
+	return fmt.Sprintf("%v-%v", i.First, i.Last)
+}
+
+// AddBlockInterval adds the blocks from first to last (inclusive) to sorted,
+// non-overlapping intervals, merging overlapping and adjacent intervals.
+func AddBlockInterval(intervals []BlockInterval, first, last uint64) []BlockInterval {
+	merged := make([]BlockInterval, 0, len(intervals)+1)
+	added := BlockInterval{First: first, Last: last}
+	for _, i := range intervals {
+		switch {
+		case i.Last < added.First && added.First-i.Last > 1:
+			merged = append(merged, i)
+		case i.First > added.Last && i.First-added.Last > 1:
+			merged = append(merged, added)
+			added = i
+		default:
+			if i.First < added.First {
+				added.First = i.First
+			}
+			if i.Last > added.Last {
+				added.Last = i.Last
+			}
+		}
+	}
+	return append(merged, added)
+}
+
+// RemoveBlockInterval removes the blocks from first to last (inclusive)
+// from sorted, non-overlapping intervals.
+func RemoveBlockInterval(intervals []BlockInterval, first, last uint64) []BlockInterval {
+	var result []BlockInterval
+	for _, i := range intervals {
+		if i.Last < first || i.First > last {
+			result = append(result, i)
+			continue
+		}
+		if i.First < first {
+			result = append(result, BlockInterval{First: i.First, Last: first - 1})
+		}
+		if i.Last > last {
+			result = append(result, BlockInterval{First: last + 1, Last: i.Last})
+		}
+	}
+	return result
+}
+
+// IntersectBlockIntervals returns the parts of intervals from block first to
+// block last (inclusive).
+func IntersectBlockIntervals(intervals []BlockInterval, first, last uint64) []BlockInterval {
+	var result []BlockInterval
+	for _, i := range intervals {
+		if i.Last < first || i.First > last {
+			continue
+		}
+		if i.First < first {
+			i.First = first
+		}
+		if i.Last > last {
+			i.Last = last
+		}
+		result = append(result, i)
+	}
+	return result
+}
+
+// SubstateDBMetadata describes the contents of a substate DB. Fields of
+// missing metadata records are left zero.
+type SubstateDBMetadata struct {
+	Version     uint64              // SubstateDBVersion of the last writer
+	ChainConfig *params.ChainConfig // chain config of the recorded chain
+	GenesisHash common.Hash         // genesis block hash of the recorded chain
+	Recorder    string              // git commit of the recorder
+	Blocks      []BlockInterval     // sorted intervals of completely recorded blocks
+}
+
+// GetMetadata reads all metadata records of the substate DB, including
+// recorded blocks that are not flushed yet.
+func (db *SubstateDB) GetMetadata() (*SubstateDBMetadata, error) {
+	m := &SubstateDBMetadata{}
+
+	value, err := db.getMetadata(metadataVersion)
+	if err != nil {
+		return nil, err
+	}
+	if value != nil {
+		if err := rlp.DecodeBytes(value, &m.Version); err != nil {
+			return nil, fmt.Errorf("record-replay: error decoding metadata %s: %v", metadataVersion, err)
+		}
+	}
+
+	value, err = db.getMetadata(metadataChainConfig)
+	if err != nil {
+		return nil, err
+	}
+	if value != nil {
+		m.ChainConfig = &params.ChainConfig{}
+		if err := json.Unmarshal(value, m.ChainConfig); err != nil {
+			return nil, fmt.Errorf("record-replay: error decoding metadata %s: %v", metadataChainConfig, err)
+		}
+	}
+
+	value, err = db.getMetadata(metadataGenesisHash)
+	if err != nil {
+		return nil, err
+	}
+	m.GenesisHash = common.BytesToHash(value)
+
+	value, err = db.getMetadata(metadataRecorder)
+	if err != nil {
+		return nil, err
+	}
+	m.Recorder = string(value)
+
+	m.Blocks, err = db.getRecordedBlocks()
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// PutMetadata writes all non-zero fields of m and SubstateDBVersion as the
+// version of the substate DB.
+func (db *SubstateDB) PutMetadata(m *SubstateDBMetadata) error {
+	batch := db.backend.NewBatch()
+
+	value, err := rlp.EncodeToBytes(SubstateDBVersion)
+	if err != nil {
+		return err
+	}
+	if err := putMetadata(batch, metadataVersion, value); err != nil {
+		return err
+	}
+
+	if m.ChainConfig != nil {
+		value, err := json.Marshal(m.ChainConfig)
+		if err != nil {
+			return fmt.Errorf("record-replay: error encoding metadata %s: %v", metadataChainConfig, err)
+		}
+		if err := putMetadata(batch, metadataChainConfig, value); err != nil {
+			return err
+		}
+	}
+	if m.GenesisHash != (common.Hash{}) {
+		if err := putMetadata(batch, metadataGenesisHash, m.GenesisHash.Bytes()); err != nil {
+			return err
+		}
+	}
+	if m.Recorder != "" {
+		if err := putMetadata(batch, metadataRecorder, []byte(m.Recorder)); err != nil {
+			return err
+		}
+	}
+	if len(m.Blocks) > 0 {
+		db.blocksLock.Lock()
+		db.blocks = append([]BlockInterval{}, m.Blocks...)
+		db.blocksDirty = false
+		db.blocksLock.Unlock()
+
+		value, err := rlp.EncodeToBytes(m.Blocks)
+		if err != nil {
+			return fmt.Errorf("record-replay: error encoding metadata %s: %v", metadataBlocks, err)
+		}
+		if err := putMetadata(batch, metadataBlocks, value); err != nil {
+			return err
+		}
+	}
+
+	return batch.Write()
+}
+
+func (db *SubstateDB) getMetadata(name string) ([]byte, error) {
+	key := Stage1MetadataKey(name)
+	has, err := db.backend.Has(key)
+	if err != nil {
+		return nil, fmt.Errorf("record-replay: error checking metadata %s: %v", name, err)
+	}
+	if !has {
+		return nil, nil
+	}
+	value, err := db.backend.Get(key)
+	if err != nil {
+		return nil, fmt.Errorf("record-replay: error getting metadata %s: %v", name, err)
+	}
+	return value, nil
+}
+
+func putMetadata(w ethdb.KeyValueWriter, name string, value []byte) error {
+	if err := w.Put(Stage1MetadataKey(name), value); err != nil {
+		return fmt.Errorf("record-replay: error putting metadata %s: %v", name, err)
+	}
+	return nil
+}
+
+func (db *SubstateDB) getRecordedBlocks() ([]BlockInterval, error) {
+	db.blocksLock.Lock()
+	defer db.blocksLock.Unlock()
+
+	if err := db.loadRecordedBlocks(); err != nil {
+		return nil, err
+	}
+	return append([]BlockInterval(nil), db.blocks...), nil
+}
+
+// loadRecordedBlocks reads recorded blocks into memory unless they are
+// already loaded. The caller must hold blocksLock.
+func (db *SubstateDB) loadRecordedBlocks() error {
+	if db.blocks != nil {
+		return nil
+	}
+	value, err := db.getMetadata(metadataBlocks)
+	if err != nil {
+		return err
+	}
+	db.blocks = []BlockInterval{}
+	if value != nil {
+		if err := rlp.DecodeBytes(value, &db.blocks); err != nil {
+			db.blocks = nil
+			return fmt.Errorf("record-replay: error decoding metadata %s: %v", metadataBlocks, err)
+		}
+	}
+	return nil
+}
+
+// AddRecordedBlocks marks blocks from first to last (inclusive) as completely
+// recorded. Recorded blocks are kept in memory and written to the substate
+// DB by FlushRecordedBlocks and Close.
+func (db *SubstateDB) AddRecordedBlocks(first, last uint64) error {
+	db.blocksLock.Lock()
+	defer db.blocksLock.Unlock()
+
+	if err := db.loadRecordedBlocks(); err != nil {
+		return err
+	}
+	db.blocks = AddBlockInterval(db.blocks, first, last)
+	db.blocksDirty = true
+	return nil
+}
+
+// RemoveRecordedBlocks marks blocks from first to last (inclusive) as not
+// recorded, see AddRecordedBlocks.
+func (db *SubstateDB) RemoveRecordedBlocks(first, last uint64) error {
+	db.blocksLock.Lock()
+	defer db.blocksLock.Unlock()
+
+	if err := db.loadRecordedBlocks(); err != nil {
+		return err
+	}
+	db.blocks = RemoveBlockInterval(db.blocks, first, last)
+	db.blocksDirty = true
+	return nil
+}
+
+// FlushRecordedBlocks writes recorded blocks added by AddRecordedBlocks to
+// the substate DB.
+func (db *SubstateDB) FlushRecordedBlocks() error {
+	db.blocksLock.Lock()
+	defer db.blocksLock.Unlock()
+
+	if !db.blocksDirty {
+		return nil
+	}
+	value, err := rlp.EncodeToBytes(db.blocks)
+	if err != nil {
+		return fmt.Errorf("record-replay: error encoding metadata %s: %v", metadataBlocks, err)
+	}
+	if err := putMetadata(db.backend, metadataBlocks, value); err != nil {
+		return err
+	}
+	db.blocksDirty = false
+	return nil
+}
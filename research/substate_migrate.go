@@ -0,0 +1,77 @@
+package research
+
+import (
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb"
+)
+
+// MigrateSubstates rewrites every substate value that is not stored in
+// SubstateFormatLatest or SubstateFormatLondonDedup, including unversioned
+// values. Values are rewritten in the layout of the substate DB and keep the
+// compressor they were written with. It returns the number of substates
+// found in each format (detected by trial decoding for unversioned values)
+// and the number of rewritten substates.
+func (db *SubstateDB) MigrateSubstates() (formats map[SubstateFormat]int64, rewritten int64, err error) {
+	formats = make(map[SubstateFormat]int64)
+
+	batch := db.backend.NewBatch()
+	iter := db.backend.NewIterator([]byte(stage1SubstatePrefix), nil)
+	defer iter.Release()
+
+	n := int64(0)
+	for iter.Next() {
+		key := iter.Key()
+		value := iter.Value()
+
+		block, tx, err := DecodeStage1SubstateKey(key)
+		if err != nil {
+			return formats, rewritten, fmt.Errorf("record-replay: invalid substate key %#x: %v", key, err)
+		}
+
+		inner, compressor, err := UnwrapSubstateValue(value)
+		if err != nil {
+			return formats, rewritten, &SubstateError{Block: block, Tx: tx, Err: err}
+		}
+		substateRLP, format, err := db.DecodeSubstateRLP(inner)
+		if err != nil {
+			return formats, rewritten, fmt.Errorf("record-replay: error decoding substateRLP %v_%v: %v", block, tx, err)
+		}
+		formats[format]++
+
+		n++
+		if n%1_000_000 == 0 {
+			fmt.Printf("record-replay: migrate: %dM substates, at block %v\n", n/1_000_000, block)
+		}
+
+		if IsVersionedSubstateValue(inner) && (format == SubstateFormatLatest || format == SubstateFormatLondonDedup) {
+			continue
+		}
+
+		// keep the compression of the value
+		newValue, err := db.encodeSubstateLayout(block, substateRLP, batch)
+		if err == nil {
+			newValue, err = WrapSubstateValue(newValue, compressor)
+		}
+		if err != nil {
+			return formats, rewritten, fmt.Errorf("record-replay: error encoding substateRLP %v_%v: %v", block, tx, err)
+		}
+		if err := batch.Put(common.CopyBytes(key), newValue); err != nil {
+			return formats, rewritten, err
+		}
+		rewritten++
+		if batch.ValueSize() >= ethdb.IdealBatchSize {
+			if err := batch.Write(); err != nil {
+				return formats, rewritten, err
+			}
+			batch.Reset()
+		}
+	}
+	if err = iter.Error(); err != nil {
+		return formats, rewritten, err
+	}
+
+	err = batch.Write()
+	return formats, rewritten, err
+}
@@ -0,0 +1,116 @@
+package research
+
+import (
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"gopkg.in/urfave/cli.v1"
+)
+
+// SubstateDBOptions describes how to open a substate DB.
+type SubstateDBOptions struct {
+	Path     string // directory of the substate DB
+	ReadOnly bool   // open the substate DB without write access
+
+	Cache   int // memory allowance (MB) for LevelDB caches
+	Handles int // number of files LevelDB may keep open
+
+	CodeCache int // memory allowance (MB) for cached code blobs, 0 to disable
+
+	Layout     SubstateLayout     // layout of substate values written to the substate DB
+	Compressor SubstateCompressor // compressor of substate values written to the substate DB, nil if uncompressed
+}
+
+// NewSubstateDBOptions returns options with default LevelDB settings.
+func NewSubstateDBOptions(path string, readOnly bool) *SubstateDBOptions {
+	return &SubstateDBOptions{
+		Path:     path,
+		ReadOnly: readOnly,
+
+		Cache:   1024,
+		Handles: 100,
+	}
+}
+
+// SubstateDBOptionsFromFlags returns options for the substate DB given by
+// --substatedir, --substate-layout, --substate-compression and --code-cache.
+func SubstateDBOptionsFromFlags(ctx *cli.Context, readOnly bool) (*SubstateDBOptions, error) {
+	var err error
+
+	opts := NewSubstateDBOptions(ctx.String(SubstateDirFlag.Name), readOnly)
+	opts.CodeCache = ctx.Int(CodeCacheFlag.Name)
+	opts.Layout, err = ParseSubstateLayout(ctx.String(SubstateLayoutFlag.Name))
+	if err != nil {
+		return nil, err
+	}
+	opts.Compressor, err = SubstateCompressorByName(ctx.String(SubstateCompressionFlag.Name))
+	if err != nil {
+		return nil, err
+	}
+
+	return opts, nil
+}
+
+// OpenSubstateDBWithOptions opens the substate DB described by opts.
+// opts.Path is either a substate DB directory, a manifest file of a
+// sharded substate DB, see SubstateDBManifest, or the endpoint of a
+// substate DB served by substate-cli db serve, which can only be opened
+// read-only. Each call returns an independent handle that must be closed by
+// the caller.
+func OpenSubstateDBWithOptions(opts *SubstateDBOptions) (*SubstateDB, error) {
+	var (
+		backend BackendDatabase
+		err     error
+	)
+	if IsRemoteSubstateDB(opts.Path) {
+		if !opts.ReadOnly {
+			return nil, fmt.Errorf("error opening remote substate DB %s: %v", opts.Path, errRemoteReadOnly)
+		}
+		backend, err = dialRemoteBackend(opts.Path)
+	} else if IsSubstateDBManifest(opts.Path) {
+		backend, err = openShardedBackend(opts)
+	} else {
+		backend, err = rawdb.NewLevelDBDatabase(opts.Path, opts.Cache, opts.Handles, "substatedir", opts.ReadOnly)
+		if err != nil {
+			err = fmt.Errorf("error opening substate leveldb %s: %v", opts.Path, err)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	db := NewSubstateDB(backend)
+	db.SetLayout(opts.Layout)
+	db.SetCompressor(opts.Compressor)
+	db.SetCodeCache(opts.CodeCache)
+	return db, nil
+}
+
+// openShardedBackend opens all shards of the manifest file opts.Path, which
+// share the cache and file handle allowance of opts.
+func openShardedBackend(opts *SubstateDBOptions) (*shardedBackend, error) {
+	manifest, err := ReadSubstateDBManifest(opts.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	cache, handles := opts.Cache/len(manifest.Shards), opts.Handles/len(manifest.Shards)
+	if cache < 16 {
+		cache = 16
+	}
+	if handles < 16 {
+		handles = 16
+	}
+
+	shards := make([]*shardBackend, 0, len(manifest.Shards))
+	for _, shard := range manifest.Shards {
+		db, err := rawdb.NewLevelDBDatabase(shard.Path, cache, handles, "substatedir", opts.ReadOnly)
+		if err != nil {
+			for _, opened := range shards {
+				opened.db.Close()
+			}
+			return nil, fmt.Errorf("error opening substate leveldb %s: %v", shard.Path, err)
+		}
+		shards = append(shards, &shardBackend{SubstateDBShard: shard, db: db})
+	}
+	return newShardedBackend(shards), nil
+}
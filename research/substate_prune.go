@@ -0,0 +1,342 @@
+package research
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// PruneStats counts what PruneSubstates and CollectGarbage deleted.
+type PruneStats struct {
+	NumSubstates int64 // substates deleted
+	NumBlocks    int64 // blocks with deleted substates
+	NumCodes     int64 // unreferenced code blobs deleted
+	NumAccounts  int64 // unreferenced account records of DedupAccountLayout deleted
+}
+
+// PruneSubstates deletes substates from block first to block last
+// (inclusive) with their tx hashes and index entries. If kinds is empty, all substates of the blocks are deleted
+// together with their block summaries, and the blocks are no longer
+// recorded. Otherwise only substates of the given kinds are deleted and
+// summaries of the affected blocks are rewritten with the indices of the
+// deleted substates in PrunedTxs, so the blocks stay recorded with known gaps
+// in their transaction indices.
+//
+// Code blobs and account records are not deleted, see CollectGarbage.
+func (db *SubstateDB) PruneSubstates(first, last uint64, kinds []SubstateTxKind, workers int) (*PruneStats, error) {
+	if len(kinds) == 0 {
+		return db.pruneBlocks(first, last)
+	}
+	return db.pruneTxs(first, last, kinds, workers)
+}
+
+// pruneBlocks deletes all substates and block summaries in a range of blocks.
+func (db *SubstateDB) pruneBlocks(first, last uint64) (*PruneStats, error) {
+	stats := &PruneStats{}
+	batch := db.backend.NewBatch()
+	flush := func() error {
+		if batch.ValueSize() < ethdb.IdealBatchSize {
+			return nil
+		}
+		if err := batch.Write(); err != nil {
+			return err
+		}
+		batch.Reset()
+		return nil
+	}
+
+	start := make([]byte, 8)
+	binary.BigEndian.PutUint64(start, first)
+	iter := db.backend.NewIterator([]byte(stage1SubstatePrefix), start)
+	defer iter.Release()
+
+	var (
+		started  bool
+		curBlock uint64
+	)
+	for iter.Next() {
+		key := iter.Key()
+		block, tx, err := DecodeStage1SubstateKey(key)
+		if err != nil {
+			return stats, fmt.Errorf("record-replay: invalid substate key %#x: %v", key, err)
+		}
+		if block > last {
+			break
+		}
+		if !started || block != curBlock {
+			started, curBlock = true, block
+			stats.NumBlocks++
+		}
+		if err := db.deleteSubstateIndex(batch, block, tx, iter.Value()); err != nil {
+			return stats, &SubstateError{Block: block, Tx: tx, Err: err}
+		}
+		if err := batch.Delete(common.CopyBytes(key)); err != nil {
+			return stats, err
+		}
+		stats.NumSubstates++
+		if stats.NumSubstates%1_000_000 == 0 {
+			fmt.Printf("record-replay: prune: %dM substates, at block %v\n", stats.NumSubstates/1_000_000, block)
+		}
+		if err := flush(); err != nil {
+			return stats, err
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return stats, err
+	}
+
+	err := db.ForEachBlockSummary(first, last, func(block uint64, summary *BlockSummary) error {
+		if err := batch.Delete(Stage1BlockSummaryKey(block)); err != nil {
+			return err
+		}
+		return flush()
+	})
+	if err != nil {
+		return stats, err
+	}
+	if err := batch.Write(); err != nil {
+		return stats, err
+	}
+
+	if err := db.RemoveRecordedBlocks(first, last); err != nil {
+		return stats, err
+	}
+	return stats, db.FlushRecordedBlocks()
+}
+
+// pruneTxs deletes substates of the given kinds in a range of blocks.
+func (db *SubstateDB) pruneTxs(first, last uint64, kinds []SubstateTxKind, workers int) (*PruneStats, error) {
+	stats := &PruneStats{}
+
+	prune := make(map[SubstateTxKind]bool)
+	for _, kind := range kinds {
+		prune[kind] = true
+	}
+	// skip blocks whose summary has no transactions of the given kinds
+	skipBlock := func(block uint64) bool {
+		summary, err := db.GetBlockSummary(block)
+		if err != nil || summary == nil {
+			return false
+		}
+		for kind := range prune {
+			if summary.NumTxsOf(kind) > 0 {
+				return false
+			}
+		}
+		return true
+	}
+
+	// blocks with deleted substates, true if the block has a summary
+	blocks := make(map[uint64]bool)
+	pruned := make(map[uint64][]uint64)
+	batch := db.backend.NewBatch()
+
+	iter := db.NewFilteredSubstateIterator(first, last, workers, skipBlock)
+	defer iter.Release()
+	for iter.Next() {
+		entry := iter.Value()
+		if !prune[entry.Substate.TxKind()] {
+			continue
+		}
+		key := Stage1SubstateKey(entry.Block, entry.Tx)
+		value, err := db.backend.Get(key)
+		if err != nil {
+			return stats, &SubstateError{Block: entry.Block, Tx: entry.Tx, Err: err}
+		}
+		if err := db.deleteSubstateIndex(batch, entry.Block, entry.Tx, value); err != nil {
+			return stats, &SubstateError{Block: entry.Block, Tx: entry.Tx, Err: err}
+		}
+		if err := batch.Delete(key); err != nil {
+			return stats, &SubstateError{Block: entry.Block, Tx: entry.Tx, Err: err}
+		}
+		stats.NumSubstates++
+		if stats.NumSubstates%1_000_000 == 0 {
+			fmt.Printf("record-replay: prune: %dM substates, at block %v\n", stats.NumSubstates/1_000_000, entry.Block)
+		}
+		pruned[entry.Block] = append(pruned[entry.Block], uint64(entry.Tx))
+		if _, exist := blocks[entry.Block]; !exist {
+			summary, err := db.GetBlockSummary(entry.Block)
+			if err != nil {
+				return stats, err
+			}
+			blocks[entry.Block] = summary != nil
+		}
+		if batch.ValueSize() >= ethdb.IdealBatchSize {
+			if err := batch.Write(); err != nil {
+				return stats, err
+			}
+			batch.Reset()
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return stats, err
+	}
+	if err := batch.Write(); err != nil {
+		return stats, err
+	}
+
+	stats.NumBlocks = int64(len(blocks))
+	for block, hasSummary := range blocks {
+		if !hasSummary {
+			continue
+		}
+		if err := db.rebuildBlockSummary(block, pruned[block]); err != nil {
+			return stats, err
+		}
+	}
+	return stats, nil
+}
+
+// CollectGarbage deletes code blobs and account records that are no longer
+// referenced by any substate. Code is referenced by accounts in InputAlloc
+// and OutputAlloc and by the init code of CREATE messages. It fails without
+// deleting anything if a substate cannot be decoded, because its references
+// are unknown.
+func (db *SubstateDB) CollectGarbage() (*PruneStats, error) {
+	stats := &PruneStats{}
+	codes := make(map[common.Hash]struct{})
+	accounts := make(map[common.Hash]struct{})
+
+	// mark
+	iter := db.backend.NewIterator([]byte(stage1SubstatePrefix), nil)
+	defer iter.Release()
+	for iter.Next() {
+		key := iter.Key()
+		block, tx, err := DecodeStage1SubstateKey(key)
+		if err != nil {
+			return stats, fmt.Errorf("record-replay: invalid substate key %#x: %v", key, err)
+		}
+		if err := db.markReferences(iter.Value(), codes, accounts); err != nil {
+			return stats, &SubstateError{Block: block, Tx: tx, Err: err}
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return stats, err
+	}
+
+	// sweep
+	var err error
+	stats.NumCodes, err = db.sweep(stage1CodePrefix, codes)
+	db.resetCodeCache()
+	if err != nil {
+		return stats, err
+	}
+	stats.NumAccounts, err = db.sweep(stage1AccountPrefix, accounts)
+	return stats, err
+}
+
+// markReferences adds code hashes and account hashes referenced by a
+// substate value to codes and accounts.
+func (db *SubstateDB) markReferences(value []byte, codes, accounts map[common.Hash]struct{}) error {
+	inner, _, err := UnwrapSubstateValue(value)
+	if err != nil {
+		return err
+	}
+	if IsVersionedSubstateValue(inner) && SubstateFormat(inner[0]) == SubstateFormatLondonDedup {
+		refRLP := SubstateRefRLP{}
+		if err := rlp.DecodeBytes(inner[1:], &refRLP); err != nil {
+			return err
+		}
+		for _, allocRefRLP := range []SubstateAllocRefRLP{refRLP.InputAlloc, refRLP.OutputAlloc} {
+			for _, accountHash := range allocRefRLP.AccountHashes {
+				accounts[accountHash] = struct{}{}
+			}
+		}
+	}
+
+	substateRLP, _, err := db.DecodeSubstateRLP(inner)
+	if err != nil {
+		return err
+	}
+	for _, allocRLP := range []SubstateAllocRLP{substateRLP.InputAlloc, substateRLP.OutputAlloc} {
+		for _, saRLP := range allocRLP.Accounts {
+			if saRLP != nil {
+				codes[saRLP.CodeHash] = struct{}{}
+			}
+		}
+	}
+	if msgRLP := substateRLP.Message; msgRLP != nil && msgRLP.InitCodeHash != nil {
+		codes[*msgRLP.InitCodeHash] = struct{}{}
+	}
+	return nil
+}
+
+// sweep deletes all keys of a 32-byte hash key space whose hash is not in
+// marked.
+func (db *SubstateDB) sweep(prefix string, marked map[common.Hash]struct{}) (deleted int64, err error) {
+	batch := db.backend.NewBatch()
+	iter := db.backend.NewIterator([]byte(prefix), nil)
+	defer iter.Release()
+
+	for iter.Next() {
+		key := iter.Key()
+		if len(key) != len(prefix)+32 {
+			return deleted, fmt.Errorf("record-replay: invalid %s key %#x", KeySpaceName(prefix), key)
+		}
+		if _, exist := marked[common.BytesToHash(key[len(prefix):])]; exist {
+			continue
+		}
+		if err := batch.Delete(common.CopyBytes(key)); err != nil {
+			return deleted, err
+		}
+		deleted++
+		if batch.ValueSize() >= ethdb.IdealBatchSize {
+			if err := batch.Write(); err != nil {
+				return deleted, err
+			}
+			batch.Reset()
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return deleted, err
+	}
+
+	return deleted, batch.Write()
+}
+
+// CompactPruned compacts key spaces changed by PruneSubstates from block
+// first to block last (inclusive), including the tx hash and address index
+// entries it deletes, and by CollectGarbage.
+func (db *SubstateDB) CompactPruned(first, last uint64) error {
+	substateLimit := []byte(nextPrefix(stage1SubstatePrefix))
+	if last < math.MaxUint64 {
+		substateLimit = Stage1SubstateBlockPrefix(last + 1)
+	}
+	summaryLimit := []byte(nextPrefix(stage1BlockSummaryPrefix))
+	if last < math.MaxUint64 {
+		summaryLimit = Stage1BlockSummaryKey(last + 1)
+	}
+	txHashLimit := []byte(nextPrefix(stage1TxHashPrefix))
+	if last < math.MaxUint64 {
+		txHashLimit = Stage1TxHashKey(last+1, 0)
+	}
+
+	// tx hash and address index entries of pruned substates are ordered by
+	// hash and address, so their whole key spaces are compacted
+	ranges := [][2][]byte{
+		{Stage1SubstateBlockPrefix(first), substateLimit},
+		{Stage1BlockSummaryKey(first), summaryLimit},
+		{Stage1TxHashKey(first, 0), txHashLimit},
+		{[]byte(stage1TxIndexPrefix), []byte(nextPrefix(stage1TxIndexPrefix))},
+		{[]byte(stage1AddressIndexPrefix), []byte(nextPrefix(stage1AddressIndexPrefix))},
+		{[]byte(stage1CodePrefix), []byte(nextPrefix(stage1CodePrefix))},
+		{[]byte(stage1AccountPrefix), []byte(nextPrefix(stage1AccountPrefix))},
+	}
+	for _, r := range ranges {
+		if err := db.Compact(r[0], r[1]); err != nil {
+			return fmt.Errorf("record-replay: error compacting %s..%s: %v", hexutil.Encode(r[0]), hexutil.Encode(r[1]), err)
+		}
+	}
+	return nil
+}
+
+// nextPrefix returns the smallest key prefix larger than all keys starting
+// with a two-character prefix.
+func nextPrefix(prefix string) string {
+	return prefix[:1] + string(prefix[1]+1)
+}
@@ -0,0 +1,355 @@
+package research
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/rpc"
+	lru "github.com/hashicorp/golang-lru"
+)
+
+const (
+	remoteRangeMaxEntries  = 4096            // maximum number of entries returned by substate_getRange
+	remoteRangeMaxSize     = 4 * 1024 * 1024 // maximum size of values returned by substate_getRange
+	remoteCodeCacheEntries = 16384           // number of code blobs cached by remote clients
+)
+
+var errRemoteReadOnly = errors.New("remote substate DB is read-only")
+
+// RemoteEntry is a raw key/value pair of a substate DB served over JSON-RPC.
+type RemoteEntry struct {
+	Key   hexutil.Bytes `json:"key"`
+	Value hexutil.Bytes `json:"value"`
+}
+
+// RemoteRange is a page of raw entries returned by substate_getRange.
+type RemoteRange struct {
+	Entries []RemoteEntry `json:"entries"`
+	Next    hexutil.Bytes `json:"next,omitempty"` // start of the next page, omitted after the last page
+}
+
+// SubstateAPI serves a substate DB read-only in the "substate" namespace of
+// a JSON-RPC server, see substate-cli db serve. It returns raw values as
+// stored in the substate DB, so clients decode substates themselves.
+type SubstateAPI struct {
+	backend BackendDatabase
+}
+
+// NewSubstateAPI returns the JSON-RPC API of db.
+func NewSubstateAPI(db *SubstateDB) *SubstateAPI {
+	return &SubstateAPI{backend: db.backend}
+}
+
+// Has reports whether key exists in the substate DB.
+func (api *SubstateAPI) Has(key hexutil.Bytes) (bool, error) {
+	return api.backend.Has(key)
+}
+
+// Get returns the raw value of key.
+func (api *SubstateAPI) Get(key hexutil.Bytes) (hexutil.Bytes, error) {
+	return api.backend.Get(key)
+}
+
+// GetCode returns the code blob of codeHash.
+func (api *SubstateAPI) GetCode(codeHash common.Hash) (hexutil.Bytes, error) {
+	return api.backend.Get(Stage1CodeKey(codeHash))
+}
+
+// GetBlock returns the raw substates of all transactions of block in
+// transaction order.
+func (api *SubstateAPI) GetBlock(block hexutil.Uint64) ([]RemoteEntry, error) {
+	iter := api.backend.NewIterator(Stage1SubstateBlockPrefix(uint64(block)), nil)
+	defer iter.Release()
+
+	entries := []RemoteEntry{}
+	for iter.Next() {
+		entries = append(entries, RemoteEntry{
+			Key:   common.CopyBytes(iter.Key()),
+			Value: common.CopyBytes(iter.Value()),
+		})
+	}
+	return entries, iter.Error()
+}
+
+// GetRange returns raw entries with the given key prefix in key order,
+// starting at prefix + start like ethdb.Iteratee. At most limit entries are
+// returned per page, fewer if their values exceed remoteRangeMaxSize.
+func (api *SubstateAPI) GetRange(prefix, start hexutil.Bytes, limit int) (*RemoteRange, error) {
+	if limit <= 0 || limit > remoteRangeMaxEntries {
+		limit = remoteRangeMaxEntries
+	}
+
+	iter := api.backend.NewIterator(prefix, start)
+	defer iter.Release()
+
+	page := &RemoteRange{Entries: []RemoteEntry{}}
+	size := 0
+	for iter.Next() {
+		if len(page.Entries) >= limit || size >= remoteRangeMaxSize {
+			key := iter.Key()
+			page.Next = common.CopyBytes(key[len(prefix):])
+			break
+		}
+		entry := RemoteEntry{
+			Key:   common.CopyBytes(iter.Key()),
+			Value: common.CopyBytes(iter.Value()),
+		}
+		page.Entries = append(page.Entries, entry)
+		size += len(entry.Key) + len(entry.Value)
+	}
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+// Stat returns a database property of the substate DB.
+func (api *SubstateAPI) Stat(property string) (string, error) {
+	return api.backend.Stat(property)
+}
+
+// IsRemoteSubstateDB reports whether path is the endpoint of a substate DB
+// served by substate-cli db serve rather than a local path.
+func IsRemoteSubstateDB(path string) bool {
+	for _, scheme := range []string{"http://", "https://", "ws://", "wss://"} {
+		if strings.HasPrefix(path, scheme) {
+			return true
+		}
+	}
+	return strings.HasSuffix(path, ".ipc")
+}
+
+// remoteBackend is a read-only BackendDatabase that reads a substate DB
+// served by SubstateAPI. Code blobs are immutable, so they are cached.
+type remoteBackend struct {
+	client   *rpc.Client
+	codes    *lru.Cache // code hash -> code blob
+	pageSize int        // entries requested per page of substate_getRange
+}
+
+// dialRemoteBackend connects to the substate DB served at endpoint.
+func dialRemoteBackend(endpoint string) (*remoteBackend, error) {
+	client, err := rpc.Dial(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to remote substate DB %s: %v", endpoint, err)
+	}
+	modules, err := client.SupportedModules()
+	if err != nil {
+		client.Close()
+		return nil, fmt.Errorf("error connecting to remote substate DB %s: %v", endpoint, err)
+	}
+	if _, ok := modules["substate"]; !ok {
+		client.Close()
+		return nil, fmt.Errorf("%s does not serve a substate DB", endpoint)
+	}
+	codes, _ := lru.New(remoteCodeCacheEntries)
+	return &remoteBackend{client: client, codes: codes, pageSize: remoteRangeMaxEntries}, nil
+}
+
+// remoteCodeHash returns the code hash of a code key.
+func remoteCodeHash(key []byte) (common.Hash, bool) {
+	if len(key) != 2+common.HashLength || string(key[:2]) != stage1CodePrefix {
+		return common.Hash{}, false
+	}
+	return common.BytesToHash(key[2:]), true
+}
+
+func (b *remoteBackend) Has(key []byte) (bool, error) {
+	if codeHash, ok := remoteCodeHash(key); ok && b.codes.Contains(codeHash) {
+		return true, nil
+	}
+	var has bool
+	if err := b.client.Call(&has, "substate_has", hexutil.Bytes(key)); err != nil {
+		return false, err
+	}
+	return has, nil
+}
+
+func (b *remoteBackend) Get(key []byte) ([]byte, error) {
+	codeHash, isCode := remoteCodeHash(key)
+	if isCode {
+		if code, ok := b.codes.Get(codeHash); ok {
+			return code.([]byte), nil
+		}
+	}
+
+	var value hexutil.Bytes
+	var err error
+	if isCode {
+		err = b.client.Call(&value, "substate_getCode", codeHash)
+	} else {
+		err = b.client.Call(&value, "substate_get", hexutil.Bytes(key))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if isCode {
+		b.codes.Add(codeHash, []byte(value))
+	}
+	return value, nil
+}
+
+func (b *remoteBackend) Put(key []byte, value []byte) error {
+	return errRemoteReadOnly
+}
+
+func (b *remoteBackend) Delete(key []byte) error {
+	return errRemoteReadOnly
+}
+
+func (b *remoteBackend) NewBatch() ethdb.Batch {
+	return &remoteBatch{}
+}
+
+// NewIterator fetches all substates of a block at once, and other key ranges
+// page by page.
+func (b *remoteBackend) NewIterator(prefix []byte, start []byte) ethdb.Iterator {
+	if len(prefix) == 2+8 && string(prefix[:2]) == stage1SubstatePrefix && len(start) == 0 {
+		var entries []RemoteEntry
+		err := b.client.Call(&entries, "substate_getBlock", hexutil.Uint64(binary.BigEndian.Uint64(prefix[2:])))
+		return &remoteIterator{page: entries, pos: -1, err: err}
+	}
+
+	it := &remoteIterator{backend: b, prefix: common.CopyBytes(prefix), pos: -1}
+	it.fetch(common.CopyBytes(start))
+	return it
+}
+
+func (b *remoteBackend) Stat(property string) (string, error) {
+	var stat string
+	if err := b.client.Call(&stat, "substate_stat", property); err != nil {
+		return "", err
+	}
+	return stat, nil
+}
+
+func (b *remoteBackend) Compact(start []byte, limit []byte) error {
+	return errRemoteReadOnly
+}
+
+func (b *remoteBackend) Close() error {
+	b.client.Close()
+	return nil
+}
+
+// remoteBatch is the batch of remoteBackend, which fails to write.
+type remoteBatch struct {
+	ops  int
+	size int
+}
+
+func (b *remoteBatch) Put(key []byte, value []byte) error {
+	b.ops++
+	b.size += len(value)
+	return errRemoteReadOnly
+}
+
+func (b *remoteBatch) Delete(key []byte) error {
+	b.ops++
+	b.size += len(key)
+	return errRemoteReadOnly
+}
+
+func (b *remoteBatch) ValueSize() int {
+	return b.size
+}
+
+func (b *remoteBatch) Write() error {
+	if b.ops > 0 {
+		return errRemoteReadOnly
+	}
+	return nil
+}
+
+func (b *remoteBatch) Reset() {
+	b.ops, b.size = 0, 0
+}
+
+func (b *remoteBatch) Replay(w ethdb.KeyValueWriter) error {
+	return nil
+}
+
+type remoteRangeResult struct {
+	page *RemoteRange
+	err  error
+}
+
+// remoteIterator iterates pages of substate_getRange. The next page is
+// fetched in the background while the current page is consumed.
+type remoteIterator struct {
+	backend *remoteBackend
+	prefix  []byte
+	pending chan remoteRangeResult // next page, nil after the last page
+
+	page []RemoteEntry
+	pos  int
+	err  error
+}
+
+// fetch requests the page starting at prefix + start.
+func (it *remoteIterator) fetch(start []byte) {
+	pending := make(chan remoteRangeResult, 1)
+	it.pending = pending
+	go func() {
+		page := &RemoteRange{}
+		err := it.backend.client.Call(page, "substate_getRange", hexutil.Bytes(it.prefix), hexutil.Bytes(start), it.backend.pageSize)
+		pending <- remoteRangeResult{page: page, err: err}
+	}()
+}
+
+func (it *remoteIterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	it.pos++
+	for it.pos >= len(it.page) {
+		if it.pending == nil {
+			it.page = nil
+			return false
+		}
+		result := <-it.pending
+		it.pending = nil
+		if result.err != nil {
+			it.err = result.err
+			it.page = nil
+			return false
+		}
+		it.page, it.pos = result.page.Entries, 0
+		if result.page.Next != nil {
+			it.fetch(result.page.Next)
+		}
+	}
+	if !bytes.HasPrefix(it.page[it.pos].Key, it.prefix) {
+		it.err = fmt.Errorf("remote substate DB returned key %#x without prefix %#x", []byte(it.page[it.pos].Key), it.prefix)
+		return false
+	}
+	return true
+}
+
+func (it *remoteIterator) Error() error {
+	return it.err
+}
+
+func (it *remoteIterator) Key() []byte {
+	if it.pos < 0 || it.pos >= len(it.page) {
+		return nil
+	}
+	return it.page[it.pos].Key
+}
+
+func (it *remoteIterator) Value() []byte {
+	if it.pos < 0 || it.pos >= len(it.page) {
+		return nil
+	}
+	return it.page[it.pos].Value
+}
+
+func (it *remoteIterator) Release() {
+	it.page = nil
+}
@@ -0,0 +1,121 @@
+package research
+
+import (
+	"math"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+func TestRemoteSubstateDB(t *testing.T) {
+	txs := []int{0, 2, 3, 0, 1, 4, 2}
+	src := newTestTaskDB(t, txs)
+	numSubstates := 0
+	for _, n := range txs {
+		numSubstates += n
+	}
+
+	server := rpc.NewServer()
+	defer server.Stop()
+	if err := server.RegisterName("substate", NewSubstateAPI(src)); err != nil {
+		t.Fatal(err)
+	}
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	// pages of substate_getRange continue at Next
+	api := NewSubstateAPI(src)
+	prefix := []byte(stage1SubstatePrefix)
+	var keys [][]byte
+	for start := []byte(nil); ; {
+		page, err := api.GetRange(prefix, start, 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page.Entries) > 5 {
+			t.Fatalf("page of %v entries, limit 5", len(page.Entries))
+		}
+		for _, entry := range page.Entries {
+			keys = append(keys, entry.Key)
+		}
+		if page.Next == nil {
+			break
+		}
+		start = page.Next
+	}
+	if len(keys) != numSubstates {
+		t.Fatalf("%v substates in all pages, want %v", len(keys), numSubstates)
+	}
+
+	if _, err := OpenSubstateDBWithOptions(NewSubstateDBOptions(httpServer.URL, false)); err == nil {
+		t.Fatal("remote substate DB opened for writing")
+	}
+	db, err := OpenSubstateDBWithOptions(NewSubstateDBOptions(httpServer.URL, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	backend := db.backend.(*remoteBackend)
+	backend.pageSize = 3
+
+	// replay all substates page by page
+	pool := &SubstateTaskPool{
+		Name: "test",
+		WorkerAction: func(block uint64, tx int, substate *Substate) (WorkerResult, error) {
+			if !substate.Equal(newTestSubstate(block, false)) {
+				t.Errorf("substate %v_%v differs", block, tx)
+			}
+			return &VanillaWorkerResult{BlockId: block, TxId: tx}, nil
+		},
+		CollectorAction: collectBlocks,
+		CollectorInit:   func() CollectorResult { return &collectedBlocks{} },
+		First:           0,
+		Last:            uint64(len(txs) - 1),
+		Workers:         2,
+		DB:              db,
+	}
+	result, err := pool.Execute()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkCollectedBlocks(t, result.(*collectedBlocks), 0, uint64(len(txs)-1), txs)
+
+	iter := db.NewSubstateIterator(0, math.MaxUint64, 2)
+	n := 0
+	for iter.Next() {
+		n++
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil || n != numSubstates {
+		t.Fatalf("iterated %v substates, want %v: %v", n, numSubstates, err)
+	}
+
+	// substates of a block are fetched with substate_getBlock
+	for block, n := range txs {
+		substates, err := db.GetBlockSubstates(uint64(block))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(substates) != n {
+			t.Fatalf("block %v has %v substates, want %v", block, len(substates), n)
+		}
+	}
+
+	// code blobs are cached
+	substate := newTestSubstate(1, false)
+	code := substate.InputAlloc[*substate.Message.To].Code
+	codeHash := crypto.Keccak256Hash(code)
+	if !backend.codes.Contains(codeHash) {
+		t.Fatalf("code %v not cached", codeHash.Hex())
+	}
+	if has, err := db.HasCode(codeHash); err != nil || !has {
+		t.Fatalf("code %v not found: %v", codeHash.Hex(), err)
+	}
+
+	// the remote substate DB is read-only
+	if err := db.PutSubstate(10, 0, substate); err == nil {
+		t.Fatal("substate written to remote substate DB")
+	}
+}
@@ -1,6 +1,7 @@
 package research
 
 import (
+	"fmt"
 	"math/big"
 	"sort"
 
@@ -36,14 +37,21 @@ func NewSubstateAccountRLP(sa *SubstateAccount) *SubstateAccountRLP {
 	return &saRLP
 }
 
-func (sa *SubstateAccount) SetRLP(saRLP *SubstateAccountRLP, db *SubstateDB) {
+func (sa *SubstateAccount) SetRLP(saRLP *SubstateAccountRLP, db *SubstateDB) error {
+	var err error
+
 	sa.Balance = saRLP.Balance
 	sa.Nonce = saRLP.Nonce
-	sa.Code = db.GetCode(saRLP.CodeHash)
+	sa.Code, err = db.GetCode(saRLP.CodeHash)
+	if err != nil {
+		return err
+	}
 	sa.Storage = make(map[common.Hash]common.Hash)
 	for i := range saRLP.Storage {
 		sa.Storage[saRLP.Storage[i][0]] = saRLP.Storage[i][1]
 	}
+
+	return nil
 }
 
 type SubstateAllocRLP struct {
@@ -71,22 +79,20 @@ func NewSubstateAllocRLP(alloc SubstateAlloc) SubstateAllocRLP {
 	return allocRLP
 }
 
-func (alloc *SubstateAlloc) SetRLP(allocRLP SubstateAllocRLP, db *SubstateDB) {
+func (alloc *SubstateAlloc) SetRLP(allocRLP SubstateAllocRLP, db *SubstateDB) error {
 	*alloc = make(SubstateAlloc)
 	for i, addr := range allocRLP.Addresses {
 		var sa SubstateAccount
 
 		saRLP := allocRLP.Accounts[i]
-		sa.Balance = saRLP.Balance
-		sa.Nonce = saRLP.Nonce
-		sa.Code = db.GetCode(saRLP.CodeHash)
-		sa.Storage = make(map[common.Hash]common.Hash)
-		for i := range saRLP.Storage {
-			sa.Storage[saRLP.Storage[i][0]] = saRLP.Storage[i][1]
+		if err := sa.SetRLP(saRLP, db); err != nil {
+			return fmt.Errorf("account %s: %v", addr.Hex(), err)
 		}
 
 		(*alloc)[addr] = &sa
 	}
+
+	return nil
 }
 
 type legacySubstateEnvRLP struct {
@@ -286,7 +292,9 @@ func NewSubstateMessageRLP(msg *SubstateMessage) *SubstateMessageRLP {
 	return &msgRLP
 }
 
-func (msg *SubstateMessage) SetRLP(msgRLP *SubstateMessageRLP, db *SubstateDB) {
+func (msg *SubstateMessage) SetRLP(msgRLP *SubstateMessageRLP, db *SubstateDB) error {
+	var err error
+
 	msg.Nonce = msgRLP.Nonce
 	msg.CheckNonce = msgRLP.CheckNonce
 	msg.GasPrice = msgRLP.GasPrice
@@ -298,13 +306,18 @@ func (msg *SubstateMessage) SetRLP(msgRLP *SubstateMessageRLP, db *SubstateDB) {
 	msg.Data = msgRLP.Data
 
 	if msgRLP.To == nil {
-		msg.Data = db.GetCode(*msgRLP.InitCodeHash)
+		msg.Data, err = db.GetCode(*msgRLP.InitCodeHash)
+		if err != nil {
+			return fmt.Errorf("init code: %v", err)
+		}
 	}
 
 	msg.AccessList = msgRLP.AccessList
 
 	msg.GasFeeCap = msgRLP.GasFeeCap
 	msg.GasTipCap = msgRLP.GasTipCap
+
+	return nil
 }
 
 type SubstateResultRLP struct {
@@ -394,16 +407,24 @@ func NewSubstateRLP(substate *Substate) *SubstateRLP {
 	return &substateRLP
 }
 
-func (substate *Substate) SetRLP(substateRLP *SubstateRLP, db *SubstateDB) {
+func (substate *Substate) SetRLP(substateRLP *SubstateRLP, db *SubstateDB) error {
 	substate.InputAlloc = make(SubstateAlloc)
 	substate.OutputAlloc = make(SubstateAlloc)
 	substate.Env = &SubstateEnv{}
 	substate.Message = &SubstateMessage{}
 	substate.Result = &SubstateResult{}
 
-	substate.InputAlloc.SetRLP(substateRLP.InputAlloc, db)
-	substate.OutputAlloc.SetRLP(substateRLP.OutputAlloc, db)
+	if err := substate.InputAlloc.SetRLP(substateRLP.InputAlloc, db); err != nil {
+		return fmt.Errorf("InputAlloc: %v", err)
+	}
+	if err := substate.OutputAlloc.SetRLP(substateRLP.OutputAlloc, db); err != nil {
+		return fmt.Errorf("OutputAlloc: %v", err)
+	}
 	substate.Env.SetRLP(substateRLP.Env, db)
-	substate.Message.SetRLP(substateRLP.Message, db)
+	if err := substate.Message.SetRLP(substateRLP.Message, db); err != nil {
+		return fmt.Errorf("Message: %v", err)
+	}
 	substate.Result.SetRLP(substateRLP.Result, db)
+
+	return nil
 }
@@ -0,0 +1,500 @@
+package research
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/syndtr/goleveldb/leveldb/errors"
+)
+
+// SubstateDBManifest describes a substate DB sharded by block ranges. It is
+// stored as a JSON file, which can be given as --substatedir instead of a
+// substate DB directory.
+type SubstateDBManifest struct {
+	Shards []SubstateDBShard `json:"shards"`
+}
+
+// SubstateDBShard is a substate DB directory holding all substates from
+// block First to block Last (inclusive).
+type SubstateDBShard struct {
+	First uint64 `json:"first"`
+	Last  uint64 `json:"last"`
+	Path  string `json:"path"` // relative to the directory of the manifest
+}
+
+// IsSubstateDBManifest reports whether path is a manifest file rather than
+// a substate DB directory.
+func IsSubstateDBManifest(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.Mode().IsRegular()
+}
+
+// ReadSubstateDBManifest reads a manifest file and checks that its shards
+// are sorted and do not overlap. Relative shard paths are resolved against
+// the directory of the manifest.
+func ReadSubstateDBManifest(path string) (*SubstateDBManifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading substate DB manifest %s: %v", path, err)
+	}
+	m := &SubstateDBManifest{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("error decoding substate DB manifest %s: %v", path, err)
+	}
+	if len(m.Shards) == 0 {
+		return nil, fmt.Errorf("substate DB manifest %s has no shards", path)
+	}
+	for i := range m.Shards {
+		shard := &m.Shards[i]
+		if shard.First > shard.Last {
+			return nil, fmt.Errorf("substate DB manifest %s: shard %s has first block larger than last block", path, shard.Path)
+		}
+		if i > 0 && shard.First <= m.Shards[i-1].Last {
+			return nil, fmt.Errorf("substate DB manifest %s: shard %s is not sorted after shard %s", path, shard.Path, m.Shards[i-1].Path)
+		}
+		if !filepath.IsAbs(shard.Path) {
+			shard.Path = filepath.Join(filepath.Dir(path), shard.Path)
+		}
+	}
+	return m, nil
+}
+
+// shardBackend is a shard of shardedBackend.
+type shardBackend struct {
+	SubstateDBShard
+	db BackendDatabase
+}
+
+// shardedBackend is a BackendDatabase that routes keys to shards by block
+// number. Keys of substates, block summaries, tx hashes and the address
+// index belong to the shard of their block. Code blobs and account records
+// written together with a substate go to the shard of that substate, so
+// every shard can be used as a substate DB on its own. Other keys are
+// written to all shards and read from the first shard that has them.
+type shardedBackend struct {
+	shards []*shardBackend
+}
+
+func newShardedBackend(shards []*shardBackend) *shardedBackend {
+	return &shardedBackend{shards: shards}
+}
+
+// keyBlock returns the block number of a key that belongs to a single shard.
+func keyBlock(key []byte) (uint64, bool) {
+	if len(key) < 2 {
+		return 0, false
+	}
+	switch string(key[:2]) {
+	case stage1SubstatePrefix, stage1BlockSummaryPrefix, stage1TxHashPrefix:
+		if len(key) >= 2+8 {
+			return binary.BigEndian.Uint64(key[2:10]), true
+		}
+	case stage1AddressIndexPrefix:
+		if len(key) >= 2+20+8 {
+			return binary.BigEndian.Uint64(key[22:30]), true
+		}
+	}
+	return 0, false
+}
+
+// shard returns the index of the shard holding block, or -1.
+func (b *shardedBackend) shard(block uint64) int {
+	i := sort.Search(len(b.shards), func(i int) bool { return b.shards[i].Last >= block })
+	if i < len(b.shards) && b.shards[i].First <= block {
+		return i
+	}
+	return -1
+}
+
+// reader returns the backend to check for code blobs and account records
+// stored together with substates of block.
+func (b *shardedBackend) reader(block uint64) ethdb.KeyValueReader {
+	if i := b.shard(block); i >= 0 {
+		return b.shards[i].db
+	}
+	return b
+}
+
+func (b *shardedBackend) Has(key []byte) (bool, error) {
+	if block, ok := keyBlock(key); ok {
+		i := b.shard(block)
+		if i < 0 {
+			return false, nil
+		}
+		return b.shards[i].db.Has(key)
+	}
+	for _, shard := range b.shards {
+		has, err := shard.db.Has(key)
+		if err != nil || has {
+			return has, err
+		}
+	}
+	return false, nil
+}
+
+func (b *shardedBackend) Get(key []byte) ([]byte, error) {
+	if block, ok := keyBlock(key); ok {
+		i := b.shard(block)
+		if i < 0 {
+			return nil, errors.ErrNotFound
+		}
+		return b.shards[i].db.Get(key)
+	}
+	if bytes.Equal(key, Stage1MetadataKey(metadataBlocks)) {
+		return b.getRecordedBlocks()
+	}
+	for _, shard := range b.shards {
+		has, err := shard.db.Has(key)
+		if err != nil {
+			return nil, err
+		}
+		if has {
+			return shard.db.Get(key)
+		}
+	}
+	return nil, errors.ErrNotFound
+}
+
+// getRecordedBlocks returns the union of recorded blocks of all shards.
+func (b *shardedBackend) getRecordedBlocks() ([]byte, error) {
+	key := Stage1MetadataKey(metadataBlocks)
+	var (
+		blocks []BlockInterval
+		found  bool
+	)
+	for _, shard := range b.shards {
+		has, err := shard.db.Has(key)
+		if err != nil {
+			return nil, err
+		}
+		if !has {
+			continue
+		}
+		value, err := shard.db.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		var shardBlocks []BlockInterval
+		if err := rlp.DecodeBytes(value, &shardBlocks); err != nil {
+			return nil, fmt.Errorf("error decoding metadata %s of shard %s: %v", metadataBlocks, shard.Path, err)
+		}
+		for _, interval := range shardBlocks {
+			blocks = AddBlockInterval(blocks, interval.First, interval.Last)
+		}
+		found = true
+	}
+	if !found {
+		return nil, errors.ErrNotFound
+	}
+	if blocks == nil {
+		blocks = []BlockInterval{}
+	}
+	return rlp.EncodeToBytes(blocks)
+}
+
+func (b *shardedBackend) Put(key []byte, value []byte) error {
+	batch := b.NewBatch()
+	batch.Put(key, value)
+	return batch.Write()
+}
+
+func (b *shardedBackend) Delete(key []byte) error {
+	batch := b.NewBatch()
+	batch.Delete(key)
+	return batch.Write()
+}
+
+func (b *shardedBackend) NewBatch() ethdb.Batch {
+	return &shardedBatch{backend: b}
+}
+
+func (b *shardedBackend) NewIterator(prefix []byte, start []byte) ethdb.Iterator {
+	iters := make([]ethdb.Iterator, len(b.shards))
+	for i, shard := range b.shards {
+		iters[i] = shard.db.NewIterator(prefix, start)
+	}
+	return newMergedIterator(iters)
+}
+
+func (b *shardedBackend) Stat(property string) (string, error) {
+	var stats []string
+	for _, shard := range b.shards {
+		stat, err := shard.db.Stat(property)
+		if err != nil {
+			return "", fmt.Errorf("shard %s: %v", shard.Path, err)
+		}
+		stats = append(stats, fmt.Sprintf("shard %v-%v %s:\n%s", shard.First, shard.Last, shard.Path, stat))
+	}
+	return strings.Join(stats, "\n"), nil
+}
+
+func (b *shardedBackend) Compact(start []byte, limit []byte) error {
+	for _, shard := range b.shards {
+		if err := shard.db.Compact(start, limit); err != nil {
+			return fmt.Errorf("shard %s: %v", shard.Path, err)
+		}
+	}
+	return nil
+}
+
+func (b *shardedBackend) Close() error {
+	var firstErr error
+	for _, shard := range b.shards {
+		if err := shard.db.Close(); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("shard %s: %v", shard.Path, err)
+		}
+	}
+	return firstErr
+}
+
+type shardedBatchOp struct {
+	key, value []byte
+	delete     bool
+}
+
+// shardedBatch queues writes of shardedBackend and routes them to shards
+// on Write.
+type shardedBatch struct {
+	backend *shardedBackend
+	ops     []shardedBatchOp
+	size    int
+}
+
+func (b *shardedBatch) Put(key []byte, value []byte) error {
+	b.ops = append(b.ops, shardedBatchOp{key: append([]byte{}, key...), value: append([]byte{}, value...)})
+	b.size += len(key) + len(value)
+	return nil
+}
+
+func (b *shardedBatch) Delete(key []byte) error {
+	b.ops = append(b.ops, shardedBatchOp{key: append([]byte{}, key...), delete: true})
+	b.size += len(key)
+	return nil
+}
+
+func (b *shardedBatch) ValueSize() int {
+	return b.size
+}
+
+func (b *shardedBatch) Reset() {
+	b.ops = nil
+	b.size = 0
+}
+
+func (b *shardedBatch) Replay(w ethdb.KeyValueWriter) error {
+	for _, op := range b.ops {
+		if op.delete {
+			if err := w.Delete(op.key); err != nil {
+				return err
+			}
+		} else if err := w.Put(op.key, op.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write routes queued writes to shards. Code blobs and account records are
+// written to the shard of the next substate in the batch, which is the
+// substate that references them, or else of the previous one. Without any
+// substate in the batch, they are written to all shards.
+func (b *shardedBatch) Write() error {
+	shards := b.backend.shards
+	batches := make([]ethdb.Batch, len(shards))
+	batchOf := func(i int) ethdb.Batch {
+		if batches[i] == nil {
+			batches[i] = shards[i].db.NewBatch()
+		}
+		return batches[i]
+	}
+
+	// shard of the next block-keyed write after each write
+	next := make([]int, len(b.ops))
+	cur := -1
+	for j := len(b.ops) - 1; j >= 0; j-- {
+		if block, ok := keyBlock(b.ops[j].key); ok {
+			if cur = b.backend.shard(block); cur < 0 {
+				return fmt.Errorf("no shard for block %v in substate DB manifest", block)
+			}
+		}
+		next[j] = cur
+	}
+
+	prev := -1
+	for j, op := range b.ops {
+		var targets []int
+		switch {
+		case op.delete:
+			if _, ok := keyBlock(op.key); ok {
+				targets = []int{next[j]}
+			} else {
+				targets = allShards(len(shards))
+			}
+
+		case bytes.HasPrefix(op.key, []byte(stage1TxIndexPrefix)) && len(op.value) == 16:
+			block := binary.BigEndian.Uint64(op.value[:8])
+			i := b.backend.shard(block)
+			if i < 0 {
+				return fmt.Errorf("no shard for block %v in substate DB manifest", block)
+			}
+			targets = []int{i}
+
+		case bytes.Equal(op.key, Stage1MetadataKey(metadataBlocks)):
+			if err := b.putRecordedBlocks(op.value, batchOf); err != nil {
+				return err
+			}
+			continue
+
+		default:
+			if _, ok := keyBlock(op.key); ok {
+				targets = []int{next[j]}
+				prev = next[j]
+			} else if bytes.HasPrefix(op.key, []byte(stage1MetadataPrefix)) {
+				targets = allShards(len(shards))
+			} else if next[j] >= 0 {
+				targets = []int{next[j]}
+			} else if prev >= 0 {
+				targets = []int{prev}
+			} else {
+				targets = allShards(len(shards))
+			}
+		}
+
+		for _, i := range targets {
+			var err error
+			if op.delete {
+				err = batchOf(i).Delete(op.key)
+			} else {
+				err = batchOf(i).Put(op.key, op.value)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for i, batch := range batches {
+		if batch == nil {
+			continue
+		}
+		if err := batch.Write(); err != nil {
+			return fmt.Errorf("shard %s: %v", shards[i].Path, err)
+		}
+	}
+	return nil
+}
+
+// putRecordedBlocks writes the part of recorded blocks within each shard.
+func (b *shardedBatch) putRecordedBlocks(value []byte, batchOf func(int) ethdb.Batch) error {
+	var blocks []BlockInterval
+	if err := rlp.DecodeBytes(value, &blocks); err != nil {
+		return fmt.Errorf("error decoding metadata %s: %v", metadataBlocks, err)
+	}
+	for i, shard := range b.backend.shards {
+		shardBlocks := IntersectBlockIntervals(blocks, shard.First, shard.Last)
+		if shardBlocks == nil {
+			shardBlocks = []BlockInterval{}
+		}
+		shardValue, err := rlp.EncodeToBytes(shardBlocks)
+		if err != nil {
+			return err
+		}
+		if err := batchOf(i).Put(Stage1MetadataKey(metadataBlocks), shardValue); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func allShards(n int) []int {
+	all := make([]int, n)
+	for i := range all {
+		all[i] = i
+	}
+	return all
+}
+
+// mergedIterator iterates keys of multiple iterators in ascending order.
+// A key found in multiple iterators is yielded once with the value of the
+// first iterator.
+type mergedIterator struct {
+	iters []ethdb.Iterator
+	valid []bool // iters[i] is positioned at a key not yielded yet
+	cur   int
+	err   error
+}
+
+func newMergedIterator(iters []ethdb.Iterator) *mergedIterator {
+	it := &mergedIterator{
+		iters: iters,
+		valid: make([]bool, len(iters)),
+		cur:   -1,
+	}
+	for i, iter := range iters {
+		it.valid[i] = iter.Next()
+	}
+	return it
+}
+
+func (it *mergedIterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	// advance iterators positioned at the previous key
+	if it.cur >= 0 {
+		key := it.iters[it.cur].Key()
+		for i, iter := range it.iters {
+			if i != it.cur && it.valid[i] && bytes.Equal(iter.Key(), key) {
+				it.valid[i] = iter.Next()
+			}
+		}
+		it.valid[it.cur] = it.iters[it.cur].Next()
+	}
+
+	it.cur = -1
+	for i, iter := range it.iters {
+		if !it.valid[i] {
+			if err := iter.Error(); err != nil {
+				it.err = err
+				return false
+			}
+			continue
+		}
+		if it.cur < 0 || bytes.Compare(iter.Key(), it.iters[it.cur].Key()) < 0 {
+			it.cur = i
+		}
+	}
+	return it.cur >= 0
+}
+
+func (it *mergedIterator) Error() error {
+	return it.err
+}
+
+func (it *mergedIterator) Key() []byte {
+	if it.cur < 0 {
+		return nil
+	}
+	return it.iters[it.cur].Key()
+}
+
+func (it *mergedIterator) Value() []byte {
+	if it.cur < 0 {
+		return nil
+	}
+	return it.iters[it.cur].Value()
+}
+
+func (it *mergedIterator) Release() {
+	for _, iter := range it.iters {
+		iter.Release()
+	}
+}
@@ -0,0 +1,140 @@
+package research
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+)
+
+func TestShardedSubstateDB(t *testing.T) {
+	shards := []*shardBackend{
+		{SubstateDBShard{First: 0, Last: 99, Path: "a"}, rawdb.NewMemoryDatabase()},
+		{SubstateDBShard{First: 100, Last: 199, Path: "b"}, rawdb.NewMemoryDatabase()},
+	}
+	db := NewSubstateDB(newShardedBackend(shards))
+	db.SetLayout(DedupAccountLayout)
+
+	// substates of each shard have their own code
+	blocks := []uint64{50, 150, 60, 160}
+	for _, block := range blocks {
+		for tx := 0; tx < 2; tx++ {
+			if err := db.PutSubstate(block, tx, newTestSubstateWithCode(block)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.AddRecordedBlocks(block, block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.AddRecordedBlocks(90, 110); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.FlushRecordedBlocks(); err != nil {
+		t.Fatal(err)
+	}
+
+	// every shard is a substate DB on its own
+	for i, shard := range shards {
+		shardDB := NewSubstateDB(shard.db)
+		for _, block := range blocks {
+			has, err := shardDB.backend.Has(Stage1SubstateKey(block, 0))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := shard.First <= block && block <= shard.Last; has != want {
+				t.Fatalf("shard %v has substate of block %v: %v, want %v", i, block, has, want)
+			}
+			if !has {
+				continue
+			}
+			substate, err := shardDB.GetSubstate(block, 0)
+			if err != nil {
+				t.Fatalf("shard %v: %v", i, err)
+			}
+			if !substate.Equal(newTestSubstateWithCode(block)) {
+				t.Fatalf("shard %v: substate of block %v differs", i, block)
+			}
+		}
+	}
+
+	// reads of the sharded DB
+	for _, block := range blocks {
+		substate, err := db.GetSubstate(block, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := newTestSubstateWithCode(block)
+		if !substate.Equal(want) {
+			t.Fatalf("substate of block %v differs", block)
+		}
+		codeHash := want.InputAlloc[*want.Message.To].CodeHash()
+		if has, err := db.HasCode(codeHash); err != nil || !has {
+			t.Fatalf("code of block %v not found: %v", block, err)
+		}
+		code, err := db.GetCode(codeHash)
+		if err != nil || !bytes.Equal(code, want.InputAlloc[*want.Message.To].Code) {
+			t.Fatalf("code of block %v differs: %v", block, err)
+		}
+	}
+	iter := db.backend.NewIterator([]byte(stage1AccountPrefix), nil)
+	accounts := 0
+	for iter.Next() {
+		accountHash := common.BytesToHash(iter.Key()[len(stage1AccountPrefix):])
+		if _, err := db.GetAccountRLP(accountHash); err != nil {
+			t.Fatal(err)
+		}
+		accounts++
+	}
+	iter.Release()
+	if accounts == 0 {
+		t.Fatal("no account records")
+	}
+
+	// iteration across shards is in key order
+	it := db.NewSubstateIterator(0, 199, 2)
+	defer it.Release()
+	var keys []SubstateKey
+	for it.Next() {
+		keys = append(keys, SubstateKey{Block: it.Value().Block, Tx: it.Value().Tx})
+	}
+	if err := it.Error(); err != nil {
+		t.Fatal(err)
+	}
+	var wantKeys []SubstateKey
+	for _, block := range []uint64{50, 60, 150, 160} {
+		wantKeys = append(wantKeys, SubstateKey{block, 0}, SubstateKey{block, 1})
+	}
+	if !reflect.DeepEqual(keys, wantKeys) {
+		t.Fatalf("iterated %v, want %v", keys, wantKeys)
+	}
+
+	// recorded blocks are split by shard and merged on read
+	recorded, err := NewSubstateDB(newShardedBackend(shards)).getRecordedBlocks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantRecorded := []BlockInterval{{50, 50}, {60, 60}, {90, 110}, {150, 150}, {160, 160}}
+	if !reflect.DeepEqual(recorded, wantRecorded) {
+		t.Fatalf("recorded blocks %v, want %v", recorded, wantRecorded)
+	}
+	shardRecorded, err := NewSubstateDB(shards[0].db).getRecordedBlocks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []BlockInterval{{50, 50}, {60, 60}, {90, 99}}; !reflect.DeepEqual(shardRecorded, want) {
+		t.Fatalf("recorded blocks of shard 0 %v, want %v", shardRecorded, want)
+	}
+}
+
+// newTestSubstateWithCode returns newTestSubstate with the code of the
+// recipient written by TestShardedSubstateDB.
+func newTestSubstateWithCode(block uint64) *Substate {
+	substate := newTestSubstate(block, true)
+	code := bytes.Repeat([]byte{0x60, byte(block)}, 32)
+	substate.InputAlloc[*substate.Message.To].Code = code
+	substate.OutputAlloc[*substate.Message.To].Code = code
+	return substate
+}
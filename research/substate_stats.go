@@ -0,0 +1,196 @@
+package research
+
+import (
+	"container/heap"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// SubstateSize is the stored size of a substate value.
+type SubstateSize struct {
+	Block uint64 `json:"block"`
+	Tx    int    `json:"tx"`
+	Bytes int64  `json:"bytes"`
+}
+
+// SubstateStats describes substates in a range of blocks. Component sizes
+// are sizes of RLP-encoded components before compression, so account
+// states referenced by hash in DedupAccountLayout are counted as hashes.
+type SubstateStats struct {
+	First uint64 `json:"first"`
+	Last  uint64 `json:"last"`
+
+	NumSubstates int64 `json:"substates"`
+	NumBlocks    int64 `json:"blocks"` // blocks with substates
+	ValueBytes   int64 `json:"valueBytes"`
+
+	InputAllocBytes  int64 `json:"inputAllocBytes"`
+	OutputAllocBytes int64 `json:"outputAllocBytes"`
+	EnvBytes         int64 `json:"envBytes"`
+	MessageBytes     int64 `json:"messageBytes"`
+	ResultBytes      int64 `json:"resultBytes"`
+
+	NumCodes  int64 `json:"codes"` // distinct code blobs referenced by substates
+	CodeBytes int64 `json:"codeBytes"`
+
+	Formats     map[string]int64 `json:"formats"`     // substates per SubstateFormat, detected format of unversioned substates
+	Compression map[string]int64 `json:"compression"` // substates per compressor, "none" if uncompressed
+
+	Largest []*SubstateSize `json:"largest"` // largest substate values in descending order
+}
+
+// substateSizeHeap is a min-heap of substate sizes.
+type substateSizeHeap []*SubstateSize
+
+func (h substateSizeHeap) Len() int            { return len(h) }
+func (h substateSizeHeap) Less(i, j int) bool  { return h[i].Bytes < h[j].Bytes }
+func (h substateSizeHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *substateSizeHeap) Push(x interface{}) { *h = append(*h, x.(*SubstateSize)) }
+func (h *substateSizeHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// Stats scans substates from block first to block last (inclusive) and
+// returns their statistics with the given number of largest substates.
+func (db *SubstateDB) Stats(first, last uint64, numLargest int) (*SubstateStats, error) {
+	stats := &SubstateStats{
+		First:       first,
+		Last:        last,
+		Formats:     make(map[string]int64),
+		Compression: make(map[string]int64),
+	}
+	codes := make(map[common.Hash]struct{})
+	largest := &substateSizeHeap{}
+
+	addCode := func(codeHash common.Hash) error {
+		if codeHash == EmptyCodeHash {
+			return nil
+		}
+		if _, exist := codes[codeHash]; exist {
+			return nil
+		}
+		codes[codeHash] = struct{}{}
+		code, err := db.GetCode(codeHash)
+		if err != nil {
+			return err
+		}
+		stats.NumCodes++
+		stats.CodeBytes += int64(len(code))
+		return nil
+	}
+
+	start := make([]byte, 8)
+	binary.BigEndian.PutUint64(start, first)
+	iter := db.backend.NewIterator([]byte(stage1SubstatePrefix), start)
+	defer iter.Release()
+
+	var (
+		started  bool
+		curBlock uint64
+	)
+	for iter.Next() {
+		key := iter.Key()
+		value := iter.Value()
+
+		block, tx, err := DecodeStage1SubstateKey(key)
+		if err != nil {
+			return stats, fmt.Errorf("record-replay: invalid substate key %#x: %v", key, err)
+		}
+		if block > last {
+			break
+		}
+		if !started || block != curBlock {
+			started, curBlock = true, block
+			stats.NumBlocks++
+		}
+		stats.NumSubstates++
+		stats.ValueBytes += int64(len(value))
+
+		heap.Push(largest, &SubstateSize{Block: block, Tx: tx, Bytes: int64(len(value))})
+		if largest.Len() > numLargest {
+			heap.Pop(largest)
+		}
+
+		inner, c, err := UnwrapSubstateValue(value)
+		if err != nil {
+			return stats, &SubstateError{Block: block, Tx: tx, Err: err}
+		}
+		if c == nil {
+			stats.Compression["none"]++
+		} else {
+			stats.Compression[c.Name()]++
+		}
+
+		substateRLP, format, err := db.DecodeSubstateRLP(inner)
+		if err != nil {
+			return stats, &SubstateError{Block: block, Tx: tx, Err: err}
+		}
+		if IsVersionedSubstateValue(inner) {
+			stats.Formats[format.String()]++
+		} else {
+			stats.Formats["unversioned "+format.String()]++
+		}
+
+		if err := stats.addComponentBytes(inner); err != nil {
+			return stats, &SubstateError{Block: block, Tx: tx, Err: err}
+		}
+
+		for _, allocRLP := range []SubstateAllocRLP{substateRLP.InputAlloc, substateRLP.OutputAlloc} {
+			for _, saRLP := range allocRLP.Accounts {
+				if err := addCode(saRLP.CodeHash); err != nil {
+					return stats, &SubstateError{Block: block, Tx: tx, Err: err}
+				}
+			}
+		}
+		if msgRLP := substateRLP.Message; msgRLP != nil && msgRLP.InitCodeHash != nil {
+			if err := addCode(*msgRLP.InitCodeHash); err != nil {
+				return stats, &SubstateError{Block: block, Tx: tx, Err: err}
+			}
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return stats, err
+	}
+
+	stats.Largest = make([]*SubstateSize, largest.Len())
+	for i := len(stats.Largest) - 1; i >= 0; i-- {
+		stats.Largest[i] = heap.Pop(largest).(*SubstateSize)
+	}
+
+	return stats, nil
+}
+
+// addComponentBytes adds sizes of the 5 components of an uncompressed
+// substate value, which are the same in all formats.
+func (stats *SubstateStats) addComponentBytes(inner []byte) error {
+	payload := inner
+	if IsVersionedSubstateValue(inner) {
+		payload = inner[1:]
+	}
+	content, _, err := rlp.SplitList(payload)
+	if err != nil {
+		return err
+	}
+	components := []*int64{
+		&stats.InputAllocBytes,
+		&stats.OutputAllocBytes,
+		&stats.EnvBytes,
+		&stats.MessageBytes,
+		&stats.ResultBytes,
+	}
+	for _, size := range components {
+		_, _, rest, err := rlp.Split(content)
+		if err != nil {
+			return err
+		}
+		*size += int64(len(content) - len(rest))
+		content = rest
+	}
+	return nil
+}
@@ -3,6 +3,7 @@ package research
 import (
 	"fmt"
 	"runtime"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -28,6 +29,10 @@ var (
 		Name:  "skip-create-txs",
 		Usage: "Skip executing CREATE transactions",
 	}
+	TxsPerTaskFlag = cli.IntFlag{
+		Name:  "txs-per-task",
+		Usage: "Split blocks with more transactions into tasks of at most this many transactions, 0 to schedule whole blocks",
+	}
 )
 
 // Abstract the behvaior of replay
@@ -86,10 +91,22 @@ type SubstateTaskPool struct {
 	Last  uint64
 
 	Workers         int
+	TxsPerTask      int // maximum number of transactions per task, 0 for whole blocks
 	SkipTransferTxs bool
 	SkipCallTxs     bool
 	SkipCreateTxs   bool
 
+	Selector *SubstateSelector // transactions selected by --tx-hash and --address, nil for all transactions
+	Filter   *SubstateFilter   // transactions matching --filter, nil for all transactions
+
+	CheckpointDir string // directory to write checkpoints to, empty for no checkpoints
+	Resume        bool   // resume from the checkpoint in CheckpointDir
+
+	KeepGoing   bool   // continue after failed transactions instead of stopping
+	FailureFile string // file to write failed transactions to with KeepGoing
+
+	failures *txFailureLog // failures of the running Execute with KeepGoing
+
 	Ctx *cli.Context // CLI context required to read additional flags
 
 	DB *SubstateDB
@@ -99,6 +116,7 @@ func NewSubstateTaskPool(name string,
 	workerAction WorkerAction,
 	collectorAction CollectorAction, collectorInit CollectorInit,
 	first, last uint64,
+	db *SubstateDB,
 	ctx *cli.Context) *SubstateTaskPool {
 	return &SubstateTaskPool{
 		Name:            name,
@@ -110,45 +128,110 @@ func NewSubstateTaskPool(name string,
 		Last:  last,
 
 		Workers:         ctx.Int(WorkersFlag.Name),
+		TxsPerTask:      ctx.Int(TxsPerTaskFlag.Name),
 		SkipTransferTxs: ctx.Bool(SkipTransferTxsFlag.Name),
 		SkipCallTxs:     ctx.Bool(SkipCallTxsFlag.Name),
 		SkipCreateTxs:   ctx.Bool(SkipCreateTxsFlag.Name),
 
+		CheckpointDir: ctx.String(CheckpointDirFlag.Name),
+		Resume:        ctx.Bool(ResumeFlag.Name),
+		KeepGoing:     ctx.Bool(KeepGoingFlag.Name),
+		FailureFile:   ctx.String(FailureFileFlag.Name),
+
 		Ctx: ctx,
 
-		DB: staticSubstateDB,
+		DB: db,
 	}
 }
 
+// maxPendingBlocks is the number of blocks per worker that may be scheduled
+// ahead of the next block to be collected
+const maxPendingBlocks = 100
+
+// substateBlockTask is a unit of work for a worker: all substates of a block,
+// or a part of them if the block is split by TxsPerTask
+type substateBlockTask struct {
+	block   uint64
+	entries []*SubstateEntry
+	err     error
+
+	part, parts int // index of the part and number of parts of a split block
+}
+
+// substateBlockPart is the result of a part of a split block
+type substateBlockPart struct {
+	part, parts int
+	results     BlockResult
+}
+
+// splitTask splits a block task into tasks of at most TxsPerTask substates
+// in tx order.
+func (pool *SubstateTaskPool) splitTask(task *substateBlockTask) []*substateBlockTask {
+	n := pool.TxsPerTask
+	if n <= 0 || task.err != nil || len(task.entries) <= n {
+		return []*substateBlockTask{task}
+	}
+
+	parts := (len(task.entries) + n - 1) / n
+	tasks := make([]*substateBlockTask, 0, parts)
+	for i := 0; i < parts; i++ {
+		end := (i + 1) * n
+		if end > len(task.entries) {
+			end = len(task.entries)
+		}
+		tasks = append(tasks, &substateBlockTask{
+			block:   task.block,
+			entries: task.entries[i*n : end],
+			part:    i,
+			parts:   parts,
+		})
+	}
+	return tasks
+}
+
 // ExecuteBlock function iterates on substates of a given block call TaskFunc
 func (pool *SubstateTaskPool) ExecuteBlock(block uint64) (results BlockResult, err error) {
+	txSubstate, err := pool.DB.GetBlockSubstates(block)
+	if err != nil {
+		results.BlockId = block
+		return results, fmt.Errorf("%s: %v", pool.Name, err)
+	}
+
+	entries := make([]*SubstateEntry, 0, len(txSubstate))
+	for tx, substate := range txSubstate {
+		entries = append(entries, &SubstateEntry{Block: block, Tx: tx, Substate: substate})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Tx < entries[j].Tx })
+
+	return pool.executeEntries(block, entries)
+}
+
+// executeEntries calls WorkerAction on substates of a given block in tx order.
+// Errors and panics of WorkerAction fail the block, or are written to the
+// failure file with KeepGoing and leave out the result of the transaction.
+func (pool *SubstateTaskPool) executeEntries(block uint64, entries []*SubstateEntry) (results BlockResult, err error) {
 	results.BlockId = block
-	var res WorkerResult
-	for tx, substate := range pool.DB.GetBlockSubstates(block) {
-		alloc := substate.InputAlloc
-		msg := substate.Message
-
-		to := msg.To
-		if pool.SkipTransferTxs && to != nil {
-			// skip regular transactions (ETH transfer)
-			if account, exist := alloc[*to]; !exist || len(account.Code) == 0 {
-				continue
-			}
-		}
-		if pool.SkipCallTxs && to != nil {
-			// skip CALL trasnactions with contract bytecode
-			if account, exist := alloc[*to]; exist && len(account.Code) > 0 {
-				continue
-			}
+	for _, entry := range entries {
+		tx, substate := entry.Tx, entry.Substate
+		if pool.skipTx(substate.TxKind()) {
+			continue
 		}
-		if pool.SkipCreateTxs && to == nil {
-			// skip CREATE transactions
+		if pool.Filter != nil && !pool.Filter.Match(substate) {
 			continue
 		}
 
-		res, err = pool.WorkerAction(block, tx, substate)
-		if err != nil {
-			return results, fmt.Errorf("%s: %v_%v: %v", pool.Name, block, tx, err)
+		res, failure := pool.callWorkerAction(block, tx, substate)
+		if failure != nil {
+			if pool.failures == nil {
+				if failure.Stack != "" {
+					return results, fmt.Errorf("%s: %v\n%s", pool.Name, failure, failure.Stack)
+				}
+				return results, fmt.Errorf("%s: %v", pool.Name, failure)
+			}
+			if err := pool.failures.add(failure); err != nil {
+				return results, fmt.Errorf("%s: %v", pool.Name, err)
+			}
+			continue
 		}
 		results.Results = append(results.Results, res)
 	}
@@ -156,8 +239,55 @@ func (pool *SubstateTaskPool) ExecuteBlock(block uint64) (results BlockResult, e
 	return results, nil
 }
 
+// skipTx reports whether transactions of the given kind are skipped by
+// --skip-* flags.
+func (pool *SubstateTaskPool) skipTx(kind SubstateTxKind) bool {
+	switch kind {
+	case TransferTx:
+		// skip regular transactions (ETH transfer)
+		return pool.SkipTransferTxs
+	case CallTx:
+		// skip CALL trasnactions with contract bytecode
+		return pool.SkipCallTxs
+	case CreateTx:
+		// skip CREATE transactions
+		return pool.SkipCreateTxs
+	default:
+		return false
+	}
+}
+
+// skipBlock reports whether all transactions of a block are skipped by
+// --skip-* flags according to its block summary. Blocks without a summary
+// are never skipped.
+func (pool *SubstateTaskPool) skipBlock(block uint64) bool {
+	if !pool.SkipTransferTxs && !pool.SkipCallTxs && !pool.SkipCreateTxs {
+		return false
+	}
+	summary, err := pool.DB.GetBlockSummary(block)
+	if err != nil || summary == nil {
+		return false
+	}
+	var numTxs uint64
+	for _, kind := range []SubstateTxKind{TransferTx, CallTx, CreateTx} {
+		if !pool.skipTx(kind) {
+			numTxs += summary.NumTxsOf(kind)
+		}
+	}
+	return numTxs == 0
+}
+
 // Execute function spawns worker goroutines and schedule tasks.
-func (pool *SubstateTaskPool) Execute() (res CollectorResult, err error) {
+// Results of finished blocks are buffered and passed to CollectorAction
+// strictly in ascending block order; at most maxPendingBlocks blocks per
+// worker are scheduled ahead of the collector to bound memory.
+// With KeepGoing, failed transactions, including substates that cannot be
+// decoded, are written to FailureFile and summarized by signature at the end
+// instead of stopping the execution.
+// With CheckpointDir, a checkpoint of the collected blocks and the collector
+// result is written to it regularly, and Resume continues from there.
+// Execute returns the final collector result.
+func (pool *SubstateTaskPool) Execute() (CollectorResult, error) {
 	start := time.Now()
 
 	var totalNumBlock, totalNumTx int64
@@ -172,6 +302,9 @@ func (pool *SubstateTaskPool) Execute() (res CollectorResult, err error) {
 		fmt.Printf("%s: total #block = %v\n", pool.Name, nb)
 		fmt.Printf("%s: total #tx    = %v\n", pool.Name, nt)
 		fmt.Printf("%s: %.2f blk/s, %.2f tx/s\n", pool.Name, blkPerSec, txPerSec)
+		if hits, misses := pool.DB.CodeCacheStats(); hits+misses > 0 {
+			fmt.Printf("%s: code cache: %v hits, %v misses\n", pool.Name, hits, misses)
+		}
 		fmt.Printf("%s done in %v\n", pool.Name, duration.Round(1*time.Millisecond))
 	}()
 
@@ -182,40 +315,74 @@ func (pool *SubstateTaskPool) Execute() (res CollectorResult, err error) {
 	}
 
 	fmt.Printf("%s: block range = %v %v\n", pool.Name, pool.First, pool.Last)
+
+	collectorResult := pool.CollectorInit()
+	first, done, err := pool.loadCheckpoint(collectorResult)
+	if err != nil {
+		return collectorResult, fmt.Errorf("%s: %v", pool.Name, err)
+	}
+	if done {
+		return collectorResult, nil
+	}
+
+	if pool.KeepGoing {
+		pool.failures, err = openTxFailureLog(pool.FailureFile, pool.Resume, first)
+		if err != nil {
+			return collectorResult, fmt.Errorf("%s: %v", pool.Name, err)
+		}
+		defer func() {
+			pool.failures.printSummary(pool.Name)
+			pool.failures.close()
+			pool.failures = nil
+		}()
+	}
+
 	fmt.Printf("%s: #CPU = %v, #worker = %v\n", pool.Name, runtime.NumCPU(), pool.Workers)
 
-	workChan := make(chan uint64, pool.Workers*10)
+	workChan := make(chan *substateBlockTask, pool.Workers*10)
 	doneChan := make(chan interface{}, pool.Workers*10)
-	stopChan := make(chan struct{}, pool.Workers)
+	// a slot of windowChan is taken for every scheduled block and released
+	// when the collector has consumed the block
+	windowChan := make(chan struct{}, pool.Workers*maxPendingBlocks)
+	stopChan := make(chan struct{})
 	wg := sync.WaitGroup{}
 	defer func() {
-		// stop all workers
-		for i := 0; i < pool.Workers; i++ {
-			stopChan <- struct{}{}
-		}
-		// stop work producer (1)
-		stopChan <- struct{}{}
-
+		// stop all workers and work producer (1)
+		close(stopChan)
 		wg.Wait()
-		close(workChan)
-		close(doneChan)
 	}()
-	// dynamically schedule one block per worker
+	// dynamically schedule one block, or one part of a split block, per worker
 	for i := 0; i < pool.Workers; i++ {
 		wg.Add(1)
 		// worker goroutine
 		go func() {
 			defer wg.Done()
 
+			done := func(data interface{}) bool {
+				select {
+				case doneChan <- data:
+					return true
+				case <-stopChan:
+					return false
+				}
+			}
+
 			for {
 				select {
 
-				case block := <-workChan:
-					results, err := pool.ExecuteBlock(block)
-					if err != nil {
-						doneChan <- err
+				case task := <-workChan:
+					var data interface{}
+					if task.err != nil {
+						data = task.err
+					} else if results, err := pool.executeEntries(task.block, task.entries); err != nil {
+						data = err
+					} else if task.parts > 1 {
+						data = &substateBlockPart{part: task.part, parts: task.parts, results: results}
 					} else {
-						doneChan <- results
+						data = results
+					}
+					if !done(data) {
+						return
 					}
 
 				case <-stopChan:
@@ -226,34 +393,98 @@ func (pool *SubstateTaskPool) Execute() (res CollectorResult, err error) {
 		}()
 	}
 
-	// wait until all workers finish all tasks
+	// stream substates in key order and schedule them block by block
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
 
-		for block := pool.First; block <= pool.Last; block++ {
+		send := func(task *substateBlockTask) bool {
 			select {
-
-			case workChan <- block:
-				continue
-
+			case windowChan <- struct{}{}:
 			case <-stopChan:
+				return false
+			}
+			for _, t := range pool.splitTask(task) {
+				select {
+				case workChan <- t:
+				case <-stopChan:
+					return false
+				}
+			}
+			return true
+		}
+
+		var iter *SubstateIterator
+		if pool.Selector != nil {
+			keys, err := pool.DB.SelectSubstates(pool.Selector, first, pool.Last)
+			if err != nil {
+				send(&substateBlockTask{block: first, err: fmt.Errorf("%s: %v", pool.Name, err)})
 				return
+			}
+			iter = pool.DB.NewSelectedSubstateIterator(keys, pool.Workers)
+		} else {
+			iter = pool.DB.NewFilteredSubstateIterator(first, pool.Last, pool.Workers, pool.skipBlock)
+		}
+		defer iter.Release()
+		if pool.failures != nil {
+			// substates that cannot be decoded are failed transactions
+			iter.SkipDecodeErrors(func(err *SubstateError) error {
+				return pool.failures.add(&TxFailure{Block: err.Block, Tx: err.Tx, Error: err.Err.Error()})
+			})
+		}
 
+		block := first
+		var entries []*SubstateEntry
+		for iter.Next() {
+			entry := iter.Value()
+			// schedule finished blocks, including blocks without substates
+			for ; block < entry.Block; block++ {
+				if !send(&substateBlockTask{block: block, entries: entries}) {
+					return
+				}
+				entries = nil
 			}
+			entries = append(entries, entry)
+		}
+		if err := iter.Error(); err != nil {
+			send(&substateBlockTask{block: block, err: fmt.Errorf("%s: %v", pool.Name, err)})
+			return
+		}
+		for ; block <= pool.Last; block++ {
+			if !send(&substateBlockTask{block: block, entries: entries}) {
+				return
+			}
+			entries = nil
 		}
 	}()
 
-	// Count finished blocks in order and report execution speed
+	// Collect finished blocks in order and report execution speed
 	var lastSec float64
 	var lastNumBlock, lastNumTx int64
-	waitMap := make(map[uint64]struct{})
-	collectorResult := pool.CollectorInit()
-	for block := pool.First; block <= pool.Last; {
+	lastCheckpoint := time.Now()
+	pending := make(map[uint64]BlockResult)
+	partial := make(map[uint64][][]WorkerResult) // results of parts of split blocks
+	remaining := make(map[uint64]int)            // number of parts not finished yet
+	for block := first; block <= pool.Last; {
+
+		// Collect finished blocks from pending in order
+		if blockResult, ok := pending[block]; ok {
+			delete(pending, block)
 
-		// Count finshed blocks from waitMap in order
-		if _, ok := waitMap[block]; ok {
-			delete(waitMap, block)
+			err := pool.CollectorAction(blockResult, &collectorResult)
+			if err != nil {
+				return collectorResult, fmt.Errorf("%s: %v: %v", pool.Name, block, err)
+			}
+			totalNumTx += int64(len(blockResult.Results))
+			totalNumBlock += 1
+			<-windowChan
+
+			if time.Since(lastCheckpoint) > checkpointInterval {
+				if err := pool.saveCheckpoint(block, collectorResult); err != nil {
+					return collectorResult, fmt.Errorf("%s: %v", pool.Name, err)
+				}
+				lastCheckpoint = time.Now()
+			}
 
 			block++
 			continue
@@ -280,20 +511,37 @@ func (pool *SubstateTaskPool) Execute() (res CollectorResult, err error) {
 		switch t := data.(type) {
 
 		case BlockResult:
-			var err error
-			blockResult := BlockResult(data.(BlockResult))
-			blockId := blockResult.BlockId
-			nt := int64(len(blockResult.Results))
-			waitMap[blockId] = struct{}{}
-			err = pool.CollectorAction(blockResult, &collectorResult)
-			if err != nil {
-				panic(err)
+			pending[t.BlockId] = t
+
+		case *substateBlockPart:
+			blockId := t.results.BlockId
+			if _, ok := partial[blockId]; !ok {
+				partial[blockId] = make([][]WorkerResult, t.parts)
+				remaining[blockId] = t.parts
 			}
-			totalNumTx += nt
-			totalNumBlock += 1
+			partial[blockId][t.part] = t.results.Results
+			remaining[blockId]--
+			if remaining[blockId] > 0 {
+				break
+			}
+
+			// concatenate results of all parts in tx order
+			blockResult := BlockResult{BlockId: blockId}
+			for _, results := range partial[blockId] {
+				blockResult.Results = append(blockResult.Results, results...)
+			}
+			pending[blockId] = blockResult
+			delete(partial, blockId)
+			delete(remaining, blockId)
+
 		case error:
-			err := data.(error)
-			return res, err
+			// keep the progress of blocks collected so far
+			if block > first {
+				if err := pool.saveCheckpoint(block-1, collectorResult); err != nil {
+					fmt.Printf("%s: %v\n", pool.Name, err)
+				}
+			}
+			return collectorResult, t
 
 		default:
 			panic(fmt.Errorf("%s: unknown type %T value from doneChan", pool.Name, t))
@@ -301,5 +549,12 @@ func (pool *SubstateTaskPool) Execute() (res CollectorResult, err error) {
 		}
 	}
 
-	return res, nil
+	if err := pool.saveCheckpoint(pool.Last, collectorResult); err != nil {
+		return collectorResult, fmt.Errorf("%s: %v", pool.Name, err)
+	}
+	if pool.failures != nil && pool.failures.count > 0 {
+		return collectorResult, fmt.Errorf("%s: %v transactions failed", pool.Name, pool.failures.count)
+	}
+
+	return collectorResult, nil
 }
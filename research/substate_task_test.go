@@ -0,0 +1,157 @@
+package research
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/core/rawdb"
+)
+
+// newTestTaskDB returns a substate DB with the given number of substates in
+// each block, indexed by block number.
+func newTestTaskDB(t *testing.T, txs []int) *SubstateDB {
+	db := NewSubstateDB(rawdb.NewMemoryDatabase())
+	for block, n := range txs {
+		for tx := 0; tx < n; tx++ {
+			if err := db.PutSubstate(uint64(block), tx, newTestSubstate(uint64(block), false)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	return db
+}
+
+// collectedBlocks is a collector result that records collected blocks and
+// the transactions of their results in collection order.
+type collectedBlocks struct {
+	blocks []uint64
+	txs    [][]int
+}
+
+func collectBlocks(result BlockResult, prev *CollectorResult) error {
+	c := (*prev).(*collectedBlocks)
+	c.blocks = append(c.blocks, result.BlockId)
+	var txs []int
+	for _, res := range result.Results {
+		txs = append(txs, res.(*VanillaWorkerResult).TxId)
+	}
+	c.txs = append(c.txs, txs)
+	return nil
+}
+
+func checkCollectedBlocks(t *testing.T, c *collectedBlocks, first, last uint64, txs []int) {
+	t.Helper()
+	if len(c.blocks) != int(last-first+1) {
+		t.Fatalf("collected %v blocks, want %v", len(c.blocks), last-first+1)
+	}
+	for i, block := range c.blocks {
+		if block != first+uint64(i) {
+			t.Fatalf("collected block %v at position %v, want block %v", block, i, first+uint64(i))
+		}
+		if len(c.txs[i]) != txs[block] {
+			t.Fatalf("block %v has %v results, want %v", block, len(c.txs[i]), txs[block])
+		}
+		for tx, id := range c.txs[i] {
+			if id != tx {
+				t.Fatalf("block %v has result of tx %v at position %v", block, id, tx)
+			}
+		}
+	}
+}
+
+func TestSubstateTaskPoolOrder(t *testing.T) {
+	// blocks 3, 6 and 9 have no substates
+	txs := []int{0, 1, 3, 0, 2, 1, 0, 5, 1, 0, 2, 3}
+	db := newTestTaskDB(t, txs)
+
+	for _, txsPerTask := range []int{0, 2} {
+		pool := &SubstateTaskPool{
+			Name: "test",
+			WorkerAction: func(block uint64, tx int, substate *Substate) (WorkerResult, error) {
+				// earlier blocks and transactions finish later
+				time.Sleep(time.Duration(len(txs)-int(block)+5-tx) * time.Millisecond)
+				return &VanillaWorkerResult{BlockId: block, TxId: tx}, nil
+			},
+			CollectorAction: collectBlocks,
+			CollectorInit:   func() CollectorResult { return &collectedBlocks{} },
+			First:           1,
+			Last:            uint64(len(txs) - 1),
+			Workers:         4,
+			TxsPerTask:      txsPerTask,
+			DB:              db,
+		}
+		result, err := pool.Execute()
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkCollectedBlocks(t, result.(*collectedBlocks), pool.First, pool.Last, txs)
+	}
+}
+
+func TestSubstateTaskPoolWindow(t *testing.T) {
+	const workers = 2
+	window := workers * maxPendingBlocks
+
+	txs := make([]int, 2*window)
+	for i := range txs {
+		txs[i] = 1
+	}
+	db := newTestTaskDB(t, txs)
+
+	var (
+		started int64
+		release = make(chan struct{})
+		once    sync.Once
+	)
+	pool := &SubstateTaskPool{
+		Name: "test",
+		WorkerAction: func(block uint64, tx int, substate *Substate) (WorkerResult, error) {
+			// the first block is collected only after release
+			if block == 0 {
+				<-release
+			} else {
+				atomic.AddInt64(&started, 1)
+			}
+			return &VanillaWorkerResult{BlockId: block, TxId: tx}, nil
+		},
+		CollectorAction: collectBlocks,
+		CollectorInit:   func() CollectorResult { return &collectedBlocks{} },
+		First:           0,
+		Last:            uint64(len(txs) - 1),
+		Workers:         workers,
+		DB:              db,
+	}
+	defer once.Do(func() { close(release) })
+
+	type executeResult struct {
+		result CollectorResult
+		err    error
+	}
+	done := make(chan executeResult, 1)
+	go func() {
+		result, err := pool.Execute()
+		done <- executeResult{result, err}
+	}()
+
+	// blocks after the first block are scheduled until the window is full
+	deadline := time.Now().Add(10 * time.Second)
+	for atomic.LoadInt64(&started) < int64(window-1) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%v blocks started, want %v", atomic.LoadInt64(&started), window-1)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := atomic.LoadInt64(&started); n != int64(window-1) {
+		t.Fatalf("%v blocks started while the first block is pending, want %v", n, window-1)
+	}
+
+	once.Do(func() { close(release) })
+	res := <-done
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	checkCollectedBlocks(t, res.result.(*collectedBlocks), pool.First, pool.Last, txs)
+}
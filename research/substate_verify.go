@@ -0,0 +1,238 @@
+package research
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// Kinds of problems reported by Verify
+const (
+	InvalidKeyFinding   = "invalid-key"   // key under stage1SubstatePrefix that cannot be decoded
+	UndecodableFinding  = "undecodable"   // substate value that cannot be decoded
+	MissingCodeFinding  = "missing-code"  // code referenced by an account or a CREATE message is missing
+	OrphanedCodeFinding = "orphaned-code" // code not referenced by any substate
+	TxGapFinding        = "tx-gap"        // missing transaction indices within a block, except pruned ones
+)
+
+// VerifyFinding is a problem found by Verify. Block and Tx are zero for
+// findings that do not belong to a substate.
+type VerifyFinding struct {
+	Kind   string `json:"kind"`
+	Block  uint64 `json:"block"`
+	Tx     int    `json:"tx"`
+	Detail string `json:"detail"`
+}
+
+func (f *VerifyFinding) String() string {
+	return fmt.Sprintf("%v_%v: %s: %s", f.Block, f.Tx, f.Kind, f.Detail)
+}
+
+// VerifyStats counts what Verify checked.
+type VerifyStats struct {
+	NumSubstates int64
+	NumBlocks    int64
+	NumCodes     int64 // code blobs checked for references, only with orphans
+	NumFindings  int64
+}
+
+// substateVerifier checks substate values for missing code.
+type substateVerifier struct {
+	db    *SubstateDB
+	stats *VerifyStats
+	emit  func(*VerifyFinding)
+
+	// codes maps code hashes to their presence under stage1CodePrefix
+	codes map[common.Hash]bool
+}
+
+func newSubstateVerifier(db *SubstateDB, report func(*VerifyFinding)) *substateVerifier {
+	v := &substateVerifier{db: db, stats: &VerifyStats{}, codes: make(map[common.Hash]bool)}
+	v.emit = func(f *VerifyFinding) {
+		v.stats.NumFindings++
+		report(f)
+	}
+	return v
+}
+
+func (v *substateVerifier) checkCode(block uint64, tx int, codeHash common.Hash, what string) error {
+	if codeHash == EmptyCodeHash {
+		return nil
+	}
+	has, checked := v.codes[codeHash]
+	if !checked {
+		var err error
+		has, err = v.db.HasCode(codeHash)
+		if err != nil {
+			return err
+		}
+		v.codes[codeHash] = has
+	}
+	if !has {
+		v.emit(&VerifyFinding{Kind: MissingCodeFinding, Block: block, Tx: tx,
+			Detail: fmt.Sprintf("code %s of %s", codeHash.Hex(), what)})
+	}
+	return nil
+}
+
+func (v *substateVerifier) checkAlloc(block uint64, tx int, allocRLP SubstateAllocRLP, name string) error {
+	for i, saRLP := range allocRLP.Accounts {
+		if saRLP == nil || i >= len(allocRLP.Addresses) {
+			continue
+		}
+		what := fmt.Sprintf("%s account %s", name, allocRLP.Addresses[i].Hex())
+		if err := v.checkCode(block, tx, saRLP.CodeHash, what); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkSubstate checks that a substate value can be decoded and that the
+// code it references exists.
+func (v *substateVerifier) checkSubstate(block uint64, tx int, value []byte) error {
+	v.stats.NumSubstates++
+
+	substateRLP, _, err := v.db.DecodeSubstateRLP(value)
+	if err != nil {
+		v.emit(&VerifyFinding{Kind: UndecodableFinding, Block: block, Tx: tx, Detail: err.Error()})
+		return nil
+	}
+	if err := v.checkAlloc(block, tx, substateRLP.InputAlloc, "InputAlloc"); err != nil {
+		return &SubstateError{Block: block, Tx: tx, Err: err}
+	}
+	if err := v.checkAlloc(block, tx, substateRLP.OutputAlloc, "OutputAlloc"); err != nil {
+		return &SubstateError{Block: block, Tx: tx, Err: err}
+	}
+	if msgRLP := substateRLP.Message; msgRLP != nil && msgRLP.To == nil && msgRLP.InitCodeHash != nil {
+		if err := v.checkCode(block, tx, *msgRLP.InitCodeHash, "init code"); err != nil {
+			return &SubstateError{Block: block, Tx: tx, Err: err}
+		}
+	}
+	return nil
+}
+
+// Verify checks substates from block first to block last (inclusive) and
+// calls report for every problem found. Orphaned code blobs are only
+// checked if orphans is true, which is meaningful only if the range covers
+// all substates of the substate DB. Code referenced only by undecodable
+// substates is reported as orphaned. Transaction indices that the
+// BlockSummary marks as pruned are not tx gaps.
+func (db *SubstateDB) Verify(first, last uint64, orphans bool, report func(*VerifyFinding)) (*VerifyStats, error) {
+	v := newSubstateVerifier(db, report)
+	stats := v.stats
+
+	var (
+		curBlock uint64
+		nextTx   int
+		started  bool
+		summary  *BlockSummary // summary of curBlock, nil if it has none
+	)
+
+	start := make([]byte, 8)
+	binary.BigEndian.PutUint64(start, first)
+	iter := db.backend.NewIterator([]byte(stage1SubstatePrefix), start)
+	defer iter.Release()
+
+	for iter.Next() {
+		key := iter.Key()
+		block, tx, err := DecodeStage1SubstateKey(key)
+		if err != nil {
+			v.emit(&VerifyFinding{Kind: InvalidKeyFinding, Detail: fmt.Sprintf("key %#x: %v", key, err)})
+			continue
+		}
+		if block > last {
+			break
+		}
+
+		// check contiguous tx indices except pruned ones
+		if !started || block != curBlock {
+			started = true
+			curBlock, nextTx = block, 0
+			stats.NumBlocks++
+			summary, err = db.GetBlockSummary(block)
+			if err != nil {
+				return stats, err
+			}
+		}
+		summary.missingTxs(nextTx, tx-1, func(first, last int) {
+			detail := fmt.Sprintf("missing tx %v", first)
+			if last > first {
+				detail = fmt.Sprintf("missing tx %v to %v", first, last)
+			}
+			v.emit(&VerifyFinding{Kind: TxGapFinding, Block: block, Tx: tx, Detail: detail})
+		})
+		nextTx = tx + 1
+
+		if err := v.checkSubstate(block, tx, iter.Value()); err != nil {
+			return stats, err
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return stats, err
+	}
+
+	if orphans {
+		if err := db.verifyOrphanedCodes(v.codes, stats, v.emit); err != nil {
+			return stats, err
+		}
+	}
+
+	return stats, nil
+}
+
+// VerifySelected checks the substates of keys like Verify, without checking
+// tx gaps and orphaned code. Keys must be in ascending order, see
+// SelectSubstates. Selected keys without substate, e.g. from an outdated
+// index, are reported as undecodable.
+func (db *SubstateDB) VerifySelected(keys []SubstateKey, report func(*VerifyFinding)) (*VerifyStats, error) {
+	v := newSubstateVerifier(db, report)
+	stats := v.stats
+
+	for i, key := range keys {
+		if i == 0 || key.Block != keys[i-1].Block {
+			stats.NumBlocks++
+		}
+		dbKey := Stage1SubstateKey(key.Block, key.Tx)
+		has, err := db.backend.Has(dbKey)
+		if err != nil {
+			return stats, &SubstateError{Block: key.Block, Tx: key.Tx, Err: err}
+		}
+		if !has {
+			stats.NumSubstates++
+			v.emit(&VerifyFinding{Kind: UndecodableFinding, Block: key.Block, Tx: key.Tx, Detail: "substate not found"})
+			continue
+		}
+		value, err := db.backend.Get(dbKey)
+		if err != nil {
+			return stats, &SubstateError{Block: key.Block, Tx: key.Tx, Err: err}
+		}
+		if err := v.checkSubstate(key.Block, key.Tx, value); err != nil {
+			return stats, err
+		}
+	}
+
+	return stats, nil
+}
+
+// verifyOrphanedCodes reports code blobs that are not in referenced.
+func (db *SubstateDB) verifyOrphanedCodes(referenced map[common.Hash]bool, stats *VerifyStats, emit func(*VerifyFinding)) error {
+	iter := db.backend.NewIterator([]byte(stage1CodePrefix), nil)
+	defer iter.Release()
+
+	for iter.Next() {
+		key := iter.Key()
+		codeHash, err := DecodeStage1CodeKey(key)
+		if err != nil {
+			emit(&VerifyFinding{Kind: InvalidKeyFinding, Detail: fmt.Sprintf("key %#x: %v", key, err)})
+			continue
+		}
+		stats.NumCodes++
+		if _, exist := referenced[codeHash]; !exist {
+			emit(&VerifyFinding{Kind: OrphanedCodeFinding,
+				Detail: fmt.Sprintf("code %s (%v bytes)", codeHash.Hex(), len(iter.Value()))})
+		}
+	}
+	return iter.Error()
+}
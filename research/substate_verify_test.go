@@ -0,0 +1,82 @@
+package research
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+)
+
+func TestVerifyPruned(t *testing.T) {
+	db := NewSubstateDB(rawdb.NewMemoryDatabase())
+	put := func(block uint64, tx int, substate *Substate) {
+		if err := db.PutSubstate(block, tx, substate); err != nil {
+			t.Fatal(err)
+		}
+	}
+	put(20, 0, newTestSubstate(20, false))
+	put(20, 1, newTestTransferSubstate(20)) // pruned
+	put(20, 2, newTestSubstate(20, false))
+	put(21, 0, newTestSubstate(21, false))  // tx 1 missing
+	put(21, 2, newTestTransferSubstate(21)) // pruned
+	put(21, 3, newTestSubstate(21, false))
+	put(22, 0, newTestTransferSubstate(22)) // pruned
+	put(22, 1, newTestTransferSubstate(22)) // pruned
+	put(22, 2, newTestSubstate(22, false))
+	if _, err := db.Reindex(20, 22, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.PruneSubstates(20, 22, []SubstateTxKind{TransferTx}, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	var findings []VerifyFinding
+	stats, err := db.Verify(20, 22, true, func(f *VerifyFinding) {
+		findings = append(findings, *f)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []VerifyFinding{{Kind: TxGapFinding, Block: 21, Tx: 3, Detail: "missing tx 1"}}
+	if !reflect.DeepEqual(findings, want) {
+		t.Fatalf("findings %v, want %v", findings, want)
+	}
+	if stats.NumSubstates != 5 || stats.NumBlocks != 3 {
+		t.Fatalf("verified %v substates of %v blocks, want 5 of 3", stats.NumSubstates, stats.NumBlocks)
+	}
+}
+
+func TestVerifySelected(t *testing.T) {
+	db := NewSubstateDB(rawdb.NewMemoryDatabase())
+	for _, tx := range []int{0, 2} { // tx 1 missing
+		if err := db.PutSubstate(20, tx, newTestSubstate(20, false)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a tx hash of a substate that was never written
+	txHash := common.Hash{0x0a}
+	if err := db.PutTxHash(21, 0, txHash); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := db.SelectSubstates(&SubstateSelector{TxHashes: []common.Hash{txHash}, Addresses: []common.Address{{0x02}}}, 0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var findings []VerifyFinding
+	stats, err := db.VerifySelected(keys, func(f *VerifyFinding) {
+		findings = append(findings, *f)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// tx gaps are not checked
+	want := []VerifyFinding{{Kind: UndecodableFinding, Block: 21, Tx: 0, Detail: "substate not found"}}
+	if !reflect.DeepEqual(findings, want) {
+		t.Fatalf("findings %v, want %v", findings, want)
+	}
+	if stats.NumSubstates != 3 || stats.NumBlocks != 2 {
+		t.Fatalf("verified %v substates of %v blocks, want 3 of 2", stats.NumSubstates, stats.NumBlocks)
+	}
+}